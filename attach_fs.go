@@ -0,0 +1,24 @@
+//go:build go1.16
+// +build go1.16
+
+package email
+
+import (
+	"io/fs"
+	"path"
+)
+
+// AttachFromFS is used to attach content from a file in fsys, such as an embed.FS, to the email.
+// Like AttachFile, the Content-Type is derived from the file extension and the base name is used as the filename.
+// The function will then return the Attachment for reference, as well as nil for the error, if successful.
+func (e *Email) AttachFromFS(fsys fs.FS, name string) (a *Attachment, err error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	ct := contentTypeByExtension(path.Ext(name))
+	basename := path.Base(name)
+	return e.Attach(f, basename, ct)
+}
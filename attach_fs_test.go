@@ -0,0 +1,33 @@
+//go:build go1.16
+// +build go1.16
+
+package email
+
+import (
+	"bytes"
+	"testing"
+	"testing/fstest"
+)
+
+func TestAttachFromFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"assets/logo.png": {Data: []byte("Let's just pretend this is raw PNG data.")},
+	}
+	e := prepareEmail()
+	a, err := e.AttachFromFS(fsys, "assets/logo.png")
+	if err != nil {
+		t.Fatal("Could not attach file: ", err)
+	}
+	if a.Filename != "logo.png" {
+		t.Errorf("Incorrect filename: %#q", a.Filename)
+	}
+	if a.ContentType != "image/png" {
+		t.Errorf("Incorrect content type: %#q", a.ContentType)
+	}
+	if !bytes.Equal(a.Content, fsys["assets/logo.png"].Data) {
+		t.Errorf("Incorrect content: %#q", a.Content)
+	}
+	if _, err := e.AttachFromFS(fsys, "assets/missing.png"); err == nil {
+		t.Error("Expected an error attaching a missing file")
+	}
+}
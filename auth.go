@@ -0,0 +1,46 @@
+package email
+
+import (
+	"fmt"
+	"net/smtp"
+	"strings"
+)
+
+// negotiatedAuth is an smtp.Auth which uses the first of several mechanisms
+// that the server advertises. It holds the state of a single authentication,
+// so a new one is needed for each connection.
+type negotiatedAuth struct {
+	auths  []smtp.Auth
+	chosen smtp.Auth
+}
+
+// Start starts each mechanism in turn, and continues with the first one which
+// starts without an error and is advertised by the server.
+func (a *negotiatedAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	var tried []string
+	var firstErr error
+	for _, auth := range a.auths {
+		proto, toServer, err := auth.Start(server)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		for _, mech := range server.Auth {
+			if strings.EqualFold(mech, proto) {
+				a.chosen = auth
+				return proto, toServer, nil
+			}
+		}
+		tried = append(tried, proto)
+	}
+	if firstErr != nil {
+		return "", nil, firstErr
+	}
+	return "", nil, fmt.Errorf("None of the AUTH mechanisms %v is supported by the server, which supports %v", tried, server.Auth)
+}
+
+func (a *negotiatedAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	return a.chosen.Next(fromServer, more)
+}
@@ -0,0 +1,119 @@
+package email
+
+import (
+	"errors"
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testAuth is an smtp.Auth for a named mechanism which records its use.
+type testAuth struct {
+	proto string
+	next  int
+}
+
+func (a *testAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	return a.proto, []byte(a.proto), nil
+}
+
+func (a *testAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		a.next++
+	}
+	return nil, nil
+}
+
+func TestNegotiatedAuth(t *testing.T) {
+	xoauth2 := &testAuth{proto: "XOAUTH2"}
+	login := &testAuth{proto: "LOGIN"}
+	a := &negotiatedAuth{auths: []smtp.Auth{xoauth2, login}}
+	proto, toServer, err := a.Start(&smtp.ServerInfo{Name: "localhost", Auth: []string{"LOGIN"}})
+	if err != nil {
+		t.Fatal("Could not start authentication: ", err)
+	}
+	if proto != "LOGIN" || string(toServer) != "LOGIN" {
+		t.Errorf("Expected LOGIN to be chosen, got %q", proto)
+	}
+	if _, err := a.Next([]byte("Username:"), true); err != nil || login.next != 1 || xoauth2.next != 0 {
+		t.Errorf("Next was not passed to the chosen mechanism: %v", err)
+	}
+
+	a = &negotiatedAuth{auths: []smtp.Auth{&testAuth{proto: "XOAUTH2"}}}
+	if _, _, err := a.Start(&smtp.ServerInfo{Name: "localhost", Auth: []string{"LOGIN"}}); err == nil {
+		t.Error("Expected an error when no mechanism is supported")
+	}
+}
+
+func TestNegotiatedAuthSendMail(t *testing.T) {
+	client, server := net.Pipe()
+	go serveSMTP(server, nil)
+
+	e := prepareEmail()
+	e.Text = []byte("Hello!\n")
+	raw, err := e.Bytes()
+	if err != nil {
+		t.Fatal("Could not serialize e-mail:", err)
+	}
+	var events []string
+	o := &sendOptions{localName: "localhost", trace: func(event string) {
+		events = append(events, event)
+	}}
+	auth := &negotiatedAuth{auths: []smtp.Auth{
+		&testAuth{proto: "XOAUTH2"},
+		smtp.PlainAuth("", "user", "secret", "localhost"),
+	}}
+	if err := sendMail(client, "localhost", auth, nil, o, e, "test@example.com", []string{"test@example.com"}, raw); err != nil {
+		t.Fatal("Could not send message: ", err)
+	}
+	if log := strings.Join(events, "\n"); !strings.Contains(log, "C: AUTH PLAIN") {
+		t.Errorf("Expected AUTH PLAIN to be used:\n%s", log)
+	}
+}
+
+func TestPoolAuthFunc(t *testing.T) {
+	s := newFakeServer(t, "AUTH XOAUTH2")
+	defer s.Close()
+	p, err := NewPool(s.addr(), 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	var mu sync.Mutex
+	var calls int
+	p.SetAuthFunc(func() (smtp.Auth, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		return &testAuth{proto: "XOAUTH2"}, nil
+	})
+
+	if err := p.Warm(2); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("Auth func called %d times for 2 connections", calls)
+	}
+	var auths int
+	for _, cmd := range s.commands() {
+		if strings.HasPrefix(cmd, "AUTH XOAUTH2 ") {
+			auths++
+		}
+	}
+	if auths != 2 {
+		t.Errorf("Got %d AUTH commands for 2 connections", auths)
+	}
+
+	// A failing auth func fails the build.
+	p2, err := NewPool(s.addr(), 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p2.Close()
+	p2.SetAuthFunc(func() (smtp.Auth, error) { return nil, errors.New("token expired") })
+	if err := p2.Warm(1); err == nil || err.Error() != "token expired" {
+		t.Errorf("Expected the auth func's error, got %v", err)
+	}
+}
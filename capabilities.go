@@ -0,0 +1,139 @@
+package email
+
+import (
+	"context"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ServerCapabilities describes the ESMTP extensions advertised by an SMTP
+// server in response to EHLO.
+type ServerCapabilities struct {
+	// Extensions maps each advertised extension keyword, in upper case, to its
+	// parameters (e.g. "SIZE" => "35882577").
+	Extensions map[string]string
+}
+
+// Supports reports whether the server advertised the named extension.
+func (sc *ServerCapabilities) Supports(ext string) bool {
+	_, ok := sc.Extensions[strings.ToUpper(ext)]
+	return ok
+}
+
+// SupportsSTARTTLS reports whether the server advertised STARTTLS.
+func (sc *ServerCapabilities) SupportsSTARTTLS() bool {
+	return sc.Supports("STARTTLS")
+}
+
+// MaxSize returns the maximum message size advertised with the SIZE extension,
+// or 0 if the server didn't advertise a limit.
+func (sc *ServerCapabilities) MaxSize() int64 {
+	size, err := strconv.ParseInt(sc.Extensions["SIZE"], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return size
+}
+
+// AuthMechanisms returns the SASL mechanisms advertised with the AUTH extension.
+func (sc *ServerCapabilities) AuthMechanisms() []string {
+	return strings.Fields(sc.Extensions["AUTH"])
+}
+
+// parseEHLO parses the lines of an EHLO response, excluding the greeting on
+// the first line, into ServerCapabilities.
+func parseEHLO(msg string) *ServerCapabilities {
+	sc := &ServerCapabilities{Extensions: map[string]string{}}
+	lines := strings.Split(msg, "\n")
+	if len(lines) > 1 {
+		for _, line := range lines[1:] {
+			args := strings.SplitN(line, " ", 2)
+			var params string
+			if len(args) > 1 {
+				params = args[1]
+			}
+			sc.Extensions[strings.ToUpper(args[0])] = params
+		}
+	}
+	return sc
+}
+
+// DefaultProbeTimeout bounds the conversation of Probe with the server.
+var DefaultProbeTimeout = 30 * time.Second
+
+// Probe connects to the SMTP server at addr, issues an EHLO and returns the
+// extensions it advertised, before cleanly closing the connection with QUIT.
+// It gives up after DefaultProbeTimeout. Note that some servers only
+// advertise certain extensions, such as AUTH, after STARTTLS.
+func Probe(addr string) (*ServerCapabilities, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultProbeTimeout)
+	defer cancel()
+	return ProbeContext(ctx, addr)
+}
+
+// ProbeContext is like Probe, but gives up when ctx is done instead. The
+// server is greeted with the local host name, as SendDirect does.
+func ProbeContext(ctx context.Context, addr string) (*ServerCapabilities, error) {
+	p, err := NewPool(addr, 1, nil)
+	if err != nil {
+		return nil, err
+	}
+	p.SetHelloHostname(localHostname())
+	c, err := p.dial(ctx)
+	if err != nil {
+		return nil, contextErr(ctx, err)
+	}
+	defer c.Close()
+	// Abort the conversation if ctx is cancelled.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.conn.Close()
+		case <-done:
+		}
+	}()
+
+	// net/smtp keeps the response to its EHLO to itself, so ask again.
+	sc, err := ehlo(c.Text, p.helloHostname)
+	if err == nil {
+		err = textCmd(c.Text, 221, "QUIT")
+	}
+	if err != nil {
+		return nil, contextErr(ctx, err)
+	}
+	return sc, nil
+}
+
+// contextErr returns ctx's error in place of err once ctx is done, or its
+// deadline has passed, which the connection's deadline may notice first.
+func contextErr(ctx context.Context, err error) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		if ne, ok := err.(net.Error); (ok && ne.Timeout()) || !time.Now().Before(deadline) {
+			return context.DeadlineExceeded
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// ehlo issues an EHLO with the given hostname, and parses the response.
+func ehlo(text *textproto.Conn, hostname string) (*ServerCapabilities, error) {
+	id, err := text.Cmd("EHLO %s", hostname)
+	if err != nil {
+		return nil, err
+	}
+	text.StartResponse(id)
+	defer text.EndResponse(id)
+	_, msg, err := text.ReadResponse(250)
+	if err != nil {
+		return nil, err
+	}
+	return parseEHLO(msg), nil
+}
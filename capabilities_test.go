@@ -0,0 +1,96 @@
+package email
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProbe(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Could not listen: ", err)
+	}
+	defer ln.Close()
+	hellos := make(chan string, 2)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		conn.Write([]byte("220 mx.example.com ESMTP\r\n"))
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch {
+			case strings.HasPrefix(line, "EHLO "):
+				hellos <- strings.TrimSpace(line[len("EHLO "):])
+				conn.Write([]byte("250-mx.example.com\r\n250-SIZE 35882577\r\n250-8BITMIME\r\n250-STARTTLS\r\n250 AUTH PLAIN LOGIN\r\n"))
+			case strings.HasPrefix(line, "QUIT"):
+				conn.Write([]byte("221 Bye\r\n"))
+				return
+			default:
+				conn.Write([]byte("502 Unrecognized command\r\n"))
+			}
+		}
+	}()
+
+	sc, err := Probe(ln.Addr().String())
+	if err != nil {
+		t.Fatal("Could not probe server: ", err)
+	}
+	if got := sc.MaxSize(); got != 35882577 {
+		t.Errorf("Incorrect max size: %d", got)
+	}
+	if !sc.SupportsSTARTTLS() {
+		t.Error("STARTTLS not supported")
+	}
+	if !sc.Supports("8bitmime") {
+		t.Error("8BITMIME not supported")
+	}
+	if sc.Supports("SMTPUTF8") {
+		t.Error("SMTPUTF8 unexpectedly supported")
+	}
+	if got, want := sc.AuthMechanisms(), []string{"PLAIN", "LOGIN"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Incorrect auth mechanisms: %v != %v", got, want)
+	}
+	if got, want := <-hellos, localHostname(); got != want {
+		t.Errorf("Incorrect EHLO hostname: %q != %q", got, want)
+	}
+}
+
+func TestProbeContext(t *testing.T) {
+	// A server which accepts connections but never greets them.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Could not listen: ", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := ProbeContext(ctx, ln.Addr().String()); err != context.DeadlineExceeded {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("ProbeContext took %v to time out", d)
+	}
+}
@@ -0,0 +1,142 @@
+package email
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// CharsetReader, if non-nil, is used when parsing to convert text parts and
+// RFC 2047 encoded-words from charsets other than UTF-8, US-ASCII, ISO-8859-1
+// and Windows-1252 to UTF-8. For example, it may be set to
+// charset.NewReaderLabel from golang.org/x/net/html/charset.
+var CharsetReader func(charset string, input io.Reader) (io.Reader, error)
+
+// DefaultCharset is the charset assumed when parsing text parts which don't
+// declare one, or which declare US-ASCII but contain 8-bit bytes. If it is
+// UTF-8 and the text isn't valid UTF-8, it is decoded as Windows-1252 instead.
+var DefaultCharset = "utf-8"
+
+// CharsetLabel is how the UTF-8 charset is spelled in the Content-Type of
+// rendered text bodies and in RFC 2047 encoded-words, such as "utf-8" or
+// "UTF-8". Charset names are case-insensitive, but some old clients only
+// recognize one spelling.
+var CharsetLabel = "utf-8"
+
+// windows1252 maps the bytes 0x80-0x9F of Windows-1252 to their code points.
+// The remaining bytes are the same as in ISO-8859-1.
+var windows1252 = [32]rune{
+	'€', '\u0081', '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', '\u008d', 'Ž', '\u008f',
+	'\u0090', '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', '\u009d', 'ž', 'Ÿ',
+}
+
+// wordDecoder returns a mime.WordDecoder which uses CharsetReader for charsets
+// it doesn't support natively. Encoded-words labeled as Latin-1 whose bytes
+// are valid, non-ASCII UTF-8 are taken to be mislabeled UTF-8, as Latin-1 text
+// almost never happens to form valid multi-byte sequences. mime.WordDecoder
+// handles "iso-8859-1" itself, so headers must go through relabelLatin1 for
+// that to apply to it.
+func wordDecoder() *mime.WordDecoder {
+	return &mime.WordDecoder{CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+		if isLatin1(charset) {
+			b, err := ioutil.ReadAll(input)
+			if err != nil {
+				return nil, err
+			}
+			if !isASCII(b) && utf8.Valid(b) {
+				return bytes.NewReader(b), nil
+			}
+			return bytes.NewReader(toUTF8(charset, b)), nil
+		}
+		if CharsetReader == nil {
+			return nil, errUnsupportedCharset(charset)
+		}
+		return CharsetReader(charset, input)
+	}}
+}
+
+var latin1Word = regexp.MustCompile(`(?i)=\?iso-8859-1([?*])`)
+
+// relabelLatin1 relabels "iso-8859-1" encoded-words in s as "latin1", so that
+// mime.WordDecoder hands them to the CharsetReader of wordDecoder.
+func relabelLatin1(s string) string {
+	return latin1Word.ReplaceAllString(s, "=?latin1$1")
+}
+
+type errUnsupportedCharset string
+
+func (e errUnsupportedCharset) Error() string {
+	return "unsupported charset: " + string(e)
+}
+
+func isLatin1(charset string) bool {
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "latin1", "windows-1252", "cp1252":
+		return true
+	}
+	return false
+}
+
+func isASCII(b []byte) bool {
+	for _, c := range b {
+		if c >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// toUTF8 converts b from the given charset to UTF-8. If the charset isn't
+// supported, or b can't be converted, b is returned with any invalid UTF-8
+// replaced by U+FFFD, so that the result is always valid UTF-8.
+func toUTF8(charset string, b []byte) []byte {
+	b = convertToUTF8(charset, b)
+	if !utf8.Valid(b) {
+		return bytes.ToValidUTF8(b, []byte("\uFFFD"))
+	}
+	return b
+}
+
+// convertToUTF8 does the conversion for toUTF8, but may return invalid UTF-8.
+func convertToUTF8(charset string, b []byte) []byte {
+	if cs := strings.ToLower(charset); cs == "" || cs == "us-ascii" {
+		if isASCII(b) {
+			return b
+		}
+		charset = DefaultCharset
+		if cs := strings.ToLower(charset); (cs == "utf-8" || cs == "utf8") && !utf8.Valid(b) {
+			charset = "windows-1252"
+		}
+	}
+	switch cs := strings.ToLower(charset); {
+	case cs == "", cs == "utf-8", cs == "utf8", cs == "us-ascii":
+		return b
+	case isLatin1(cs):
+		var buf bytes.Buffer
+		buf.Grow(len(b) + len(b)/4)
+		for _, c := range b {
+			r := rune(c)
+			if c >= 0x80 && c < 0xa0 && strings.HasSuffix(cs, "1252") {
+				r = windows1252[c-0x80]
+			}
+			buf.WriteRune(r)
+		}
+		return buf.Bytes()
+	}
+	if CharsetReader == nil {
+		return b
+	}
+	r, err := CharsetReader(charset, bytes.NewReader(b))
+	if err != nil {
+		return b
+	}
+	converted, err := ioutil.ReadAll(r)
+	if err != nil {
+		return b
+	}
+	return converted
+}
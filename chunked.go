@@ -0,0 +1,182 @@
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ChunkedReader reads from an underlying reader in chunks of a fixed length,
+// such as the BDAT chunks of the SMTP CHUNKING extension (RFC 3030).
+type ChunkedReader struct {
+	r       *bufio.Reader
+	buf     []byte
+	pending []byte
+	err     error
+}
+
+// NewChunkedReader returns a ChunkedReader which reads chunks of chunkLen
+// bytes from r.
+func NewChunkedReader(r io.Reader, chunkLen int) *ChunkedReader {
+	if chunkLen <= 0 {
+		panic("email: NewChunkedReader called with a chunk length <= 0")
+	}
+	return &ChunkedReader{r: bufio.NewReader(r), buf: make([]byte, chunkLen)}
+}
+
+// ReadChunk returns the next chunk, which is chunkLen bytes long unless it is
+// the last one. The last chunk, which may be empty, is returned along with
+// io.EOF. The chunk is only valid until the next call to ReadChunk or Read.
+func (cr *ChunkedReader) ReadChunk() ([]byte, error) {
+	if cr.err != nil {
+		return nil, cr.err
+	}
+	n, err := io.ReadFull(cr.r, cr.buf)
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		cr.err = io.EOF
+	case err != nil:
+		cr.err = err
+		return nil, err
+	default:
+		// Look ahead, so that a full last chunk is still reported as the last.
+		if _, err := cr.r.Peek(1); err != nil {
+			cr.err = err
+		}
+	}
+	return cr.buf[:n], cr.err
+}
+
+// Read implements io.Reader, reading the chunks into b regardless of its
+// length, so that a ChunkedReader can be used with io.Copy.
+func (cr *ChunkedReader) Read(b []byte) (int, error) {
+	if len(cr.pending) == 0 {
+		if cr.err != nil {
+			return 0, cr.err
+		}
+		var err error
+		if cr.pending, err = cr.ReadChunk(); err != nil && err != io.EOF {
+			return 0, err
+		}
+	}
+	n := copy(b, cr.pending)
+	cr.pending = cr.pending[n:]
+	if len(cr.pending) == 0 && cr.err != nil {
+		return n, cr.err
+	}
+	return n, nil
+}
+
+// WriteChunks renders the message and writes it to w in chunks of at most
+// chunkSize bytes, such as for a message queue which limits the size of its
+// messages, returning the number of chunks. Each chunk is preceded by a line
+// with its sequence number, starting at 0, its length, and "LAST" if it is
+// the last chunk, and is written with a single call to w.Write, so that w may
+// publish each call as a separate queue message. The chunks, concatenated in
+// order, are reassembled by NewChunkAssembler.
+func (e *Email) WriteChunks(w io.Writer, chunkSize int) (int, error) {
+	if chunkSize <= 0 {
+		return 0, fmt.Errorf("Invalid chunk size %d", chunkSize)
+	}
+	raw, err := e.Bytes()
+	if err != nil {
+		return 0, err
+	}
+	cr := NewChunkedReader(bytes.NewReader(raw), chunkSize)
+	var frame bytes.Buffer
+	for seq := 0; ; seq++ {
+		chunk, err := cr.ReadChunk()
+		if err != nil && err != io.EOF {
+			return seq, err
+		}
+		last := err == io.EOF
+		frame.Reset()
+		fmt.Fprintf(&frame, "%d %d", seq, len(chunk))
+		if last {
+			frame.WriteString(" LAST")
+		}
+		frame.WriteString("\r\n")
+		frame.Write(chunk)
+		if _, err := w.Write(frame.Bytes()); err != nil {
+			return seq, err
+		}
+		if last {
+			return seq + 1, nil
+		}
+	}
+}
+
+// ChunkAssembler reads the message written by Email.WriteChunks back from its
+// chunks, checking that none are missing or out of order.
+type ChunkAssembler struct {
+	r         *bufio.Reader
+	seq       int
+	remaining int
+	last      bool
+	err       error
+}
+
+// NewChunkAssembler returns a ChunkAssembler which reads the chunks from r,
+// which can then be passed to NewEmailFromReader.
+func NewChunkAssembler(r io.Reader) *ChunkAssembler {
+	return &ChunkAssembler{r: bufio.NewReader(r)}
+}
+
+// Read implements io.Reader, returning the content of the chunks. It returns
+// io.EOF after the last chunk, or io.ErrUnexpectedEOF if r ends before it.
+func (a *ChunkAssembler) Read(b []byte) (int, error) {
+	for a.remaining == 0 && a.err == nil {
+		if a.last {
+			a.err = io.EOF
+			break
+		}
+		a.err = a.readHeader()
+	}
+	if a.err != nil {
+		return 0, a.err
+	}
+	if len(b) > a.remaining {
+		b = b[:a.remaining]
+	}
+	n, err := a.r.Read(b)
+	a.remaining -= n
+	if err == io.EOF {
+		// The end of r is only expected after the last chunk's header.
+		err = nil
+		if a.remaining > 0 {
+			err = io.ErrUnexpectedEOF
+			a.err = err
+		}
+	}
+	return n, err
+}
+
+// readHeader reads the line which precedes a chunk.
+func (a *ChunkAssembler) readHeader() error {
+	line, err := a.r.ReadString('\n')
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 || (len(fields) == 3 && fields[2] != "LAST") {
+		return fmt.Errorf("Invalid chunk header %q", strings.TrimSpace(line))
+	}
+	seq, err := strconv.Atoi(fields[0])
+	if err != nil || seq != a.seq {
+		return fmt.Errorf("Expected chunk %d, got %q", a.seq, fields[0])
+	}
+	length, err := strconv.Atoi(fields[1])
+	if err != nil || length < 0 {
+		return fmt.Errorf("Invalid length %q of chunk %d", fields[1], seq)
+	}
+	a.seq++
+	a.remaining = length
+	a.last = len(fields) == 3
+	return nil
+}
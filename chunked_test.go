@@ -0,0 +1,118 @@
+package email
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestChunkedReaderReadChunk(t *testing.T) {
+	for _, length := range []int{0, 1, 9, 10, 11, 30} {
+		content := bytes.Repeat([]byte("x"), length)
+		cr := NewChunkedReader(bytes.NewReader(content), 10)
+		var got []byte
+		for {
+			chunk, err := cr.ReadChunk()
+			if err != nil && err != io.EOF {
+				t.Fatalf("%d: unexpected error: %v", length, err)
+			}
+			if err == nil && len(chunk) != 10 {
+				t.Errorf("%d: got a chunk of %d bytes before the last", length, len(chunk))
+			}
+			got = append(got, chunk...)
+			if err == io.EOF {
+				break
+			}
+		}
+		if !bytes.Equal(got, content) {
+			t.Errorf("%d: chunks did not match the content: %d bytes", length, len(got))
+		}
+		if _, err := cr.ReadChunk(); err != io.EOF {
+			t.Errorf("%d: expected io.EOF after the last chunk, got %v", length, err)
+		}
+	}
+}
+
+func TestChunkedReaderRead(t *testing.T) {
+	content := make([]byte, 1000)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	for _, bufLen := range []int{1, 7, 64, 100, 4096} {
+		var got bytes.Buffer
+		cr := NewChunkedReader(bytes.NewReader(content), 64)
+		if _, err := io.CopyBuffer(&got, struct{ io.Reader }{cr}, make([]byte, bufLen)); err != nil {
+			t.Fatalf("%d: unexpected error: %v", bufLen, err)
+		}
+		if !bytes.Equal(got.Bytes(), content) {
+			t.Errorf("%d: read content did not match", bufLen)
+		}
+	}
+}
+
+// chunkRecorder records each call to Write as a separate chunk.
+type chunkRecorder struct {
+	chunks [][]byte
+}
+
+func (r *chunkRecorder) Write(b []byte) (int, error) {
+	r.chunks = append(r.chunks, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func TestWriteChunks(t *testing.T) {
+	e := prepareEmail()
+	e.Text = bytes.Repeat([]byte("Text Body is, of course, supported!\n"), 50)
+	if _, err := e.Attach(bytes.NewBufferString("Rad attachment"), "rad.txt", "text/plain"); err != nil {
+		t.Fatal("Could not add an attachment to the message: ", err)
+	}
+	e.Headers.Set("Date", "Thu, 17 Oct 2019 08:55:37 +0100")
+	e.Headers.Set("Message-Id", "<chunks@example.com>")
+	raw, err := e.Bytes()
+	if err != nil {
+		t.Fatal("Failed to render message: ", err)
+	}
+
+	var rec chunkRecorder
+	n, err := e.WriteChunks(&rec, 500)
+	if err != nil {
+		t.Fatal("Could not write chunks: ", err)
+	}
+	if n != len(rec.chunks) || n != (len(raw)+499)/500 {
+		t.Errorf("Expected %d chunks, got %d and %d writes", (len(raw)+499)/500, n, len(rec.chunks))
+	}
+
+	// Each rendering has different boundaries and header order, so the
+	// reassembled message is compared with the original by length and by
+	// parsing it.
+	stream := bytes.Join(rec.chunks, nil)
+	got, err := ioutil.ReadAll(NewChunkAssembler(bytes.NewReader(stream)))
+	if err != nil {
+		t.Fatal("Could not reassemble chunks: ", err)
+	}
+	if len(got) != len(raw) {
+		t.Errorf("Reassembled message is %d bytes, expected %d", len(got), len(raw))
+	}
+	parsed, err := NewEmailFromReader(bytes.NewReader(got))
+	if err != nil {
+		t.Fatal("Could not parse reassembled message: ", err)
+	}
+	if parsed.Subject != e.Subject || !bytes.Equal(parsed.Text, toCRLF(e.Text)) {
+		t.Errorf("Reassembled message does not match the original: %q", parsed.Subject)
+	}
+	if len(parsed.Attachments) != 1 || string(parsed.Attachments[0].Content) != "Rad attachment" {
+		t.Errorf("Incorrect attachments: %v", parsed.Attachments)
+	}
+
+	// Missing, reordered and truncated chunks are detected.
+	for name, broken := range map[string][]byte{
+		"missing":   bytes.Join(append(append([][]byte(nil), rec.chunks[:1]...), rec.chunks[2:]...), nil),
+		"reordered": bytes.Join(append([][]byte{rec.chunks[1], rec.chunks[0]}, rec.chunks[2:]...), nil),
+		"truncated": bytes.Join(rec.chunks[:len(rec.chunks)-1], nil),
+	} {
+		if _, err := ioutil.ReadAll(NewChunkAssembler(bytes.NewReader(broken))); err == nil {
+			t.Errorf("%s: expected an error reassembling the chunks", name)
+		}
+	}
+}
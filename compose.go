@@ -0,0 +1,222 @@
+package email
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+)
+
+// replyPrefix matches any number of leading "Re:" markers on a subject.
+var replyPrefix = regexp.MustCompile(`(?i)^(\s*re\s*:\s*)+`)
+
+// Reply returns a copy of e composed as a reply to original. The Subject is
+// prefixed with "Re:", the reply is addressed to the original's Reply-To or
+// From address, and In-Reply-To and References are set so that it is threaded
+// with the original. If replyAll is true, the original's other To and Cc
+// recipients are copied, except for e.From.
+//
+// e.Text and e.HTML are the new content of the reply, which is followed by an
+// attribution line ("On <date>, <sender> wrote:") and the original body, quoted
+// with "> " in the plaintext and in a <blockquote> in the HTML.
+func (e *Email) Reply(original *Email, replyAll bool) (*Email, error) {
+	r := e.Clone()
+	r.Subject = "Re: " + replyPrefix.ReplaceAllString(original.Subject, "")
+	r.RawSubject = ""
+
+	r.To = append([]string(nil), original.ReplyTo...)
+	if len(r.To) == 0 {
+		if original.From == "" {
+			return nil, errors.New("No Reply-To or From found in the original message")
+		}
+		r.To = []string{original.From}
+	}
+	r.Cc = nil
+	if replyAll {
+		seen := map[string]bool{}
+		for _, addr := range append([]string{e.From}, r.To...) {
+			if a, err := mail.ParseAddress(addr); err == nil {
+				seen[strings.ToLower(a.Address)] = true
+			}
+		}
+		for _, addr := range append(append([]string(nil), original.To...), original.Cc...) {
+			a, err := mail.ParseAddress(addr)
+			if err != nil {
+				return nil, err
+			}
+			if seen[strings.ToLower(a.Address)] {
+				continue
+			}
+			seen[strings.ToLower(a.Address)] = true
+			r.Cc = append(r.Cc, addr)
+		}
+	}
+
+	if r.Headers == nil {
+		r.Headers = textproto.MIMEHeader{}
+	}
+	if original.Headers != nil {
+		if msgID := original.Headers.Get("Message-Id"); msgID != "" {
+			refs := original.Headers.Get("References")
+			if refs == "" {
+				refs = original.Headers.Get("In-Reply-To")
+			}
+			r.Headers.Set("In-Reply-To", msgID)
+			r.Headers.Set("References", strings.TrimSpace(refs+" "+msgID))
+		}
+	}
+
+	attribution := original.From + " wrote:"
+	if original.Headers != nil && original.Headers.Get("Date") != "" {
+		attribution = "On " + original.Headers.Get("Date") + ", " + attribution
+	}
+	if len(original.Text) > 0 || len(e.Text) > 0 {
+		r.Text = appendQuoted(e.Text, attribution, original.Text)
+	}
+	if len(original.HTML) > 0 || len(e.HTML) > 0 {
+		r.HTML = appendBlockquote(htmlOf(e.Text, e.HTML), attribution, htmlOf(original.Text, original.HTML))
+	}
+	return r, nil
+}
+
+// appendQuoted returns text followed by the attribution line and quoted,
+// with each of its lines prefixed by "> ".
+func appendQuoted(text []byte, attribution string, quoted []byte) []byte {
+	var b bytes.Buffer
+	if len(text) > 0 {
+		b.Write(text)
+		if !bytes.HasSuffix(text, []byte("\n")) {
+			b.WriteString("\n")
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString(attribution + "\n")
+	lines := strings.Split(strings.TrimRight(string(quoted), "\r\n"), "\n")
+	for _, line := range lines {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" || strings.HasPrefix(line, ">") {
+			b.WriteString(">" + line + "\n")
+			continue
+		}
+		b.WriteString("> " + line + "\n")
+	}
+	return b.Bytes()
+}
+
+// appendBlockquote returns the HTML content followed by the attribution line
+// and quoted inside a <blockquote>.
+func appendBlockquote(content []byte, attribution string, quoted []byte) []byte {
+	var b bytes.Buffer
+	b.Write(content)
+	b.WriteString("<div>" + html.EscapeString(attribution) + "</div>\n")
+	b.WriteString("<blockquote type=\"cite\">\n")
+	b.Write(quoted)
+	b.WriteString("\n</blockquote>\n")
+	return b.Bytes()
+}
+
+// htmlOf returns the contents of the body element of doc, or if there is no
+// HTML, the escaped plaintext with line breaks.
+func htmlOf(text, doc []byte) []byte {
+	if len(doc) == 0 {
+		s := html.EscapeString(strings.TrimRight(string(text), "\r\n"))
+		s = strings.Replace(strings.Replace(s, "\r\n", "\n", -1), "\n", "<br>\n", -1)
+		if s == "" {
+			return nil
+		}
+		return []byte("<div>" + s + "</div>\n")
+	}
+	lower := bytes.ToLower(doc)
+	if i := bytes.Index(lower, []byte("<body")); i >= 0 {
+		if j := bytes.IndexByte(lower[i:], '>'); j >= 0 {
+			doc, lower = doc[i+j+1:], lower[i+j+1:]
+		}
+	}
+	if i := bytes.LastIndex(lower, []byte("</body>")); i >= 0 {
+		doc = doc[:i]
+	}
+	return doc
+}
+
+// ForwardMode selects how the original message is included in a forward.
+type ForwardMode int
+
+const (
+	// ForwardInline includes the original headers and body in the body of the
+	// forward, and copies the original attachments.
+	ForwardInline ForwardMode = iota
+	// ForwardAsAttachment attaches the original as a message/rfc822 part.
+	ForwardAsAttachment
+)
+
+// forwardPrefix matches any number of leading "Fwd:" or "Fw:" markers on a subject.
+var forwardPrefix = regexp.MustCompile(`(?i)^(\s*fwd?\s*:\s*)+`)
+
+// Forward returns a copy of e composed as a forward of original, with the
+// Subject prefixed with "Fwd:". e.Text and e.HTML are the new content of the
+// forward, and the recipients are left as they are in e.
+func (e *Email) Forward(original *Email, mode ForwardMode) (*Email, error) {
+	f := e.Clone()
+	f.Subject = "Fwd: " + forwardPrefix.ReplaceAllString(original.Subject, "")
+	f.RawSubject = ""
+
+	switch mode {
+	case ForwardAsAttachment:
+		if _, err := f.AttachMessage(original); err != nil {
+			return nil, err
+		}
+		return f, nil
+	case ForwardInline:
+	default:
+		return nil, fmt.Errorf("Invalid forward mode %d", mode)
+	}
+
+	var fields []string
+	fields = append(fields, "From: "+original.From)
+	if original.Headers != nil && original.Headers.Get("Date") != "" {
+		fields = append(fields, "Date: "+original.Headers.Get("Date"))
+	}
+	fields = append(fields, "Subject: "+original.Subject)
+	if len(original.To) > 0 {
+		fields = append(fields, "To: "+strings.Join(original.To, ", "))
+	}
+	if len(original.Cc) > 0 {
+		fields = append(fields, "Cc: "+strings.Join(original.Cc, ", "))
+	}
+	const separator = "---------- Forwarded message ----------"
+
+	if len(original.Text) > 0 || len(e.Text) > 0 {
+		var b bytes.Buffer
+		if len(e.Text) > 0 {
+			b.Write(e.Text)
+			if !bytes.HasSuffix(e.Text, []byte("\n")) {
+				b.WriteString("\n")
+			}
+			b.WriteString("\n")
+		}
+		b.WriteString(separator + "\n" + strings.Join(fields, "\n") + "\n\n")
+		b.Write(original.Text)
+		f.Text = b.Bytes()
+	}
+	if len(original.HTML) > 0 || len(e.HTML) > 0 {
+		var b bytes.Buffer
+		b.Write(htmlOf(e.Text, e.HTML))
+		b.WriteString("<div>" + separator + "<br>\n")
+		for _, field := range fields {
+			b.WriteString(html.EscapeString(field) + "<br>\n")
+		}
+		b.WriteString("</div>\n<br>\n")
+		b.Write(htmlOf(original.Text, original.HTML))
+		f.HTML = b.Bytes()
+	}
+	for _, a := range original.Attachments {
+		at := *a
+		at.Header = cloneHeader(a.Header)
+		f.Attachments = append(f.Attachments, &at)
+	}
+	return f, nil
+}
@@ -0,0 +1,134 @@
+package email
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestReply(t *testing.T) {
+	raw := []byte("From: Alice <alice@example.com>\r\n" +
+		"To: Bob <bob@example.com>, carol@example.com\r\n" +
+		"Cc: dave@example.com\r\n" +
+		"Subject: Re: Lunch\r\n" +
+		"Date: Mon, 02 Jan 2006 15:04:05 -0700\r\n" +
+		"Message-Id: <2@example.com>\r\n" +
+		"References: <1@example.com>\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Noon works.\r\n" +
+		"\r\n" +
+		"> How about noon?\r\n")
+	original, err := NewEmailFromReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Error parsing email %s", err.Error())
+	}
+	e := NewEmail()
+	e.From = "Bob <bob@example.com>"
+	e.Text = []byte("See you there.\n")
+	r, err := e.Reply(original, true)
+	if err != nil {
+		t.Fatal("Failed to compose reply: ", err)
+	}
+	if got, want := r.Subject, "Re: Lunch"; got != want {
+		t.Errorf("Incorrect subject: %#q != %#q", got, want)
+	}
+	if got, want := strings.Join(r.To, ", "), "Alice <alice@example.com>"; got != want {
+		t.Errorf("Incorrect To: %#q != %#q", got, want)
+	}
+	if got, want := strings.Join(r.Cc, ", "), "carol@example.com, dave@example.com"; got != want {
+		t.Errorf("Incorrect Cc: %#q != %#q", got, want)
+	}
+	if got, want := r.Headers.Get("In-Reply-To"), "<2@example.com>"; got != want {
+		t.Errorf("Incorrect In-Reply-To: %#q != %#q", got, want)
+	}
+	if got, want := r.Headers.Get("References"), "<1@example.com> <2@example.com>"; got != want {
+		t.Errorf("Incorrect References: %#q != %#q", got, want)
+	}
+	want := "See you there.\n\n" +
+		"On Mon, 02 Jan 2006 15:04:05 -0700, Alice <alice@example.com> wrote:\n" +
+		"> Noon works.\n" +
+		">\n" +
+		">> How about noon?\n"
+	if got := string(r.Text); got != want {
+		t.Errorf("Incorrect quoted text: %#q != %#q", got, want)
+	}
+	if len(r.HTML) != 0 {
+		t.Errorf("Unexpected HTML in reply: %#q", r.HTML)
+	}
+
+	original.HTML = []byte("<html><body><p>Noon works.</p></body></html>")
+	if r, err = e.Reply(original, false); err != nil {
+		t.Fatal("Failed to compose reply: ", err)
+	}
+	if len(r.Cc) != 0 {
+		t.Errorf("Unexpected Cc in reply: %#q", r.Cc)
+	}
+	if !bytes.Contains(r.HTML, []byte("<blockquote type=\"cite\">\n<p>Noon works.</p>\n</blockquote>")) {
+		t.Errorf("Original HTML was not quoted: %#q", r.HTML)
+	}
+	if !bytes.Contains(r.HTML, []byte("<div>See you there.</div>")) {
+		t.Errorf("Reply text was not included in the HTML: %#q", r.HTML)
+	}
+}
+
+func TestForward(t *testing.T) {
+	raw := []byte("From: Alice <alice@example.com>\r\n" +
+		"To: bob@example.com\r\n" +
+		"Subject: Fwd: Quarterly numbers\r\n" +
+		"Date: Mon, 02 Jan 2006 15:04:05 -0700\r\n" +
+		"Message-Id: <1@example.com>\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Numbers attached.\r\n")
+	original, err := NewEmailFromReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Error parsing email %s", err.Error())
+	}
+	e := NewEmail()
+	e.From = "bob@example.com"
+	e.To = []string{"carol@example.com"}
+	e.Text = []byte("FYI\n")
+
+	f, err := e.Forward(original, ForwardInline)
+	if err != nil {
+		t.Fatal("Failed to compose forward: ", err)
+	}
+	if got, want := f.Subject, "Fwd: Quarterly numbers"; got != want {
+		t.Errorf("Incorrect subject: %#q != %#q", got, want)
+	}
+	want := "FYI\n\n" +
+		"---------- Forwarded message ----------\n" +
+		"From: Alice <alice@example.com>\n" +
+		"Date: Mon, 02 Jan 2006 15:04:05 -0700\n" +
+		"Subject: Fwd: Quarterly numbers\n" +
+		"To: bob@example.com\n\n" +
+		"Numbers attached.\r\n"
+	if got := string(f.Text); got != want {
+		t.Errorf("Incorrect forwarded text: %#q != %#q", got, want)
+	}
+	if len(f.Attachments) != 0 {
+		t.Errorf("Unexpected attachments: %d", len(f.Attachments))
+	}
+
+	if f, err = e.Forward(original, ForwardAsAttachment); err != nil {
+		t.Fatal("Failed to compose forward: ", err)
+	}
+	if got, want := string(f.Text), "FYI\n"; got != want {
+		t.Errorf("Incorrect text: %#q != %#q", got, want)
+	}
+	if len(f.Attachments) != 1 || f.Attachments[0].ContentType != "message/rfc822" {
+		t.Fatalf("Original was not attached as message/rfc822")
+	}
+	rendered, err := f.Bytes()
+	if err != nil {
+		t.Fatal("Failed to render message: ", err)
+	}
+	f2, err := NewEmailFromReader(bytes.NewReader(rendered))
+	if err != nil {
+		t.Fatalf("Error parsing email %s", err.Error())
+	}
+	if len(f2.Embedded) != 1 || f2.Embedded[0].Subject != original.Subject {
+		t.Errorf("Forwarded message was not embedded")
+	}
+}
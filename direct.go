@@ -0,0 +1,241 @@
+package email
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// lookupMX resolves the MX records of a domain. It is a variable so that
+// tests can replace it.
+var lookupMX = net.DefaultResolver.LookupMX
+
+// directPort is the port SendDirect delivers to.
+var directPort = "25"
+
+// DefaultDirectTimeout is the time SendDirect allows the conversation with
+// each mail server, including connecting to it, when neither its context nor
+// DirectOptions.Timeout set a shorter one.
+var DefaultDirectTimeout = 10 * time.Minute
+
+// SendDirect delivers e straight to the mail servers of its recipients'
+// domains, rather than through a relay. The recipients are grouped by domain,
+// and for each domain the MX hosts are tried in order of preference until one
+// accepts the message. If a domain has no MX records, its address records are
+// used instead. STARTTLS is used whenever a server supports it.
+//
+// If the message is delivered to some domains but not others, a
+// *PartialSendError is returned.
+func SendDirect(ctx context.Context, e *Email) error {
+	return SendDirectWithOptions(ctx, e, nil)
+}
+
+// DirectOptions are optional parameters of SendDirectWithOptions.
+type DirectOptions struct {
+	// Hello returns the name to send in EHLO to the mail server at host,
+	// given the local address of the connection. Receivers commonly check
+	// that it matches the reverse DNS of that address, which may differ
+	// between connections on a multihomed machine. If Hello is nil or
+	// returns "", the host name reported by the kernel is sent.
+	Hello func(host string, local net.Addr) string
+
+	// Timeout limits the conversation with each mail server, including
+	// connecting to it. If it is 0, DefaultDirectTimeout is used.
+	Timeout time.Duration
+
+	// VerifyTLS makes STARTTLS fail, and the next mail server be tried, if
+	// the certificate of a mail server isn't valid for its name. By default,
+	// as is usual for opportunistic TLS between mail servers (RFC 7435), the
+	// certificate isn't verified, since self-signed and mismatched ones are
+	// common, and failing would only leave the message to be sent in the
+	// clear or not at all. Messages with RequireTLS are always verified.
+	VerifyTLS bool
+}
+
+// SendDirectWithOptions is like SendDirect, but uses opts for each connection
+// to a mail server. A nil opts behaves exactly like SendDirect.
+func SendDirectWithOptions(ctx context.Context, e *Email, opts *DirectOptions) error {
+	if opts == nil {
+		opts = &DirectOptions{}
+	}
+	if e.From == "" {
+		return errors.New("Must specify at least one From address and one To address")
+	}
+	recipients, err := addressLists(e.To, e.Cc, e.Bcc)
+	if err != nil {
+		return err
+	}
+	if len(recipients) == 0 {
+		return errors.New("Must specify at least one From address and one To address")
+	}
+	sender, err := e.parseSender()
+	if err != nil {
+		return err
+	}
+	msg, err := e.Bytes()
+	if err != nil {
+		return err
+	}
+
+	var domains []string
+	byDomain := make(map[string][]string)
+	for _, rcpt := range recipients {
+		domain := strings.ToLower(rcpt[strings.LastIndex(rcpt, "@")+1:])
+		if _, ok := byDomain[domain]; !ok {
+			domains = append(domains, domain)
+		}
+		byDomain[domain] = append(byDomain[domain], rcpt)
+	}
+
+	var delivered, failed []string
+	var firstErr error
+	for _, domain := range domains {
+		if err := sendToDomain(ctx, e, opts, domain, sender, byDomain[domain], msg); err != nil {
+			if pe, ok := err.(*PartialSendError); ok {
+				delivered = append(delivered, pe.Delivered...)
+				failed = append(failed, pe.Failed...)
+				err = pe.Err
+			} else {
+				failed = append(failed, byDomain[domain]...)
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		delivered = append(delivered, byDomain[domain]...)
+	}
+	if firstErr != nil && len(delivered) > 0 {
+		return &PartialSendError{Delivered: delivered, Failed: failed, Err: firstErr, origins: recipientOrigins(e)}
+	}
+	return firstErr
+}
+
+// mxHosts returns the hosts which accept mail for domain, in the order they
+// should be tried.
+func mxHosts(ctx context.Context, domain string) ([]string, error) {
+	mxs, err := lookupMX(ctx, domain)
+	if err != nil || len(mxs) == 0 {
+		// Fall back to the domain's address records (RFC 5321, section 5.1).
+		return []string{domain}, nil
+	}
+	sort.SliceStable(mxs, func(i, j int) bool {
+		return mxs[i].Pref < mxs[j].Pref
+	})
+	if len(mxs) == 1 && mxs[0].Host == "." {
+		return nil, fmt.Errorf("Domain %s does not accept mail", domain)
+	}
+	hosts := make([]string, len(mxs))
+	for i, mx := range mxs {
+		hosts[i] = strings.TrimSuffix(mx.Host, ".")
+	}
+	return hosts, nil
+}
+
+// sendToDomain delivers msg to the recipients at domain, trying each of its
+// hosts in turn until one accepts or permanently rejects the message.
+func sendToDomain(ctx context.Context, e *Email, opts *DirectOptions, domain, sender string, recipients []string, msg []byte) error {
+	hosts, err := mxHosts(ctx, domain)
+	if err != nil {
+		return err
+	}
+	for _, host := range hosts {
+		err = sendToHost(ctx, e, opts, host, sender, recipients, msg)
+		if err == nil {
+			return nil
+		}
+		if tpErr, ok := err.(*textproto.Error); ok && tpErr.Code >= 500 {
+			return err
+		}
+		// Once the message may have been accepted, or the server has given
+		// its verdict on it, another host would only deliver it twice.
+		if se, ok := err.(*SendError); ok && !se.Retryable() {
+			return err
+		}
+		if pe, ok := err.(*PartialSendError); ok {
+			return pe
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+// localHostname returns the name of the local host to greet servers with, or
+// "localhost" if it isn't known.
+func localHostname() string {
+	if name, err := os.Hostname(); err == nil && name != "" {
+		return name
+	}
+	return "localhost"
+}
+
+// sendToHost delivers msg to the recipients in a single transaction with the
+// mail server at host. The message counts as delivered once the server has
+// accepted it, whether or not the connection is closed cleanly afterwards.
+func sendToHost(ctx context.Context, e *Email, opts *DirectOptions, host, sender string, recipients []string, msg []byte) error {
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = DefaultDirectTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(host, directPort))
+	if err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	// Abort the conversation if ctx is cancelled.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	cl, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer cl.Close()
+	hello := localHostname()
+	if opts.Hello != nil {
+		if name := opts.Hello(host, conn.LocalAddr()); name != "" {
+			hello = name
+		}
+	}
+	if err = cl.Hello(hello); err != nil {
+		return err
+	}
+	if ok, _ := cl.Extension("STARTTLS"); ok {
+		verify := opts.VerifyTLS || e.RequireTLS
+		if err = cl.StartTLS(&tls.Config{ServerName: host, InsecureSkipVerify: !verify}); err != nil {
+			return err
+		}
+	}
+	mailCmd, err := mailCommand(cl, sender, &MailOptions{RequireTLS: e.RequireTLS, EnvelopeID: e.EnvelopeID}, false)
+	if err != nil {
+		return err
+	}
+	if err = sendTransaction(&client{Client: cl, conn: conn}, mailCmd, recipients, msg, false); err != nil {
+		return err
+	}
+	// The message has been accepted, so failing to say goodbye mustn't cause
+	// it to be sent again.
+	cl.Quit()
+	return nil
+}
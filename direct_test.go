@@ -0,0 +1,295 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMXHosts(t *testing.T) {
+	defer func(f func(context.Context, string) ([]*net.MX, error)) { lookupMX = f }(lookupMX)
+	lookupMX = func(ctx context.Context, domain string) ([]*net.MX, error) {
+		switch domain {
+		case "example.com":
+			return []*net.MX{
+				{Host: "backup.example.com.", Pref: 20},
+				{Host: "mx1.example.com.", Pref: 10},
+				{Host: "mx2.example.com.", Pref: 10},
+			}, nil
+		case "null.example.com":
+			return []*net.MX{{Host: ".", Pref: 0}}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	var cases = []struct {
+		domain string
+		want   []string
+		haserr bool
+	}{
+		{"example.com", []string{"mx1.example.com", "mx2.example.com", "backup.example.com"}, false},
+		{"nomx.example.com", []string{"nomx.example.com"}, false},
+		{"null.example.com", nil, true},
+	}
+	for i, testcase := range cases {
+		got, err := mxHosts(context.Background(), testcase.domain)
+		if !reflect.DeepEqual(got, testcase.want) || (err != nil) != testcase.haserr {
+			t.Errorf(`%d: got %v != want %v or error "%t" != "%t"`, i+1, got, testcase.want, err != nil, testcase.haserr)
+		}
+	}
+}
+
+// recordingConn is a net.Conn which notes what is read from it in log.
+type recordingConn struct {
+	net.Conn
+	mu  *sync.Mutex
+	log *bytes.Buffer
+}
+
+func (c recordingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.mu.Lock()
+	c.log.Write(b[:n])
+	c.mu.Unlock()
+	return n, err
+}
+
+func TestSendDirectHello(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var mu sync.Mutex
+	var logs []*bytes.Buffer
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			log := &bytes.Buffer{}
+			mu.Lock()
+			logs = append(logs, log)
+			mu.Unlock()
+			go serveSMTP(recordingConn{conn, &mu, log}, nil)
+		}
+	}()
+
+	defer func(port string) { directPort = port }(directPort)
+	_, directPort, _ = net.SplitHostPort(l.Addr().String())
+	defer func(f func(context.Context, string) ([]*net.MX, error)) { lookupMX = f }(lookupMX)
+	lookupMX = func(ctx context.Context, domain string) ([]*net.MX, error) {
+		switch domain {
+		case "a.example.com":
+			return []*net.MX{{Host: "127.0.0.1.", Pref: 10}}, nil
+		case "b.example.com":
+			return []*net.MX{{Host: "localhost.", Pref: 10}}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	e := NewEmail()
+	e.From = "sender@example.org"
+	e.To = []string{"one@a.example.com", "two@b.example.com"}
+	e.Text = []byte("Hello")
+	names := map[string]string{"127.0.0.1": "out1.example.org", "localhost": "out2.example.org"}
+	err = SendDirectWithOptions(context.Background(), e, &DirectOptions{Hello: func(host string, local net.Addr) string {
+		if local == nil {
+			t.Errorf("No local address given for %s", host)
+		}
+		return names[host]
+	}})
+	if err != nil {
+		t.Fatalf("Error sending directly: %s", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	var hellos []string
+	for _, log := range logs {
+		for _, line := range strings.Split(log.String(), "\r\n") {
+			if strings.HasPrefix(line, "EHLO ") {
+				hellos = append(hellos, line)
+			}
+		}
+	}
+	want := []string{"EHLO out1.example.org", "EHLO out2.example.org"}
+	if !reflect.DeepEqual(hellos, want) {
+		t.Errorf("Incorrect EHLO commands: %q != %q", hellos, want)
+	}
+}
+
+func TestSendDirectNoFailoverAfterData(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.Close()
+	defer func(port string) { directPort = port }(directPort)
+	_, directPort, _ = net.SplitHostPort(s.addr())
+	defer func(f func(context.Context, string) ([]*net.MX, error)) { lookupMX = f }(lookupMX)
+	lookupMX = func(ctx context.Context, domain string) ([]*net.MX, error) {
+		return []*net.MX{{Host: "127.0.0.1.", Pref: 10}, {Host: "localhost.", Pref: 20}}, nil
+	}
+
+	e := NewEmail()
+	e.From = "sender@example.org"
+	e.To = []string{"spam@example.com"}
+	e.Text = []byte("Hello")
+	err := SendDirect(context.Background(), e)
+	se, ok := err.(*SendError)
+	if !ok || !se.Rejected() {
+		t.Fatalf("Expected a rejected *SendError, got %#v", err)
+	}
+	var datas int
+	for _, cmd := range s.commands() {
+		if cmd == "DATA" {
+			datas++
+		}
+	}
+	if datas != 1 {
+		t.Errorf("Message sent %d times after being rejected at the end of DATA", datas)
+	}
+}
+
+func TestSendDirectQuitAndTimeout(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.Close()
+	s.mu.Lock()
+	s.dropQuit = true
+	s.mu.Unlock()
+	defer func(port string) { directPort = port }(directPort)
+	_, directPort, _ = net.SplitHostPort(s.addr())
+	defer func(f func(context.Context, string) ([]*net.MX, error)) { lookupMX = f }(lookupMX)
+	lookupMX = func(ctx context.Context, domain string) ([]*net.MX, error) {
+		return []*net.MX{{Host: "127.0.0.1.", Pref: 10}, {Host: "localhost.", Pref: 20}}, nil
+	}
+
+	e := NewEmail()
+	e.From = "sender@example.org"
+	e.To = []string{"one@example.com"}
+	e.Text = []byte("Hello")
+	if err := SendDirect(context.Background(), e); err != nil {
+		t.Fatalf("Failed QUIT after the message was accepted caused an error: %s", err)
+	}
+	if txs := s.transactions(); len(txs) != 1 {
+		t.Errorf("Message delivered %d times", len(txs))
+	}
+	hostname, _ := os.Hostname()
+	if cmds := s.commands(); len(cmds) == 0 || cmds[0] != "EHLO "+hostname {
+		t.Errorf("Expected EHLO with the host name %q, got %q", hostname, cmds)
+	}
+
+	// A server which never greets the client.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	_, directPort, _ = net.SplitHostPort(l.Addr().String())
+	start := time.Now()
+	err = SendDirectWithOptions(context.Background(), e, &DirectOptions{Timeout: 200 * time.Millisecond})
+	if err == nil {
+		t.Fatal("Expected an error from a server which never responds")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Timeout not applied: took %s", d)
+	}
+}
+
+func TestSendDirectTLS(t *testing.T) {
+	// The certificate is signed by a CA which the client doesn't trust.
+	ca := testCertificate(t, "Test CA", nil)
+	var mu sync.Mutex
+	var log bytes.Buffer
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{testCertificate(t, "mx.example.net", &ca)}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSMTP(recordingConn{conn, &mu, &log}, serverConfig)
+		}
+	}()
+	defer func(port string) { directPort = port }(directPort)
+	_, directPort, _ = net.SplitHostPort(l.Addr().String())
+	defer func(f func(context.Context, string) ([]*net.MX, error)) { lookupMX = f }(lookupMX)
+	lookupMX = func(ctx context.Context, domain string) ([]*net.MX, error) {
+		return []*net.MX{{Host: "127.0.0.1.", Pref: 10}}, nil
+	}
+
+	e := NewEmail()
+	e.From = "sender@example.org"
+	e.To = []string{"one@example.com"}
+	e.Text = []byte("Hello")
+	if err := SendDirect(context.Background(), e); err != nil {
+		t.Fatalf("Opportunistic TLS failed on an unverified certificate: %s", err)
+	}
+	mu.Lock()
+	if !strings.Contains(log.String(), "STARTTLS\r\n") {
+		t.Errorf("Message was not sent over STARTTLS:\n%s", log.String())
+	}
+	mu.Unlock()
+	if err := SendDirectWithOptions(context.Background(), e, &DirectOptions{VerifyTLS: true}); err == nil {
+		t.Error("Expected VerifyTLS to refuse an untrusted certificate")
+	}
+}
+
+func TestSendDirectCancel(t *testing.T) {
+	// A server which never greets the client.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	defer func(port string) { directPort = port }(directPort)
+	_, directPort, _ = net.SplitHostPort(l.Addr().String())
+	defer func(f func(context.Context, string) ([]*net.MX, error)) { lookupMX = f }(lookupMX)
+	lookupMX = func(ctx context.Context, domain string) ([]*net.MX, error) {
+		return []*net.MX{{Host: "127.0.0.1.", Pref: 10}}, nil
+	}
+
+	e := NewEmail()
+	e.From = "sender@example.org"
+	e.To = []string{"one@example.com"}
+	e.Text = []byte("Hello")
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	err = SendDirectWithOptions(ctx, e, &DirectOptions{Timeout: 30 * time.Second})
+	if err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Cancelling the context didn't stop the conversation: took %s", d)
+	}
+}
@@ -5,12 +5,17 @@ package email
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
 	"encoding/base64"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"html"
 	"io"
+	"io/ioutil"
 	"math"
 	"math/big"
 	"mime"
@@ -21,14 +26,19 @@ import (
 	"net/textproto"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	"unicode"
 )
 
 const (
 	MaxLineLength      = 76                             // MaxLineLength is the maximum line length per RFC 2045
+	maxMessageLineLen  = 998                            // maxMessageLineLen is the maximum line length, excluding the CRLF, per RFC 5322
 	defaultContentType = "text/plain; charset=us-ascii" // defaultContentType is the default Content-Type according to RFC 2045, section 5.2
+	maxEmbeddedDepth   = 8                              // maxEmbeddedDepth is how deeply message/rfc822 parts are parsed into Email.Embedded
 )
 
 // ErrMissingBoundary is returned when there is no boundary given for a multipart entity
@@ -37,26 +47,60 @@ var ErrMissingBoundary = errors.New("No boundary found for multipart entity")
 // ErrMissingContentType is returned when there is no "Content-Type" header for a MIME entity
 var ErrMissingContentType = errors.New("No Content-Type found for MIME entity")
 
+// ErrMessageTooLarge is returned by NewEmailFromReaderLimit when the message is longer than the limit
+var ErrMessageTooLarge = errors.New("Message exceeds the maximum size")
+
+// errHTMLAttachmentsNoBody is returned when rendering an Email with HTML related attachments but no HTML body
+var errHTMLAttachmentsNoBody = errors.New("there are HTML attachments, but no HTML body")
+
 // Email is the type used for email messages
 type Email struct {
-	ReplyTo     []string
-	From        string
-	To          []string
-	Bcc         []string
-	Cc          []string
-	Subject     string
-	Text        []byte // Plaintext message (optional)
-	HTML        []byte // Html message (optional)
-	Sender      string // override From as SMTP envelope sender (optional)
-	Headers     textproto.MIMEHeader
-	Attachments []*Attachment
-	ReadReceipt []string
+	ReplyTo           []string
+	From              string
+	To                []string
+	Bcc               []string
+	Cc                []string
+	Subject           string
+	Text              []byte // Plaintext message (optional)
+	HTML              []byte // Html message (optional)
+	Sender            string // override From as SMTP envelope sender (optional)
+	ReturnPath        string // override Sender and From as SMTP envelope sender, "<>" for none; parsed from Return-Path (optional)
+	Headers           textproto.MIMEHeader
+	Attachments       []*Attachment
+	ReadReceipt       []string
+	NoMIME            bool     // omit MIME headers if there is only a 7-bit plaintext message (optional)
+	RequireTLS        bool     // only relay the message over TLS, REQUIRETLS (RFC 8689) (optional)
+	TLSOptional       bool     // add "TLS-Required: No" to ignore recipients' TLS policies (RFC 8689) (optional)
+	EnvelopeID        string   // identifier for tracking the message, sent as ENVID (RFC 3461) and X-Envelope-Id (optional)
+	PreserveEncoding  bool     // write parsed Text and HTML with their original Content-Transfer-Encoding (optional)
+	QPWordWrap        bool     // break long quoted-printable lines at spaces rather than within words (optional)
+	HTMLOnly          bool     // omit the plaintext alternative when there is an HTML message (optional)
+	CIDDomain         string   // domain of the Content-IDs generated by AttachInline (optional)
+	FlowedText        bool     // write Text as format=flowed (RFC 3676) so that clients can reflow it (optional)
+	FlowedDelSp       bool     // with FlowedText, use delsp=yes so that text without spaces, such as CJK, is wrapped too (optional)
+	RawSubject        string   // verbatim, RFC 2047 encoded Subject of a parsed message, or set with SetRawSubject (optional)
+	RawHeaders        []byte   // verbatim header block of a parsed message (optional)
+	Embedded          []*Email // messages parsed from the message/rfc822 parts of a parsed message (optional)
+	report            *report  // machine readable parts of a multipart/report (optional)
+	preheader         string   // inbox preview text set with SetPreheader (optional)
+	rawBody           *Part    // undecoded body of a parsed message, for PartByPath
+	rawSum            uint64   // contentSum of a parsed message, to tell whether rawBody is still current
+	rawHeaderSum      uint64   // headerSum of a parsed message, to tell whether wireSize is still current
+	wireSize          int64    // size of a parsed message as it was read
+	textEncoding      string   // original Content-Transfer-Encoding of a parsed Text body
+	htmlEncoding      string   // original Content-Transfer-Encoding of a parsed HTML body
+	date              time.Time
+	alternatives      []alternative // further alternative bodies added with AddAlternative (optional)
+	maxAttachments    int           // maximum number of attachments, set with SetAttachmentLimits (optional)
+	maxAttachmentSize int64         // maximum combined size of attachments, set with SetAttachmentLimits (optional)
 }
 
 // part is a copyable representation of a multipart.Part
 type part struct {
-	header textproto.MIMEHeader
-	body   []byte
+	header   textproto.MIMEHeader
+	body     []byte
+	related  bool // a resource of a multipart/related entity, rather than its root
+	attached bool // a part of a parsed report which is also one of the Email's Attachments
 }
 
 // NewEmail creates an Email, and returns the pointer to it.
@@ -87,10 +131,21 @@ func (tr *trimReader) Read(buf []byte) (int, error) {
 
 func handleAddressList(v []string) []string {
 	res := []string{}
+	// Recipients may be spread across several occurrences of the header.
 	for _, a := range v {
+		if addrs, err := (&mail.AddressParser{WordDecoder: wordDecoder()}).ParseList(relabelLatin1(a)); err == nil {
+			for _, addr := range addrs {
+				res = append(res, formatAddress(addr))
+			}
+			continue
+		}
 		w := strings.Split(a, ",")
 		for _, addr := range w {
-			decodedAddr, err := (&mime.WordDecoder{}).DecodeHeader(strings.TrimSpace(addr))
+			// Skip empty fields, such as the "Bcc:" of a saved draft.
+			if strings.TrimSpace(addr) == "" {
+				continue
+			}
+			decodedAddr, err := wordDecoder().DecodeHeader(relabelLatin1(strings.TrimSpace(addr)))
 			if err == nil {
 				res = append(res, decodedAddr)
 			} else {
@@ -101,13 +156,98 @@ func handleAddressList(v []string) []string {
 	return res
 }
 
+// formatAddress formats addr as "Name <address>", or just the address if it
+// has no display name. Unlike mail.Address.String, the name is not encoded,
+// and it is only quoted if it contains special characters.
+func formatAddress(addr *mail.Address) string {
+	if addr.Name == "" {
+		return addr.Address
+	}
+	name := addr.Name
+	if strings.ContainsAny(name, "\"(),.:;<>@[\\]") {
+		name = `"` + strings.Replace(strings.Replace(name, `\`, `\\`, -1), `"`, `\"`, -1) + `"`
+	}
+	return name + " <" + addr.Address + ">"
+}
+
 // NewEmailFromReader reads a stream of bytes from an io.Reader, r,
 // and returns an email struct containing the parsed data.
 // This function expects the data in RFC 5322 format.
+// Any message/rfc822 parts are themselves parsed into Email.Embedded, up to a
+// fixed nesting depth; their raw bytes are kept in Email.Attachments when they
+// are attached rather than inline, or when they can't be parsed.
 func NewEmailFromReader(r io.Reader) (*Email, error) {
+	return newEmailFromReader(r, 0)
+}
+
+// NewEmailFromGzipReader decompresses a gzip-compressed message from r, such
+// as one rendered with BytesGzip, and parses it like NewEmailFromReader.
+func NewEmailFromGzipReader(r io.Reader) (*Email, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return NewEmailFromReader(zr)
+}
+
+// NewEmailFromReaderLimit is like NewEmailFromReader, but reads at most
+// maxBytes bytes from r, and returns ErrMessageTooLarge if the message is
+// longer, so that untrusted input can't make it allocate without bound. A
+// limit <= 0 means there is no limit.
+func NewEmailFromReaderLimit(r io.Reader, maxBytes int64) (*Email, error) {
+	if maxBytes <= 0 {
+		return newEmailFromReader(r, 0)
+	}
+	lr := &limitReader{r: io.LimitReader(r, maxBytes+1), remaining: maxBytes}
+	e, err := newEmailFromReader(lr, 0)
+	if lr.exceeded {
+		return nil, ErrMessageTooLarge
+	}
+	return e, err
+}
+
+// limitReader returns ErrMessageTooLarge once more than remaining bytes have
+// been read from r, and records that it did, since the parser doesn't report
+// every read error.
+type limitReader struct {
+	r         io.Reader
+	remaining int64
+	exceeded  bool
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.exceeded {
+		return 0, ErrMessageTooLarge
+	}
+	n, err := l.r.Read(p)
+	if int64(n) > l.remaining {
+		l.exceeded = true
+		return int(l.remaining), ErrMessageTooLarge
+	}
+	l.remaining -= int64(n)
+	return n, err
+}
+
+func newEmailFromReader(r io.Reader, depth int) (*Email, error) {
 	e := NewEmail()
 	s := &trimReader{rd: r}
-	tp := textproto.NewReader(bufio.NewReader(s))
+	br := bufio.NewReader(s)
+	// Keep a verbatim copy of the header block, up to the blank line which
+	// separates it from the body
+	var blank []byte
+	for {
+		line, err := br.ReadBytes('\n')
+		if string(line) == "\r\n" || string(line) == "\n" {
+			blank = line
+			break
+		}
+		e.RawHeaders = append(e.RawHeaders, line...)
+		if err != nil {
+			break
+		}
+	}
+	tp := textproto.NewReader(bufio.NewReader(io.MultiReader(bytes.NewReader(e.RawHeaders), bytes.NewReader(blank), br)))
 	// Parse the main headers
 	hdrs, err := tp.ReadMIMEHeader()
 	if err != nil {
@@ -117,8 +257,9 @@ func NewEmailFromReader(r io.Reader) (*Email, error) {
 	for h, v := range hdrs {
 		switch h {
 		case "Subject":
+			e.RawSubject = v[0]
 			e.Subject = v[0]
-			subj, err := (&mime.WordDecoder{}).DecodeHeader(e.Subject)
+			subj, err := wordDecoder().DecodeHeader(e.Subject)
 			if err == nil && len(subj) > 0 {
 				e.Subject = subj
 			}
@@ -135,30 +276,69 @@ func NewEmailFromReader(r io.Reader) (*Email, error) {
 		case "Reply-To":
 			e.ReplyTo = handleAddressList(v)
 			delete(hdrs, h)
-		case "From":
-			e.From = v[0]
-			fr, err := (&mime.WordDecoder{}).DecodeHeader(e.From)
-			if err == nil && len(fr) > 0 {
-				e.From = fr
+		case "Return-Path":
+			// The envelope sender stamped by the delivering MTA, which is
+			// "<>" for bounces.
+			e.ReturnPath = strings.TrimSpace(v[0])
+			if e.ReturnPath != "<>" {
+				e.ReturnPath = strings.TrimSuffix(strings.TrimPrefix(e.ReturnPath, "<"), ">")
 			}
 			delete(hdrs, h)
+		case "From":
+			// Decoded like the recipient fields, so display names come back
+			// the same way whichever header they were in.
+			e.From = strings.Join(handleAddressList(v[:1]), ", ")
+			delete(hdrs, h)
 		}
 	}
 	e.Headers = hdrs
-	body := tp.R
+	body, err := ioutil.ReadAll(tp.R)
+	if err != nil {
+		return e, err
+	}
+	e.rawBody = &Part{Header: textproto.MIMEHeader{}, Body: body}
+	e.wireSize = int64(len(e.RawHeaders) + len(blank) + len(body))
+	for _, h := range []string{"Content-Type", "Content-Transfer-Encoding"} {
+		if v, ok := e.Headers[h]; ok {
+			e.rawBody.Header[h] = v
+		}
+	}
 	// Recursively parse the MIME parts
-	ps, err := parseMIMEParts(e.Headers, body)
+	ps, err := parseMIMEParts(e.Headers, bytes.NewReader(body))
 	if err != nil {
 		return e, err
 	}
+	// Keep the machine readable parts of a report, so that it can be
+	// inspected and rendered again.
+	if mt, params, err := mime.ParseMediaType(e.Headers.Get("Content-Type")); err == nil && mt == "multipart/report" {
+		e.report = &report{reportType: params["report-type"], parsed: true}
+	}
 	for _, p := range ps {
 		if ct := p.header.Get("Content-Type"); ct == "" {
 			return e, ErrMissingContentType
 		}
-		ct, _, err := mime.ParseMediaType(p.header.Get("Content-Type"))
+		ct, ctParams, err := mime.ParseMediaType(p.header.Get("Content-Type"))
 		if err != nil {
 			return e, err
 		}
+		reportPart := &part{}
+		if e.report != nil && ct != "text/plain" && ct != "text/html" {
+			reportPart = decodedPart(p)
+			e.report.parts = append(e.report.parts, reportPart)
+		}
+		if ct == "message/rfc822" && depth < maxEmbeddedDepth {
+			// A message which can't be parsed doesn't fail the one it is
+			// in, but is kept as an attachment so that it isn't lost.
+			if em, err := newEmailFromReader(bytes.NewReader(p.body), depth+1); err == nil {
+				e.Embedded = append(e.Embedded, em)
+			} else if p.header.Get("Content-Disposition") == "" {
+				if _, err := e.Attach(bytes.NewReader(p.body), "", ct); err != nil {
+					return e, err
+				}
+				reportPart.attached = true
+				continue
+			}
+		}
 		// Check if part is an attachment based on the existence of the Content-Disposition header with a value of "attachment".
 		if cd := p.header.Get("Content-Disposition"); cd != "" {
 			cd, params, err := mime.ParseMediaType(p.header.Get("Content-Disposition"))
@@ -166,24 +346,84 @@ func NewEmailFromReader(r io.Reader) (*Email, error) {
 				return e, err
 			}
 			filename, filenameDefined := params["filename"]
-			if cd == "attachment" || (cd == "inline" && filenameDefined) {
-				_, err = e.Attach(bytes.NewReader(p.body), filename, ct)
+			location := strings.TrimSpace(p.header.Get("Content-Location"))
+			if cd == "attachment" || (cd == "inline" && (filenameDefined || location != "")) {
+				at, err := e.Attach(bytes.NewReader(p.body), filename, ct)
 				if err != nil {
 					return e, err
 				}
+				at.ContentLocation = location
+				if desc := p.header.Get("Content-Description"); desc != "" {
+					if at.Description, err = wordDecoder().DecodeHeader(desc); err != nil {
+						at.Description = desc
+					}
+				}
+				if t, err := mail.ParseDate(params["creation-date"]); err == nil {
+					at.CreationDate = t
+				}
+				if t, err := mail.ParseDate(params["modification-date"]); err == nil {
+					at.ModificationDate = t
+				}
+				reportPart.attached = true
 				continue
 			}
+		} else if location := strings.TrimSpace(p.header.Get("Content-Location")); p.related && location != "" {
+			// MHTML documents (RFC 2557) identify the resources of a page
+			// only by their Content-Location, without a disposition.
+			at, err := e.Attach(bytes.NewReader(p.body), ctParams["name"], ct)
+			if err != nil {
+				return e, err
+			}
+			at.HTMLRelated = true
+			at.ContentLocation = location
+			reportPart.attached = true
+			continue
 		}
+		// If there are several text or HTML parts, the last one wins, but an
+		// empty part never replaces a previously found body.
+		empty := len(bytes.TrimSpace(p.body)) == 0
 		switch {
-		case ct == "text/plain":
-			e.Text = p.body
-		case ct == "text/html":
-			e.HTML = p.body
+		case ct == "text/plain" && (!empty || len(e.Text) == 0):
+			e.Text = toUTF8(ctParams["charset"], p.body)
+			e.FlowedText = strings.EqualFold(ctParams["format"], "flowed")
+			e.FlowedDelSp = e.FlowedText && strings.EqualFold(ctParams["delsp"], "yes")
+			if e.FlowedText {
+				e.Text = fromFlowed(e.Text, e.FlowedDelSp)
+			}
+			e.textEncoding = p.header.Get("Content-Transfer-Encoding")
+		case ct == "text/html" && (!empty || len(e.HTML) == 0):
+			e.HTML = toUTF8(ctParams["charset"], p.body)
+			e.htmlEncoding = p.header.Get("Content-Transfer-Encoding")
 		}
 	}
+	e.rawSum = e.contentSum()
+	e.rawHeaderSum = e.headerSum()
 	return e, nil
 }
 
+// decodedPart returns p with its Content-Transfer-Encoding header removed if
+// parseMIMEParts has already decoded its body.
+func decodedPart(p *part) *part {
+	if p.header.Get("Content-Transfer-Encoding") != "base64" {
+		return p
+	}
+	h := cloneHeader(p.header)
+	h.Del("Content-Transfer-Encoding")
+	return &part{header: h, body: p.body}
+}
+
+// boundaryParam returns the boundary parameter of a multipart entity. A
+// boundary may contain spaces but may not end with one, and may never contain
+// quotes (RFC 2046, section 5.1.1), so trailing whitespace and stray quotes
+// that some senders add are trimmed to match the delimiter lines.
+func boundaryParam(params map[string]string) (string, error) {
+	b := strings.TrimLeft(strings.TrimRight(params["boundary"], " \t\r\n\""), "\"")
+	if b == "" {
+		return "", ErrMissingBoundary
+	}
+	return b, nil
+}
+
 // parseMIMEParts will recursively walk a MIME entity and return a []mime.Part containing
 // each (flattened) mime.Part found.
 // It is important to note that there are no limits to the number of recursions, so be
@@ -200,10 +440,14 @@ func parseMIMEParts(hs textproto.MIMEHeader, b io.Reader) ([]*part, error) {
 	}
 	// If it's a multipart email, recursively parse the parts
 	if strings.HasPrefix(ct, "multipart/") {
-		if _, ok := params["boundary"]; !ok {
-			return ps, ErrMissingBoundary
+		boundary, err := boundaryParam(params)
+		if err != nil {
+			return ps, err
 		}
-		mr := multipart.NewReader(b, params["boundary"])
+		mr := multipart.NewReader(b, boundary)
+		// The root of a multipart/related entity is the part named by its
+		// start parameter, or else the first part (RFC 2387, section 3.2).
+		related, root := ct == "multipart/related", true
 		for {
 			var buf bytes.Buffer
 			p, err := mr.NextPart()
@@ -220,6 +464,11 @@ func parseMIMEParts(hs textproto.MIMEHeader, b io.Reader) ([]*part, error) {
 			if err != nil {
 				return ps, err
 			}
+			isRoot := root
+			if start := params["start"]; start != "" {
+				isRoot = p.Header.Get("Content-ID") == start
+			}
+			root = false
 			if strings.HasPrefix(subct, "multipart/") {
 				sps, err := parseMIMEParts(p.Header, p)
 				if err != nil {
@@ -238,7 +487,7 @@ func parseMIMEParts(hs textproto.MIMEHeader, b io.Reader) ([]*part, error) {
 				if _, err := io.Copy(&buf, reader); err != nil {
 					return ps, err
 				}
-				ps = append(ps, &part{body: buf.Bytes(), header: p.Header})
+				ps = append(ps, &part{body: buf.Bytes(), header: p.Header, related: related && !isRoot})
 			}
 		}
 	} else {
@@ -262,8 +511,27 @@ func parseMIMEParts(hs textproto.MIMEHeader, b io.Reader) ([]*part, error) {
 // Required parameters include an io.Reader, the desired filename for the attachment, and the Content-Type
 // The function will return the created Attachment for reference, as well as nil for the error, if successful.
 func (e *Email) Attach(r io.Reader, filename string, c string) (a *Attachment, err error) {
+	if e.maxAttachments > 0 && len(e.Attachments) >= e.maxAttachments {
+		return nil, fmt.Errorf("Cannot attach %q: the limit of %d attachments has been reached", filename, e.maxAttachments)
+	}
 	var buffer bytes.Buffer
-	if _, err = io.Copy(&buffer, r); err != nil {
+	if e.maxAttachmentSize > 0 {
+		var size int64
+		for _, at := range e.Attachments {
+			size += int64(len(at.Content))
+		}
+		// Read at most one byte past the limit, rather than the whole of r.
+		remaining := e.maxAttachmentSize - size
+		if remaining < 0 {
+			remaining = 0
+		}
+		if _, err = io.Copy(&buffer, io.LimitReader(r, remaining+1)); err != nil {
+			return
+		}
+		if int64(buffer.Len()) > remaining {
+			return nil, fmt.Errorf("Cannot attach %q: the combined attachment size would exceed the limit of %d bytes", filename, e.maxAttachmentSize)
+		}
+	} else if _, err = io.Copy(&buffer, r); err != nil {
 		return
 	}
 	at := &Attachment{
@@ -276,20 +544,649 @@ func (e *Email) Attach(r io.Reader, filename string, c string) (a *Attachment, e
 	return at, nil
 }
 
+// SetAttachmentLimits limits the number of attachments and their combined
+// size in bytes, so that Attach and the functions built on it return an error
+// rather than exceed them. A limit <= 0 means there is no limit, which is the
+// default.
+func (e *Email) SetAttachmentLimits(maxCount int, maxSize int64) {
+	e.maxAttachments = maxCount
+	e.maxAttachmentSize = maxSize
+}
+
+// AttachWriter returns a writer for the content of a new attachment, for
+// content which is generated incrementally. The attachment is added to the
+// email when the writer is closed, which is when any limits set with
+// SetAttachmentLimits are checked.
+func (e *Email) AttachWriter(filename string, c string) (io.WriteCloser, *Attachment, error) {
+	if e.maxAttachments > 0 && len(e.Attachments) >= e.maxAttachments {
+		return nil, nil, fmt.Errorf("Cannot attach %q: the limit of %d attachments has been reached", filename, e.maxAttachments)
+	}
+	at := &Attachment{
+		Filename:    filename,
+		ContentType: c,
+		Header:      textproto.MIMEHeader{},
+	}
+	return &attachmentWriter{e: e, at: at}, at, nil
+}
+
+// attachmentWriter buffers the content of an attachment created with
+// Email.AttachWriter.
+type attachmentWriter struct {
+	e      *Email
+	at     *Attachment
+	buf    bytes.Buffer
+	closed bool
+}
+
+var errAttachmentWriterClosed = errors.New("email: write to closed attachment writer")
+
+func (w *attachmentWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errAttachmentWriterClosed
+	}
+	return w.buf.Write(p)
+}
+
+// Close adds the attachment to the email.
+func (w *attachmentWriter) Close() error {
+	if w.closed {
+		return errAttachmentWriterClosed
+	}
+	w.closed = true
+	// Attach checks the limits, and the Attachment it creates is then
+	// replaced by the one which was returned by AttachWriter.
+	at, err := w.e.Attach(&w.buf, w.at.Filename, w.at.ContentType)
+	if err != nil {
+		return err
+	}
+	w.at.Content = at.Content
+	w.e.Attachments[len(w.e.Attachments)-1] = w.at
+	return nil
+}
+
+// AttachInline attaches content to be displayed within the HTML message, like
+// Attach with HTMLRelated set. It is given a unique Content-ID of the form
+// <random.counter@domain>, where the domain is e.CIDDomain, or if that is
+// empty, the domain of e.From or "localhost". The HTML should refer to it as
+// "cid:" followed by a.CID(). The filename may be empty for resources which
+// shouldn't be listed as attachments, such as CSS background images.
+func (e *Email) AttachInline(r io.Reader, filename string, c string) (a *Attachment, err error) {
+	cid, err := e.generateCID()
+	if err != nil {
+		return
+	}
+	a, err = e.Attach(r, filename, c)
+	if err != nil {
+		return
+	}
+	a.HTMLRelated = true
+	a.Header.Set("Content-ID", "<"+cid+">")
+	return a, nil
+}
+
+// AttachInlineLocation attaches content to be displayed within the HTML
+// message like AttachInline, but identified by a Content-Location header
+// (RFC 2557) instead of a Content-ID. The HTML should refer to it by the same
+// absolute or relative URL, as in MHTML documents saved by some browsers.
+func (e *Email) AttachInlineLocation(r io.Reader, location string, filename string, c string) (a *Attachment, err error) {
+	if location == "" {
+		return nil, errors.New("Content-Location must not be empty")
+	}
+	a, err = e.Attach(r, filename, c)
+	if err != nil {
+		return
+	}
+	a.HTMLRelated = true
+	a.ContentLocation = location
+	return a, nil
+}
+
+// cidCounter distinguishes Content-IDs generated by the same process.
+var cidCounter uint64
+
+// generateCID returns a new Content-ID, without the angle brackets, for an
+// inline attachment of e.
+func (e *Email) generateCID() (string, error) {
+	rint, err := rand.Int(rand.Reader, maxBigInt)
+	if err != nil {
+		return "", err
+	}
+	domain := e.CIDDomain
+	if domain == "" {
+		domain = "localhost"
+		if from, err := mail.ParseAddress(e.From); err == nil {
+			if i := strings.LastIndex(from.Address, "@"); i >= 0 && i < len(from.Address)-1 {
+				domain = from.Address[i+1:]
+			}
+		}
+	}
+	return fmt.Sprintf("%d.%d@%s", rint, atomic.AddUint64(&cidCounter, 1), domain), nil
+}
+
+// AttachMessage renders m and attaches it to the email as a message/rfc822
+// part, named after its Subject. As RFC 2046 requires, the part isn't
+// encoded, but sent as 7bit, or 8bit if the rendered message isn't ASCII.
+func (e *Email) AttachMessage(m *Email) (a *Attachment, err error) {
+	raw, err := m.Bytes()
+	if err != nil {
+		return
+	}
+	name := strings.Map(func(r rune) rune {
+		if r < ' ' || strings.ContainsRune(`"/\:*?<>|`, r) {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(m.Subject))
+	if name == "" {
+		name = "message"
+	}
+	if a, err = e.Attach(bytes.NewReader(raw), name+".eml", "message/rfc822"); err != nil {
+		return
+	}
+	cte := "7bit"
+	for _, c := range raw {
+		if c >= 0x80 {
+			cte = "8bit"
+			break
+		}
+	}
+	a.Header.Set("Content-Transfer-Encoding", cte)
+	return a, nil
+}
+
 // AttachFile is used to attach content to the email.
 // It attempts to open the file referenced by filename and, if successful, creates an Attachment.
 // This Attachment is then appended to the slice of Email.Attachments.
 // The function will then return the Attachment for reference, as well as nil for the error, if successful.
 func (e *Email) AttachFile(filename string) (a *Attachment, err error) {
+	return e.AttachFileAs(filename, filepath.Base(filename))
+}
+
+// AttachFileAs is like AttachFile, but names the attachment displayName
+// rather than after the file, e.g. to present a temporary file as
+// "Invoice.pdf". The Content-Type is derived from the extension of the file,
+// or of displayName if the file's extension is unknown.
+func (e *Email) AttachFileAs(filename, displayName string) (a *Attachment, err error) {
 	f, err := os.Open(filename)
 	if err != nil {
 		return
 	}
 	defer f.Close()
 
-	ct := mime.TypeByExtension(filepath.Ext(filename))
-	basename := filepath.Base(filename)
-	return e.Attach(f, basename, ct)
+	ct := contentTypeByExtension(filepath.Ext(filename))
+	if ct == "" {
+		ct = contentTypeByExtension(filepath.Ext(displayName))
+	}
+	a, err = e.Attach(f, displayName, ct)
+	if err != nil {
+		return
+	}
+	if fi, err := f.Stat(); err == nil {
+		a.ModificationDate = fi.ModTime()
+	}
+	return a, nil
+}
+
+// SaveAttachments writes the content of each attachment to a file in dir and
+// returns the paths of the files. The files are named after the attachments,
+// with path separators, control characters and leading dots replaced so that
+// every file is created directly in dir. Existing files are never
+// overwritten: if a name is taken, a number is added before its extension.
+func (e *Email) SaveAttachments(dir string) ([]string, error) {
+	var paths []string
+	for _, a := range e.Attachments {
+		path, err := saveAttachment(dir, safeFilename(a.Filename), a.Content)
+		if err != nil {
+			return paths, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// safeFilename returns name with everything that could take a file outside
+// its directory, or hide it, replaced by underscores.
+func safeFilename(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f || r == '/' || r == '\\' || r == ':' {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(name))
+	if trimmed := strings.TrimLeft(name, "."); trimmed != name {
+		name = "_" + trimmed
+	}
+	if name == "" || name == "_" {
+		name = "attachment"
+	}
+	return name
+}
+
+// saveAttachment creates a new file named name in dir, or if it exists,
+// name with a number added, and writes content to it.
+func saveAttachment(dir, name string, content []byte) (string, error) {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 0; ; i++ {
+		path := filepath.Join(dir, name)
+		if i > 0 {
+			path = filepath.Join(dir, fmt.Sprintf("%s-%d%s", base, i, ext))
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) && i < 1000 {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if _, err = f.Write(content); err != nil {
+			f.Close()
+			return "", err
+		}
+		return path, f.Close()
+	}
+}
+
+var (
+	contentTypesMu sync.RWMutex
+	// contentTypes holds common types which are missing from some system MIME
+	// databases, along with any registered with RegisterContentType.
+	contentTypes = map[string]string{
+		".avif":  "image/avif",
+		".heic":  "image/heic",
+		".heif":  "image/heif",
+		".ics":   "text/calendar",
+		".svg":   "image/svg+xml",
+		".webp":  "image/webp",
+		".woff":  "font/woff",
+		".woff2": "font/woff2",
+	}
+)
+
+// RegisterContentType registers the Content-Type to use for attached files with
+// the extension ext (e.g. ".webp"), taking precedence over the system MIME database.
+func RegisterContentType(ext, ctype string) {
+	if !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	contentTypesMu.Lock()
+	contentTypes[strings.ToLower(ext)] = ctype
+	contentTypesMu.Unlock()
+}
+
+// contentTypeByExtension returns the Content-Type for the extension ext, using
+// the registered types before falling back to mime.TypeByExtension.
+func contentTypeByExtension(ext string) string {
+	contentTypesMu.RLock()
+	ct, ok := contentTypes[strings.ToLower(ext)]
+	contentTypesMu.RUnlock()
+	if ok {
+		return ct
+	}
+	return mime.TypeByExtension(ext)
+}
+
+// Clone returns a deep copy of the Email which can be modified and rendered
+// independently of the original. Attachment content is shared, since it is
+// never modified, but attachment headers are copied.
+func (e *Email) Clone() *Email {
+	c := *e
+	c.ReplyTo = append([]string(nil), e.ReplyTo...)
+	c.To = append([]string(nil), e.To...)
+	c.Bcc = append([]string(nil), e.Bcc...)
+	c.Cc = append([]string(nil), e.Cc...)
+	c.ReadReceipt = append([]string(nil), e.ReadReceipt...)
+	c.Text = append([]byte(nil), e.Text...)
+	c.HTML = append([]byte(nil), e.HTML...)
+	c.alternatives = append([]alternative(nil), e.alternatives...)
+	c.RawHeaders = append([]byte(nil), e.RawHeaders...)
+	c.Headers = cloneHeader(e.Headers)
+	c.Embedded = make([]*Email, len(e.Embedded))
+	for i, em := range e.Embedded {
+		c.Embedded[i] = em.Clone()
+	}
+	c.Attachments = make([]*Attachment, len(e.Attachments))
+	for i, a := range e.Attachments {
+		at := *a
+		at.Header = cloneHeader(a.Header)
+		c.Attachments[i] = &at
+	}
+	return &c
+}
+
+// WithFooter returns a copy of the Email with the text footer appended to its
+// plaintext body and the html footer inserted at the end of its HTML body,
+// before the closing </body> tag if there is one. A footer is only added to a
+// body which is already present, so the structure of the message is unchanged.
+func (e *Email) WithFooter(text, html []byte) *Email {
+	c := e.Clone()
+	if len(c.Text) > 0 && len(text) > 0 {
+		c.Text = append(c.Text, text...)
+	}
+	if len(c.HTML) > 0 && len(html) > 0 {
+		i := bytes.LastIndex(bytes.ToLower(c.HTML), []byte("</body>"))
+		if i < 0 {
+			i = len(c.HTML)
+		}
+		c.HTML = append(c.HTML[:i:i], append(append([]byte(nil), html...), c.HTML[i:]...)...)
+	}
+	return c
+}
+
+// AddTo appends addrs to the To recipients. If any of them is not a valid
+// address, an error is returned and none of them are added.
+func (e *Email) AddTo(addrs ...string) error {
+	return appendAddresses(&e.To, addrs)
+}
+
+// AddCc appends addrs to the Cc recipients. If any of them is not a valid
+// address, an error is returned and none of them are added.
+func (e *Email) AddCc(addrs ...string) error {
+	return appendAddresses(&e.Cc, addrs)
+}
+
+// AddBcc appends addrs to the Bcc recipients. If any of them is not a valid
+// address, an error is returned and none of them are added.
+func (e *Email) AddBcc(addrs ...string) error {
+	return appendAddresses(&e.Bcc, addrs)
+}
+
+func appendAddresses(dst *[]string, addrs []string) error {
+	for _, addr := range addrs {
+		if _, err := mail.ParseAddress(addr); err != nil {
+			return fmt.Errorf("invalid address %q: %v", addr, err)
+		}
+	}
+	*dst = append(*dst, addrs...)
+	return nil
+}
+
+// Recipient is a single recipient of a mail-merge send, along with any headers
+// (e.g. List-Unsubscribe or X-Recipient-ID) that only apply to their copy.
+type Recipient struct {
+	Address string
+	Headers textproto.MIMEHeader
+}
+
+// Personalize returns a copy of the Email addressed only to r, with r.Headers
+// merged over the shared headers. The original Email is not modified. A
+// List-Unsubscribe header is folded between its URIs when rendered, so that
+// long per-recipient tokens are kept whole.
+func (e *Email) Personalize(r Recipient) *Email {
+	c := e.Clone()
+	c.To = []string{r.Address}
+	c.Cc = nil
+	c.Bcc = nil
+	if c.Headers == nil {
+		c.Headers = textproto.MIMEHeader{}
+	}
+	c.Headers.Del("To")
+	c.Headers.Del("Cc")
+	c.Headers.Del("Bcc")
+	for field, vals := range r.Headers {
+		c.Headers[textproto.CanonicalMIMEHeaderKey(field)] = append([]string(nil), vals...)
+	}
+	return c
+}
+
+func cloneHeader(h textproto.MIMEHeader) textproto.MIMEHeader {
+	if h == nil {
+		return nil
+	}
+	res := make(textproto.MIMEHeader, len(h))
+	for field, vals := range h {
+		res[field] = append([]string(nil), vals...)
+	}
+	return res
+}
+
+// SetRawSubject sets a Subject which is already RFC 2047 encoded, such as one
+// copied from another message, so that it is rendered verbatim rather than
+// being encoded a second time. The raw value is stored in e.RawSubject and the
+// decoded value in e.Subject; if the Subject is later changed, it is encoded
+// as usual.
+func (e *Email) SetRawSubject(s string) {
+	e.RawSubject = s
+	e.Subject = decodeRawSubject(s)
+}
+
+func decodeRawSubject(s string) string {
+	if subj, err := wordDecoder().DecodeHeader(s); err == nil {
+		return subj
+	}
+	return s
+}
+
+// preheaderPadding follows the preheader, so that mail clients don't fill the
+// rest of the inbox preview with the start of the body.
+var preheaderPadding = strings.Repeat("&#847; &zwnj; &nbsp; ", 80)
+
+// SetPreheader sets the preview text which mail clients show next to the
+// subject in the inbox, rather than the start of the body. When the message
+// is rendered, it is added to the top of the HTML body in a hidden span, and
+// prepended to the plaintext body.
+func (e *Email) SetPreheader(s string) {
+	e.preheader = s
+}
+
+// withPreheader returns a copy of e with the preheader added to its bodies.
+func (e *Email) withPreheader() *Email {
+	c := e.Clone()
+	c.preheader = ""
+	if len(c.Text) > 0 {
+		c.Text = append([]byte(e.preheader+"\n\n"), c.Text...)
+	}
+	if len(c.HTML) > 0 {
+		span := `<span style="display:none !important;visibility:hidden;mso-hide:all;font-size:1px;line-height:1px;max-height:0;max-width:0;opacity:0;overflow:hidden;">` +
+			html.EscapeString(e.preheader) + preheaderPadding + "</span>\n"
+		i := 0
+		lower := bytes.ToLower(c.HTML)
+		if j := bytes.Index(lower, []byte("<body")); j >= 0 {
+			if k := bytes.IndexByte(lower[j:], '>'); k >= 0 {
+				i = j + k + 1
+			}
+		}
+		c.HTML = append(c.HTML[:i:i], append([]byte(span), c.HTML[i:]...)...)
+	}
+	return c
+}
+
+// SetDate sets the Date of the Email, replacing any Date header. If t is the
+// zero time, the Date is set to the current time when the Email is rendered.
+func (e *Email) SetDate(t time.Time) {
+	e.date = t
+	if e.Headers != nil {
+		e.Headers.Del("Date")
+	}
+}
+
+// Date returns the Date of the Email, as set by SetDate or parsed from the
+// Date header. It returns the zero time if neither is set.
+func (e *Email) Date() (time.Time, error) {
+	if !e.date.IsZero() {
+		return e.date, nil
+	}
+	if v := e.Headers.Get("Date"); v != "" {
+		return mail.ParseDate(v)
+	}
+	return time.Time{}, nil
+}
+
+// traceHeaders are the headers removed by StripTraceHeaders.
+var traceHeaders = []string{
+	"Received",
+	"X-Received",
+	"Received-SPF",
+	"Return-Path",
+	"Delivered-To",
+	"X-Originating-IP",
+	"X-Forwarded-For",
+	"X-Forwarded-To",
+	"Authentication-Results",
+	"ARC-Seal",
+	"ARC-Message-Signature",
+	"ARC-Authentication-Results",
+}
+
+// StripHeaders removes every occurrence of the given headers from e.Headers.
+// RawHeaders is left untouched.
+func (e *Email) StripHeaders(keys ...string) {
+	for _, k := range keys {
+		e.Headers.Del(k)
+	}
+}
+
+// StripTraceHeaders removes headers which reveal how a message was delivered,
+// such as Received, X-Originating-IP, Authentication-Results and Delivered-To,
+// so that internal topology isn't leaked when the message is relayed or forwarded.
+func (e *Email) StripTraceHeaders() {
+	e.StripHeaders(traceHeaders...)
+}
+
+// SetOrganization sets the Organization header, which is RFC 2047 encoded when rendered if needed.
+func (e *Email) SetOrganization(s string) {
+	e.setHeader("Organization", s)
+}
+
+// Organization returns the decoded value of the Organization header.
+func (e *Email) Organization() string {
+	return e.decodedHeader("Organization")
+}
+
+// SetComments sets the Comments header, which is RFC 2047 encoded when rendered if needed.
+func (e *Email) SetComments(s string) {
+	e.setHeader("Comments", s)
+}
+
+// Comments returns the decoded value of the Comments header.
+func (e *Email) Comments() string {
+	return e.decodedHeader("Comments")
+}
+
+// SetKeywords sets the Keywords header to the given list of keywords, which
+// must not contain commas. When rendered, each keyword is RFC 2047 encoded if
+// needed, and the list is folded over several lines if it is long.
+func (e *Email) SetKeywords(keywords ...string) {
+	e.setHeader("Keywords", strings.Join(keywords, ", "))
+}
+
+// Keywords returns the decoded keywords of all of the Keywords headers.
+func (e *Email) Keywords() []string {
+	var keywords []string
+	for _, v := range e.Headers["Keywords"] {
+		if dec, err := wordDecoder().DecodeHeader(v); err == nil {
+			v = dec
+		}
+		for _, kw := range strings.Split(v, ",") {
+			if kw = strings.TrimSpace(kw); kw != "" {
+				keywords = append(keywords, kw)
+			}
+		}
+	}
+	return keywords
+}
+
+// TextLF returns e.Text with its line endings normalized to LF, for display
+// or storage. e.Text itself is unchanged, and usually has CRLF line endings
+// when it was parsed from a message.
+func (e *Email) TextLF() []byte {
+	return toLF(e.Text)
+}
+
+// HTMLLF returns e.HTML with its line endings normalized to LF, like TextLF.
+func (e *Email) HTMLLF() []byte {
+	return toLF(e.HTML)
+}
+
+// Priority is the importance of a message, as declared by the X-Priority,
+// Importance and Priority headers.
+type Priority int
+
+// The priorities a message may have. The zero value is PriorityNormal.
+const (
+	PriorityNormal Priority = iota
+	PriorityHigh
+	PriorityLow
+)
+
+// SetPriority sets the X-Priority, Importance and Priority headers, which are
+// recognized by different mail clients, to p. PriorityNormal removes them.
+func (e *Email) SetPriority(p Priority) {
+	fields := map[string]string{}
+	switch p {
+	case PriorityHigh:
+		fields = map[string]string{"X-Priority": "1 (Highest)", "Importance": "high", "Priority": "urgent"}
+	case PriorityLow:
+		fields = map[string]string{"X-Priority": "5 (Lowest)", "Importance": "low", "Priority": "non-urgent"}
+	}
+	for _, field := range []string{"X-Priority", "Importance", "Priority"} {
+		if v, ok := fields[field]; ok {
+			e.setHeader(field, v)
+		} else if e.Headers != nil {
+			e.Headers.Del(field)
+		}
+	}
+}
+
+// Priority returns the priority declared by the X-Priority header, where 1
+// and 2 are high, 3 is normal and 4 and 5 are low, the Importance header
+// ("high", "normal" or "low") and the Priority header ("urgent", "normal" or
+// "non-urgent"). Unrecognized values are ignored. If there are no recognized
+// headers, or they disagree, PriorityNormal is returned.
+func (e *Email) Priority() Priority {
+	var found []Priority
+	if v := strings.TrimSpace(e.Headers.Get("X-Priority")); v != "" {
+		switch v[0] {
+		case '1', '2':
+			found = append(found, PriorityHigh)
+		case '3':
+			found = append(found, PriorityNormal)
+		case '4', '5':
+			found = append(found, PriorityLow)
+		}
+	}
+	for _, h := range []struct {
+		field             string
+		high, normal, low string
+	}{
+		{"Importance", "high", "normal", "low"},
+		{"Priority", "urgent", "normal", "non-urgent"},
+	} {
+		switch strings.ToLower(strings.TrimSpace(e.Headers.Get(h.field))) {
+		case h.high:
+			found = append(found, PriorityHigh)
+		case h.normal:
+			found = append(found, PriorityNormal)
+		case h.low:
+			found = append(found, PriorityLow)
+		}
+	}
+	for _, p := range found {
+		if p != found[0] {
+			return PriorityNormal
+		}
+	}
+	if len(found) == 0 {
+		return PriorityNormal
+	}
+	return found[0]
+}
+
+func (e *Email) setHeader(field, value string) {
+	if e.Headers == nil {
+		e.Headers = textproto.MIMEHeader{}
+	}
+	e.Headers.Set(field, value)
+}
+
+// decodedHeader returns the first value of the given header, with any RFC 2047
+// encoded-words decoded.
+func (e *Email) decodedHeader(field string) string {
+	v := e.Headers.Get(field)
+	if dec, err := wordDecoder().DecodeHeader(v); err == nil {
+		return dec
+	}
+	return v
 }
 
 // msgHeaders merges the Email's various fields and custom headers together in a
@@ -332,36 +1229,81 @@ func (e *Email) msgHeaders() (textproto.MIMEHeader, error) {
 		res.Set("From", e.From)
 	}
 	if _, ok := res["Date"]; !ok {
-		res.Set("Date", time.Now().Format(time.RFC1123Z))
+		date := e.date
+		if date.IsZero() {
+			date = time.Now()
+		}
+		res.Set("Date", date.Format(time.RFC1123Z))
 	}
 	if _, ok := res["MIME-Version"]; !ok {
 		res.Set("MIME-Version", "1.0")
 	}
+	if _, ok := res["X-Envelope-Id"]; !ok && e.EnvelopeID != "" {
+		res.Set("X-Envelope-Id", e.EnvelopeID)
+	}
+	// The header is ignored by servers when REQUIRETLS is used.
+	if e.TLSOptional && !e.RequireTLS {
+		res.Set("TLS-Required", "No")
+	}
 	for field, vals := range e.Headers {
-		if _, ok := res[field]; !ok {
+		// Bcc recipients are only given in the envelope.
+		if _, ok := res[field]; !ok && field != "Bcc" {
 			res[field] = vals
 		}
 	}
 	return res, nil
 }
 
-func writeMessage(buff io.Writer, msg []byte, multipart bool, mediaType string, w *multipart.Writer) error {
-	if multipart {
-		header := textproto.MIMEHeader{
-			"Content-Type":              {mediaType + "; charset=UTF-8"},
-			"Content-Transfer-Encoding": {"quoted-printable"},
-		}
-		if _, err := w.CreatePart(header); err != nil {
-			return err
-		}
+// writeMessage emits msg as a part of type mediaType. header is the message
+// header if the part is the whole message body, or nil if it is nested.
+func writeMessage(em partEmitter, header textproto.MIMEHeader, msg []byte, mediaType string, encoding string, wordWrap bool) error {
+	encoding = bodyEncoding(encoding, msg)
+	if header == nil {
+		header = textproto.MIMEHeader{}
+	}
+	header.Set("Content-Type", mediaType+"; charset="+CharsetLabel)
+	header.Set("Content-Transfer-Encoding", encoding)
+	buff, err := em.leaf(header)
+	if err != nil {
+		return err
 	}
 
-	qp := quotedprintable.NewWriter(buff)
-	// Write the text
-	if _, err := qp.Write(msg); err != nil {
+	switch encoding {
+	case "base64":
+		base64Wrap(buff, msg)
+		return nil
+	case "7bit", "8bit":
+		_, err := buff.Write(toCRLF(msg))
 		return err
 	}
-	return qp.Close()
+	if wordWrap {
+		return quotedPrintableWordWrap(buff, msg)
+	}
+	return quotePrintEncode(buff, msg)
+}
+
+// bodyEncoding returns the Content-Transfer-Encoding to write msg with, which
+// is encoding if it is suitable for msg, or otherwise quoted-printable.
+func bodyEncoding(encoding string, msg []byte) string {
+	switch encoding = strings.ToLower(encoding); encoding {
+	case "base64", "8bit":
+		return encoding
+	case "7bit":
+		if isASCII(msg) {
+			return encoding
+		}
+	}
+	return "quoted-printable"
+}
+
+// textEncodings returns the Content-Transfer-Encodings to write the Text and
+// HTML bodies with, which are their original encodings if PreserveEncoding is
+// set.
+func (e *Email) textEncodings() (text, html string) {
+	if !e.PreserveEncoding {
+		return "", ""
+	}
+	return e.textEncoding, e.htmlEncoding
 }
 
 func (e *Email) categorizeAttachments() (htmlRelated, others []*Attachment) {
@@ -379,161 +1321,517 @@ func (e *Email) categorizeAttachments() (htmlRelated, others []*Attachment) {
 func (e *Email) Bytes() ([]byte, error) {
 	// TODO: better guess buffer size
 	buff := bytes.NewBuffer(make([]byte, 0, 4096))
+	if _, err := e.WriteTo(buff); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+// BytesGzip is like Bytes, but returns the rendered message compressed with
+// gzip, for storing or queueing it efficiently. It can be parsed again with
+// NewEmailFromGzipReader.
+func (e *Email) BytesGzip() ([]byte, error) {
+	var buff bytes.Buffer
+	zw := gzip.NewWriter(&buff)
+	if _, err := e.WriteTo(zw); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+// WriteTo renders the Email to w, including all needed MIMEHeaders, boundaries, etc.
+// It implements io.WriterTo, returning the number of bytes written.
+func (e *Email) WriteTo(w io.Writer) (int64, error) {
+	if e.preheader != "" {
+		return e.withPreheader().WriteTo(w)
+	}
+	if e.HTMLOnly && len(e.HTML) > 0 && len(e.Text) > 0 {
+		c := *e
+		c.Text = nil
+		return c.WriteTo(w)
+	}
+	buff := &countingWriter{w: w}
 
 	headers, err := e.msgHeaders()
 	if err != nil {
-		return nil, err
+		return buff.n, err
 	}
 
+	em := &byteEmitter{w: buff, writeHeader: e.writeHeaders}
+	if e.report != nil && !e.report.parsed {
+		if err := e.emitReport(em, headers); err != nil {
+			return buff.n, err
+		}
+		return buff.n, buff.err
+	}
+
+	if e.NoMIME && !e.FlowedText && isPlainRFC822(e) {
+		if _, ok := e.Headers["MIME-Version"]; !ok {
+			headers.Del("MIME-Version")
+		}
+		e.writeHeaders(buff, headers)
+		io.WriteString(buff, "\r\n")
+		buff.Write(toCRLF(e.Text))
+		return buff.n, buff.err
+	}
+
+	if isSmallASCIIText(e) {
+		// Nothing here needs encoding, so skip the MIME machinery.
+		headers.Set("Content-Type", "text/plain; charset=us-ascii")
+		headers.Set("Content-Transfer-Encoding", "7bit")
+		e.writeHeaders(buff, headers)
+		io.WriteString(buff, "\r\n")
+		writeCRLF(buff, e.Text)
+		return buff.n, buff.err
+	}
+
+	if err := e.emitParts(em, headers); err != nil {
+		return buff.n, err
+	}
+	return buff.n, buff.err
+}
+
+// alternative is a body added with AddAlternative.
+type alternative struct {
+	contentType string
+	body        []byte
+}
+
+// AddAlternative adds body, of the given text media type such as
+// "text/markdown" or "text/enriched", as a further alternative representation
+// of the message. Alternatives are written in the multipart/alternative after
+// the Text and HTML bodies, in the order they were added; as clients show the
+// last one they support (RFC 2046, section 5.1.4), they should be added from
+// the least to the most preferred. Like Text and HTML, the body is written
+// with a UTF-8 charset parameter.
+func (e *Email) AddAlternative(contentType string, body []byte) {
+	e.alternatives = append(e.alternatives, alternative{contentType: contentType, body: body})
+}
+
+// emitParts emits the MIME structure of e, with headers as the message header.
+func (e *Email) emitParts(em partEmitter, headers textproto.MIMEHeader) error {
 	htmlAttachments, otherAttachments := e.categorizeAttachments()
 	if len(e.HTML) == 0 && len(htmlAttachments) > 0 {
-		return nil, errors.New("there are HTML attachments, but no HTML body")
+		return errHTMLAttachmentsNoBody
 	}
 
+	bodies := len(e.alternatives)
+	if len(e.Text) > 0 {
+		bodies++
+	}
+	if len(e.HTML) > 0 {
+		bodies++
+	}
+	// A parsed report keeps its report parts after the body, in place of a
+	// multipart/mixed.
+	mixed := "mixed"
+	if e.report != nil {
+		mixed = "report; report-type=" + e.report.reportType
+	}
 	var (
-		isMixed       = len(otherAttachments) > 0
-		isAlternative = len(e.Text) > 0 && len(e.HTML) > 0
+		isMixed       = len(otherAttachments) > 0 || e.report != nil
+		isAlternative = bodies > 1
 		isRelated     = len(e.HTML) > 0 && len(htmlAttachments) > 0
 	)
 
-	var w *multipart.Writer
-	if isMixed || isAlternative || isRelated {
-		w = multipart.NewWriter(buff)
-	}
-	switch {
-	case isMixed:
-		headers.Set("Content-Type", "multipart/mixed;\r\n boundary="+w.Boundary())
-	case isAlternative:
-		headers.Set("Content-Type", "multipart/alternative;\r\n boundary="+w.Boundary())
-	case isRelated:
-		headers.Set("Content-Type", "multipart/related;\r\n boundary="+w.Boundary())
-	case len(e.HTML) > 0:
-		headers.Set("Content-Type", "text/html; charset=UTF-8")
-		headers.Set("Content-Transfer-Encoding", "quoted-printable")
-	default:
-		headers.Set("Content-Type", "text/plain; charset=UTF-8")
-		headers.Set("Content-Transfer-Encoding", "quoted-printable")
-	}
-	headerToBytes(buff, headers)
-	_, err = io.WriteString(buff, "\r\n")
-	if err != nil {
-		return nil, err
+	textEncoding, htmlEncoding := e.textEncodings()
+	text, textType := e.Text, "text/plain"
+	if e.FlowedText {
+		text, textType = toFlowed(e.Text, e.FlowedDelSp), "text/plain; format=flowed"
+		if e.FlowedDelSp {
+			textType += "; delsp=yes"
+		}
 	}
 
-	// Check to see if there is a Text or HTML field
-	if len(e.Text) > 0 || len(e.HTML) > 0 {
-		var subWriter *multipart.Writer
-
-		if isMixed && isAlternative {
-			// Create the multipart alternative part
-			subWriter = multipart.NewWriter(buff)
-			header := textproto.MIMEHeader{
-				"Content-Type": {"multipart/alternative;\r\n boundary=" + subWriter.Boundary()},
+	// The message header goes on the outermost entity, whichever that is.
+	top := headers
+	if isMixed {
+		if err := em.openMultipart(mixed, top); err != nil {
+			return err
+		}
+		top = nil
+	}
+	if isAlternative {
+		if err := em.openMultipart("alternative", top); err != nil {
+			return err
+		}
+		top = nil
+	}
+	if len(e.Text) > 0 {
+		if err := writeMessage(em, top, text, textType, textEncoding, e.QPWordWrap); err != nil {
+			return err
+		}
+		top = nil
+	}
+	if len(e.HTML) > 0 {
+		if isRelated {
+			if err := em.openMultipart("related", top); err != nil {
+				return err
+			}
+			top = nil
+		}
+		if err := writeMessage(em, top, e.HTML, "text/html", htmlEncoding, e.QPWordWrap); err != nil {
+			return err
+		}
+		top = nil
+		for _, a := range htmlAttachments {
+			if err := emitAttachment(em, a); err != nil {
+				return err
 			}
-			if _, err := w.CreatePart(header); err != nil {
-				return nil, err
+		}
+		if isRelated {
+			if err := em.closeMultipart(); err != nil {
+				return err
 			}
-		} else {
-			subWriter = w
-		}
-		// Create the body sections
-		if len(e.Text) > 0 {
-			// Write the text
-			if err := writeMessage(buff, e.Text, isMixed || isAlternative, "text/plain", subWriter); err != nil {
-				return nil, err
-			}
-		}
-		if len(e.HTML) > 0 {
-			messageWriter := subWriter
-			var relatedWriter *multipart.Writer
-			if (isMixed || isAlternative) && len(htmlAttachments) > 0 {
-				relatedWriter = multipart.NewWriter(buff)
-				header := textproto.MIMEHeader{
-					"Content-Type": {"multipart/related;\r\n boundary=" + relatedWriter.Boundary()},
-				}
-				if _, err := subWriter.CreatePart(header); err != nil {
-					return nil, err
-				}
+		}
+	}
+	for _, alt := range e.alternatives {
+		if err := writeMessage(em, top, alt.body, alt.contentType, "", e.QPWordWrap); err != nil {
+			return err
+		}
+		top = nil
+	}
+	if isAlternative {
+		if err := em.closeMultipart(); err != nil {
+			return err
+		}
+	}
+	if e.report != nil {
+		if err := e.emitReportParts(em); err != nil {
+			return err
+		}
+	}
+	for _, a := range otherAttachments {
+		if err := emitAttachment(em, a); err != nil {
+			return err
+		}
+	}
+	if isMixed {
+		return em.closeMultipart()
+	}
+	// A message without any content still has an empty plaintext body.
+	if top != nil {
+		return writeMessage(em, top, text, textType, textEncoding, e.QPWordWrap)
+	}
+	return nil
+}
 
-				messageWriter = relatedWriter
-			} else if isRelated && len(htmlAttachments) > 0 {
-				relatedWriter = w
-				messageWriter = w
-			}
-			// Write the HTML
-			if err := writeMessage(buff, e.HTML, isMixed || isAlternative || isRelated, "text/html", messageWriter); err != nil {
-				return nil, err
-			}
-			if len(htmlAttachments) > 0 {
-				for _, a := range htmlAttachments {
-					a.setDefaultHeaders()
-					ap, err := relatedWriter.CreatePart(a.Header)
-					if err != nil {
-						return nil, err
-					}
-					// Write the base64Wrapped content to the part
-					base64Wrap(ap, a.Content)
-				}
+// emitAttachment emits a as a part with its encoded content.
+func emitAttachment(em partEmitter, a *Attachment) error {
+	a.setDefaultHeaders()
+	ap, err := em.leaf(a.Header)
+	if err != nil {
+		return err
+	}
+	return a.writeContent(ap)
+}
 
-				if isMixed || isAlternative {
-					relatedWriter.Close()
-				}
-			}
+// isPlainRFC822 reports whether e can be rendered as a bare RFC 5322 message,
+// without any MIME structure.
+func isPlainRFC822(e *Email) bool {
+	if len(e.HTML) > 0 || len(e.Attachments) > 0 || len(e.alternatives) > 0 || e.report != nil {
+		return false
+	}
+	for _, line := range bytes.Split(e.Text, []byte("\n")) {
+		if len(line) > maxMessageLineLen {
+			return false
 		}
-		if isMixed && isAlternative {
-			if err := subWriter.Close(); err != nil {
-				return nil, err
+		for _, c := range line {
+			if c >= 0x80 || c == 0 {
+				return false
 			}
 		}
 	}
-	// Create attachment part, if necessary
-	for _, a := range otherAttachments {
-		a.setDefaultHeaders()
-		ap, err := w.CreatePart(a.Header)
-		if err != nil {
-			return nil, err
+	return true
+}
+
+// maxSmallTextLen is the largest text body isSmallASCIIText accepts.
+const maxSmallTextLen = 4096
+
+// isSmallASCIIText reports whether e is a short plain text message in ASCII,
+// which can be written as is with a 7bit encoding rather than as quoted
+// printable.
+func isSmallASCIIText(e *Email) bool {
+	if len(e.Text) == 0 || len(e.Text) > maxSmallTextLen || e.FlowedText || e.QPWordWrap {
+		return false
+	}
+	if enc, _ := e.textEncodings(); enc != "" && !strings.EqualFold(enc, "7bit") {
+		return false
+	}
+	if len(e.HTML) > 0 || len(e.Attachments) > 0 || len(e.alternatives) > 0 || e.report != nil {
+		return false
+	}
+	lineLen := 0
+	for _, c := range e.Text {
+		switch {
+		case c >= 0x80 || c == 0:
+			return false
+		case c == '\n':
+			lineLen = 0
+		case lineLen == maxMessageLineLen:
+			return false
+		default:
+			lineLen++
 		}
-		// Write the base64Wrapped content to the part
-		base64Wrap(ap, a.Content)
 	}
-	if isMixed || isAlternative || isRelated {
-		if err := w.Close(); err != nil {
-			return nil, err
+	return true
+}
+
+// toCRLF converts any bare LF or bare CR line endings in b to CRLF, as SMTP
+// requires. Bare line endings can otherwise be interpreted differently by
+// different servers, which allows SMTP smuggling.
+func toCRLF(b []byte) []byte {
+	var buf bytes.Buffer
+	buf.Grow(len(b))
+	for i, c := range b {
+		if c == '\n' && (i == 0 || b[i-1] != '\r') {
+			buf.WriteByte('\r')
+		}
+		buf.WriteByte(c)
+		if c == '\r' && (i == len(b)-1 || b[i+1] != '\n') {
+			buf.WriteByte('\n')
 		}
 	}
-	return buff.Bytes(), nil
+	return buf.Bytes()
 }
 
-// Send an email using the given host and SMTP auth (optional), returns any error thrown by smtp.SendMail
-// This function merges the To, Cc, and Bcc fields and calls the smtp.SendMail function using the Email.Bytes() output as the message
-func (e *Email) Send(addr string, a smtp.Auth) error {
-	// Merge the To, Cc, and Bcc fields
-	to := make([]string, 0, len(e.To)+len(e.Cc)+len(e.Bcc))
-	to = append(append(append(to, e.To...), e.Cc...), e.Bcc...)
-	for i := 0; i < len(to); i++ {
-		addr, err := mail.ParseAddress(to[i])
-		if err != nil {
+var crlf = []byte("\r\n")
+
+// writeCRLF writes b to w like toCRLF, but without copying it first.
+func writeCRLF(w io.Writer, b []byte) error {
+	for len(b) > 0 {
+		i := bytes.IndexAny(b, "\r\n")
+		if i < 0 {
+			_, err := w.Write(b)
 			return err
 		}
-		to[i] = addr.Address
+		n := i + 1
+		if b[i] == '\r' && i+1 < len(b) && b[i+1] == '\n' {
+			n++
+		}
+		if _, err := w.Write(b[:i]); err != nil {
+			return err
+		}
+		if _, err := w.Write(crlf); err != nil {
+			return err
+		}
+		b = b[n:]
 	}
-	// Check to make sure there is at least one recipient and one "From" address
-	if e.From == "" || len(to) == 0 {
+	return nil
+}
+
+// toLF converts CRLF and bare CR line endings in b to LF.
+func toLF(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	b = bytes.Replace(b, []byte("\r\n"), []byte("\n"), -1)
+	return bytes.Replace(b, []byte("\r"), []byte("\n"), -1)
+}
+
+// foldLineBreaks converts the line breaks in the header value s to CRLF and
+// makes sure that each is followed by whitespace, so that they fold the value
+// rather than ending it and starting a new header field.
+func foldLineBreaks(s string) string {
+	if !strings.ContainsAny(s, "\r\n") {
+		return s
+	}
+	lines := strings.Split(string(toCRLF([]byte(s))), "\r\n")
+	for i, line := range lines[1:] {
+		if !strings.HasPrefix(line, " ") && !strings.HasPrefix(line, "\t") {
+			lines[i+1] = " " + line
+		}
+	}
+	return strings.Join(lines, "\r\n")
+}
+
+// Fingerprint returns a SHA-256 hash of the meaningful content of the Email:
+// the From and recipient addresses, the Subject, the plaintext and HTML bodies,
+// and the attachments. Volatile fields such as the Date, Message-Id and MIME
+// boundaries are not included, so the fingerprint is stable across renders
+// and can be used to detect duplicate messages.
+func (e *Email) Fingerprint() [32]byte {
+	h := sha256.New()
+	// Length-prefix every field so that they can't run into each other.
+	field := func(b []byte) {
+		var n [8]byte
+		binary.BigEndian.PutUint64(n[:], uint64(len(b)))
+		h.Write(n[:])
+		h.Write(b)
+	}
+	addrs := func(list []string) {
+		norm := make([]string, 0, len(list))
+		for _, a := range list {
+			if addr, err := mail.ParseAddress(a); err == nil {
+				a = addr.Address
+			}
+			norm = append(norm, strings.ToLower(a))
+		}
+		sort.Strings(norm)
+		field([]byte(strings.Join(norm, ",")))
+	}
+	addrs([]string{e.From})
+	addrs(e.To)
+	addrs(e.Cc)
+	addrs(e.Bcc)
+	field([]byte(e.Subject))
+	field(e.Text)
+	field(e.HTML)
+	for _, a := range e.Attachments {
+		field([]byte(a.Filename))
+		field([]byte(a.ContentType))
+		field(a.Content)
+	}
+	var sum [32]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// Reader returns an io.ReadCloser which renders the Email lazily as it is read,
+// without materializing the whole message in memory. Any error encountered while
+// rendering is returned from Read. Callers that stop reading early must call Close
+// to release the rendering goroutine.
+func (e *Email) Reader() (io.ReadCloser, error) {
+	if htmlAttachments, _ := e.categorizeAttachments(); len(e.HTML) == 0 && len(htmlAttachments) > 0 {
+		return nil, errHTMLAttachmentsNoBody
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := e.WriteTo(pw)
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+// countingWriter counts the bytes written to the underlying io.Writer, and
+// remembers the first error so that it isn't lost by writers which ignore it.
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
+
+// WriteString writes s without copying it to a []byte first, if the
+// underlying io.Writer supports that.
+func (cw *countingWriter) WriteString(s string) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := io.WriteString(cw.w, s)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
+
+// Validate checks that the Email has a valid From address and at least one
+// valid recipient, and that none of its header fields or values could be used
+// for header injection.
+func (e *Email) Validate() error {
+	if e.From == "" {
 		return errors.New("Must specify at least one From address and one To address")
 	}
-	sender, err := e.parseSender()
+	if _, err := e.parseSender(); err != nil {
+		return err
+	}
+	if _, err := mail.ParseAddress(e.From); err != nil {
+		return err
+	}
+	to, err := addressLists(e.To, e.Cc, e.Bcc)
 	if err != nil {
 		return err
 	}
+	if len(to) == 0 {
+		return errors.New("Must specify at least one From address and one To address")
+	}
+	values := append([]string{e.From, e.Sender, e.ReturnPath, e.Subject}, e.ReplyTo...)
+	for _, lst := range [][]string{e.To, e.Cc, e.Bcc, e.ReadReceipt} {
+		values = append(values, lst...)
+	}
+	for field, vals := range e.Headers {
+		if field == "" || strings.ContainsAny(field, ": \t\r\n") {
+			return fmt.Errorf("invalid header field name %q", field)
+		}
+		values = append(values, vals...)
+	}
+	for _, v := range values {
+		if strings.ContainsAny(v, "\r\n") {
+			return fmt.Errorf("header value %q contains a line break", v)
+		}
+	}
+	return nil
+}
+
+// DryRun validates and renders the Email without sending it, and then parses
+// the rendered message back to check that it is well-formed. It returns the
+// first problem found, or nil if the Email would be sent as expected.
+func (e *Email) DryRun() error {
+	if err := e.Validate(); err != nil {
+		return err
+	}
 	raw, err := e.Bytes()
 	if err != nil {
 		return err
 	}
-	return smtp.SendMail(addr, a, sender, to, raw)
+	for i, line := range bytes.Split(raw, []byte("\r\n")) {
+		if len(line) > maxMessageLineLen {
+			return fmt.Errorf("line %d is %d characters long, exceeding the maximum of %d", i+1, len(line), maxMessageLineLen)
+		}
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	_, err = parseMIMEParts(textproto.MIMEHeader(msg.Header), msg.Body)
+	return err
 }
 
-// Select and parse an SMTP envelope sender address.  Choose Email.Sender if set, or fallback to Email.From.
+// Send an email using the given host and SMTP auth (optional), returns any error thrown by SendMail
+// This function merges the To, Cc, and Bcc fields and calls SendMail with the default options
+func (e *Email) Send(addr string, a smtp.Auth) error {
+	return SendMail(addr, a, e)
+}
+
+// mail starts a mail transaction on c from sender, asking the server to only
+// relay the message over TLS if e.RequireTLS is set, and with the envelope ID
+// of the message.
+func (e *Email) mail(c *smtp.Client, sender string) error {
+	if !e.RequireTLS && e.EnvelopeID == "" {
+		return c.Mail(sender)
+	}
+	cmd, err := mailCommand(c, sender, &MailOptions{RequireTLS: e.RequireTLS, EnvelopeID: e.EnvelopeID}, false)
+	if err != nil {
+		return err
+	}
+	return textCmd(c.Text, 250, "%s", cmd)
+}
+
+// Select and parse an SMTP envelope sender address.  Choose Email.ReturnPath if set, then Email.Sender,
+// or fallback to Email.From. The header From is always Email.From, and the SMTP AUTH identity is
+// independent of all three.
 func (e *Email) parseSender() (string, error) {
+	if e.ReturnPath == "<>" {
+		return "", nil
+	}
+	if e.ReturnPath != "" {
+		rp, err := mail.ParseAddress(e.ReturnPath)
+		if err != nil {
+			return "", err
+		}
+		return rp.Address, nil
+	}
 	if e.Sender != "" {
 		sender, err := mail.ParseAddress(e.Sender)
 		if err != nil {
@@ -598,7 +1896,7 @@ func (e *Email) SendWithTLS(addr string, a smtp.Auth, t *tls.Config) error {
 			}
 		}
 	}
-	if err = c.Mail(sender); err != nil {
+	if err = e.mail(c, sender); err != nil {
 		return err
 	}
 	for _, addr := range to {
@@ -606,16 +1904,10 @@ func (e *Email) SendWithTLS(addr string, a smtp.Auth, t *tls.Config) error {
 			return err
 		}
 	}
-	w, err := c.Data()
-	if err != nil {
-		return err
-	}
-	_, err = w.Write(raw)
-	if err != nil {
+	if err = textCmd(c.Text, 354, "DATA"); err != nil {
 		return err
 	}
-	err = w.Close()
-	if err != nil {
+	if err = writeData(c.Text, raw); err != nil {
 		return err
 	}
 	return c.Quit()
@@ -673,7 +1965,7 @@ func (e *Email) SendWithStartTLS(addr string, a smtp.Auth, t *tls.Config) error
 			}
 		}
 	}
-	if err = c.Mail(sender); err != nil {
+	if err = e.mail(c, sender); err != nil {
 		return err
 	}
 	for _, addr := range to {
@@ -681,16 +1973,10 @@ func (e *Email) SendWithStartTLS(addr string, a smtp.Auth, t *tls.Config) error
 			return err
 		}
 	}
-	w, err := c.Data()
-	if err != nil {
-		return err
-	}
-	_, err = w.Write(raw)
-	if err != nil {
+	if err = textCmd(c.Text, 354, "DATA"); err != nil {
 		return err
 	}
-	err = w.Close()
-	if err != nil {
+	if err = writeData(c.Text, raw); err != nil {
 		return err
 	}
 	return c.Quit()
@@ -699,11 +1985,29 @@ func (e *Email) SendWithStartTLS(addr string, a smtp.Auth, t *tls.Config) error
 // Attachment is a struct representing an email attachment.
 // Based on the mime/multipart.FileHeader struct, Attachment contains the name, MIMEHeader, and content of the attachment in question
 type Attachment struct {
-	Filename    string
-	ContentType string
-	Header      textproto.MIMEHeader
-	Content     []byte
-	HTMLRelated bool
+	Filename         string
+	ContentType      string
+	Header           textproto.MIMEHeader
+	Content          []byte
+	HTMLRelated      bool
+	ContentLocation  string    // URL by which the HTML refers to the attachment (optional)
+	Description      string    // Content-Description header, e.g. for accessibility tools (optional)
+	CreationDate     time.Time // creation-date Content-Disposition parameter (optional)
+	ModificationDate time.Time // modification-date Content-Disposition parameter (optional)
+
+	defaultEncoding bool // whether setDefaultHeaders chose the Content-Transfer-Encoding
+}
+
+// CID returns the Content-ID of the attachment without its angle brackets,
+// as it is referred to in a "cid:" URL.
+func (at *Attachment) CID() string {
+	return strings.TrimSuffix(strings.TrimPrefix(at.Header.Get("Content-ID"), "<"), ">")
+}
+
+// Reader returns a reader over the decoded content of the attachment, which
+// can be used to copy it elsewhere without making another copy in memory.
+func (at *Attachment) Reader() io.Reader {
+	return bytes.NewReader(at.Content)
 }
 
 func (at *Attachment) setDefaultHeaders() {
@@ -718,14 +2022,129 @@ func (at *Attachment) setDefaultHeaders() {
 		if at.HTMLRelated {
 			disposition = "inline"
 		}
-		at.Header.Set("Content-Disposition", fmt.Sprintf("%s;\r\n filename=\"%s\"", disposition, at.Filename))
+		// An inline resource may have no filename, so that clients don't
+		// list it as an attachment.
+		cd := disposition
+		if at.Filename != "" {
+			cd += fmt.Sprintf(";\r\n filename=\"%s\"", at.Filename)
+		}
+		if !at.CreationDate.IsZero() {
+			cd += fmt.Sprintf(";\r\n creation-date=\"%s\"", at.CreationDate.Format(time.RFC1123Z))
+		}
+		if !at.ModificationDate.IsZero() {
+			cd += fmt.Sprintf(";\r\n modification-date=\"%s\"", at.ModificationDate.Format(time.RFC1123Z))
+		}
+		at.Header.Set("Content-Disposition", cd)
 	}
-	if len(at.Header.Get("Content-ID")) == 0 {
+	if at.Description != "" && len(at.Header.Get("Content-Description")) == 0 {
+		at.Header.Set("Content-Description", mime.QEncoding.Encode(CharsetLabel, at.Description))
+	}
+	if at.ContentLocation != "" {
+		at.Header.Set("Content-Location", at.ContentLocation)
+	} else if len(at.Header.Get("Content-ID")) == 0 && at.Filename != "" {
 		at.Header.Set("Content-ID", fmt.Sprintf("<%s>", at.Filename))
 	}
 	if len(at.Header.Get("Content-Transfer-Encoding")) == 0 {
 		at.Header.Set("Content-Transfer-Encoding", "base64")
+		at.defaultEncoding = true
+	}
+}
+
+// writeContent encodes the attachment content according to its Content-Transfer-Encoding
+// header and writes it to w. Unknown encodings fall back to base64.
+func (at *Attachment) writeContent(w io.Writer) error {
+	switch strings.ToLower(at.Header.Get("Content-Transfer-Encoding")) {
+	case "quoted-printable":
+		return quotePrintEncode(w, at.Content)
+	case "7bit", "8bit":
+		_, err := w.Write(toCRLF(at.Content))
+		return err
+	case "binary":
+		_, err := w.Write(at.Content)
+		return err
+	default:
+		return base64WrapReader(w, at.Reader())
+	}
+}
+
+// quotedPrintableWordWrap writes b to w in quoted-printable encoding, like a
+// quotedprintable.Writer, but breaks long lines after a space or tab where
+// possible, rather than in the middle of a word. Encoded lines are never
+// longer than MaxLineLength.
+func quotedPrintableWordWrap(w io.Writer, b []byte) error {
+	const hex = "0123456789ABCDEF"
+	var out bytes.Buffer
+	for len(b) > 0 {
+		// Split off the next line, treating CRLF, LF and CR as line breaks.
+		end := bytes.IndexAny(b, "\r\n")
+		line, rest, hardBreak := b, []byte(nil), false
+		if end >= 0 {
+			line, rest, hardBreak = b[:end], b[end+1:], true
+			if b[end] == '\r' && len(rest) > 0 && rest[0] == '\n' {
+				rest = rest[1:]
+			}
+		}
+		b = rest
+
+		var cur []byte
+		lastSpace := -1
+		for i, c := range line {
+			var tok []byte
+			switch {
+			case (c == ' ' || c == '\t') && i < len(line)-1, c >= '!' && c <= '~' && c != '=':
+				tok = []byte{c}
+			default:
+				tok = []byte{'=', hex[c>>4], hex[c&0x0f]}
+			}
+			// Leave room for the "=" of a soft line break.
+			if len(cur)+len(tok) > MaxLineLength-1 {
+				if lastSpace > 0 {
+					out.Write(cur[:lastSpace])
+					out.WriteString("=\r\n")
+					cur = append([]byte(nil), cur[lastSpace:]...)
+				}
+				if len(cur)+len(tok) > MaxLineLength-1 {
+					out.Write(cur)
+					out.WriteString("=\r\n")
+					cur = cur[:0]
+				}
+				lastSpace = -1
+			}
+			cur = append(cur, tok...)
+			if len(tok) == 1 && (c == ' ' || c == '\t') {
+				lastSpace = len(cur)
+			}
+		}
+		out.Write(cur)
+		if hardBreak {
+			out.WriteString("\r\n")
+		}
+	}
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+// WriteBase64 writes b to w encoded as base64, in lines of 76 characters
+// ending in CRLF (RFC 2045), as the package encodes attachments. It is useful
+// for building MIME parts by hand.
+func WriteBase64(w io.Writer, b []byte) {
+	base64Wrap(w, b)
+}
+
+// WriteQuotedPrintable writes b to w encoded as quoted-printable (RFC 2045),
+// with soft line breaks keeping lines within 76 characters, as the package
+// encodes text bodies. It is useful for building MIME parts by hand.
+func WriteQuotedPrintable(w io.Writer, b []byte) error {
+	return quotePrintEncode(w, b)
+}
+
+// quotePrintEncode encodes b as quoted-printable, and writes it to w.
+func quotePrintEncode(w io.Writer, b []byte) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write(b); err != nil {
+		return err
 	}
+	return qp.Close()
 }
 
 // base64Wrap encodes the attachment content, and wraps it according to RFC 2045 standards (every 76 chars)
@@ -751,34 +2170,166 @@ func base64Wrap(w io.Writer, b []byte) {
 	}
 }
 
+// base64WrapReader is the streaming counterpart to base64Wrap. It reads r in chunks of
+// whole 57-byte lines and writes the wrapped base64 output to w as it goes, producing
+// byte-identical output to base64Wrap without holding the entire content in memory.
+// Unlike base64Wrap, it returns the first error writing to w.
+func base64WrapReader(w io.Writer, r io.Reader) error {
+	// 57 raw bytes per 76-byte base64 line, read 64 lines at a time.
+	const maxRaw = 57
+	raw := make([]byte, maxRaw*64)
+	cw := &countingWriter{w: w}
+	for {
+		n, err := io.ReadFull(r, raw)
+		if n > 0 {
+			base64Wrap(cw, raw[:n])
+			if cw.err != nil {
+				return cw.err
+			}
+		}
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			return nil
+		default:
+			return err
+		}
+	}
+}
+
+// writeHeaders renders the message headers to buff, emitting e.RawSubject
+// verbatim unless the Subject has been changed since it was set.
+func (e *Email) writeHeaders(buff io.Writer, headers textproto.MIMEHeader) {
+	if e.RawSubject != "" && headers.Get("Subject") == decodeRawSubject(e.RawSubject) {
+		headers.Del("Subject")
+		io.WriteString(buff, "Subject: "+foldLineBreaks(e.RawSubject)+"\r\n")
+	}
+	headerToBytes(buff, headers)
+}
+
 // headerToBytes renders "header" to "buff". If there are multiple values for a
-// field, multiple "Field: value\r\n" lines will be emitted.
-func headerToBytes(buff io.Writer, header textproto.MIMEHeader) {
+// field, multiple "Field: value\r\n" lines will be emitted. Address headers have
+// their display names RFC 2047 encoded as needed, as do the values of all other
+// unstructured headers containing non-ASCII characters.
+func headerToBytes(w io.Writer, header textproto.MIMEHeader) {
+	// Everything is written straight to w, which saves copying it through a
+	// buffer when w is one already, as it is when rendering a message.
 	for field, vals := range header {
 		for _, subval := range vals {
-			// bytes.Buffer.Write() never returns an error.
-			io.WriteString(buff, field)
-			io.WriteString(buff, ": ")
+			io.WriteString(w, field)
+			io.WriteString(w, ": ")
 			// Write the encoded header if needed
 			switch {
 			case field == "Content-Type" || field == "Content-Disposition":
-				buff.Write([]byte(subval))
-			case field == "From" || field == "To" || field == "Cc" || field == "Bcc":
-				participants := strings.Split(subval, ",")
-				for i, v := range participants {
-					addr, err := mail.ParseAddress(v)
-					if err != nil {
-						continue
+				io.WriteString(w, foldLineBreaks(subval))
+			case field == "Keywords":
+				io.WriteString(w, encodeKeywords(field, subval))
+			case field == "List-Unsubscribe":
+				io.WriteString(w, foldURIList(field, subval))
+			case field == "From" || field == "To" || field == "Cc" || field == "Bcc" || field == "Reply-To" || field == "Sender":
+				if strings.ContainsAny(subval, "\r\n") {
+					participants := strings.Split(subval, ",")
+					for i, v := range participants {
+						if addr, err := mail.ParseAddress(v); err == nil {
+							participants[i] = encodeAddress(addr)
+						}
+					}
+					io.WriteString(w, foldLineBreaks(strings.Join(participants, ", ")))
+					break
+				}
+				// Like the folded case, but without splitting into a slice.
+				for rest := subval; ; {
+					v := rest
+					j := strings.IndexByte(rest, ',')
+					if j >= 0 {
+						v, rest = rest[:j], rest[j+1:]
+					}
+					if addr, err := mail.ParseAddress(v); err == nil {
+						v = encodeAddress(addr)
+					}
+					io.WriteString(w, v)
+					if j < 0 {
+						break
 					}
-					participants[i] = addr.String()
+					io.WriteString(w, ", ")
 				}
-				buff.Write([]byte(strings.Join(participants, ", ")))
 			default:
-				buff.Write([]byte(mime.QEncoding.Encode("UTF-8", subval)))
+				io.WriteString(w, mime.QEncoding.Encode(CharsetLabel, subval))
+			}
+			io.WriteString(w, "\r\n")
+		}
+	}
+}
+
+// encodeAddress formats addr for a header like addr.String, but spells the
+// charset of an encoded display name as CharsetLabel.
+func encodeAddress(addr *mail.Address) string {
+	s := addr.String()
+	if i := strings.LastIndex(s, " <"); i >= 0 && CharsetLabel != "utf-8" {
+		s = strings.Replace(s[:i], "=?utf-8?", "=?"+CharsetLabel+"?", -1) + s[i:]
+	}
+	return s
+}
+
+// encodeKeywords RFC 2047 encodes each of the comma-separated keywords in
+// list separately, and folds the list so that the lines of the field are no
+// longer than 78 characters where possible.
+func encodeKeywords(field, list string) string {
+	var keywords []string
+	for _, kw := range strings.Split(list, ",") {
+		if kw = strings.TrimSpace(kw); kw != "" {
+			keywords = append(keywords, kw)
+		}
+	}
+	var words []string
+	for i, kw := range keywords {
+		enc := strings.Fields(mime.QEncoding.Encode(CharsetLabel, kw))
+		if i < len(keywords)-1 {
+			enc[len(enc)-1] += ","
+		}
+		words = append(words, enc...)
+	}
+	var b bytes.Buffer
+	lineLen := len(field) + 1
+	for i, w := range words {
+		if i > 0 && lineLen+1+len(w) > 78 {
+			b.WriteString("\r\n")
+			lineLen = 0
+		}
+		if i > 0 {
+			b.WriteString(" ")
+		}
+		b.WriteString(w)
+		lineLen += 1 + len(w)
+	}
+	return b.String()
+}
+
+// foldURIList folds a comma-separated list of <URI>s, as in List-Unsubscribe
+// (RFC 2369), between its entries, so that the lines of the field are no longer
+// than 78 characters where possible. The URIs themselves are never broken or
+// encoded, since they often carry long tokens which must survive intact.
+func foldURIList(field, list string) string {
+	list = strings.NewReplacer("\r", "", "\n", "").Replace(list)
+	var b bytes.Buffer
+	lineLen := len(field) + 1
+	for _, uri := range strings.Split(list, ",") {
+		if uri = strings.TrimSpace(uri); uri == "" {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString(",")
+			lineLen++
+			if lineLen+1+len(uri) > 78 {
+				b.WriteString("\r\n")
+				lineLen = 0
 			}
-			io.WriteString(buff, "\r\n")
 		}
+		b.WriteString(" ")
+		b.WriteString(uri)
+		lineLen += 1 + len(uri)
 	}
+	return strings.TrimPrefix(b.String(), " ")
 }
 
 var maxBigInt = big.NewInt(math.MaxInt64)
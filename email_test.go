@@ -16,6 +16,11 @@ import (
 	"net/mail"
 	"net/smtp"
 	"net/textproto"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+	"unicode/utf8"
 )
 
 func prepareEmail() *Email {
@@ -70,6 +75,39 @@ func TestEmailText(t *testing.T) {
 	}
 }
 
+func TestEmailNoMIME(t *testing.T) {
+	e := prepareEmail()
+	e.NoMIME = true
+	e.Text = []byte("Plain old text.\nSecond line.\r\n")
+	raw, err := e.Bytes()
+	if err != nil {
+		t.Fatal("Failed to render message: ", err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal("Could not parse rendered message: ", err)
+	}
+	for _, h := range []string{"Mime-Version", "Content-Type", "Content-Transfer-Encoding"} {
+		if v := msg.Header.Get(h); v != "" {
+			t.Errorf("Unexpected %s header: %#q", h, v)
+		}
+	}
+	body, err := ioutil.ReadAll(msg.Body)
+	if err != nil {
+		t.Fatal("Could not read body: ", err)
+	}
+	if want := "Plain old text.\r\nSecond line.\r\n"; string(body) != want {
+		t.Errorf("Incorrect body: %#q != %#q", body, want)
+	}
+
+	// Non-ASCII text still requires MIME.
+	e.Text = []byte("Caf\u00e9\n")
+	msg = basicTests(t, e)
+	if v := msg.Header.Get("Mime-Version"); v != "1.0" {
+		t.Errorf("Missing Mime-Version header: %#q", v)
+	}
+}
+
 func TestEmailWithHTMLAttachments(t *testing.T) {
 	e := prepareEmail()
 
@@ -202,6 +240,309 @@ func TestEmailWithHTMLAttachmentsHTMLOnly(t *testing.T) {
 	}
 }
 
+func TestEmailAddAlternative(t *testing.T) {
+	// alternativeTypes returns the media types of the parts of the
+	// multipart/alternative message raw, in order.
+	alternativeTypes := func(raw []byte) []string {
+		msg, err := mail.ReadMessage(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal("Could not parse rendered message: ", err)
+		}
+		mt, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+		if mt != "multipart/alternative" {
+			t.Fatalf("Content-Type expected \"multipart/alternative\", not %q", mt)
+		}
+		var types []string
+		mr := multipart.NewReader(msg.Body, params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal("Could not read part: ", err)
+			}
+			ct, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+			types = append(types, ct)
+		}
+		return types
+	}
+
+	e := prepareEmail()
+	e.AddAlternative("text/plain", []byte("Hello"))
+	e.AddAlternative("text/enriched", []byte("<bold>Hello</bold>"))
+	e.AddAlternative("text/markdown", []byte("**Hello**"))
+	raw, err := e.Bytes()
+	if err != nil {
+		t.Fatal("Could not serialize e-mail:", err)
+	}
+	if got, want := alternativeTypes(raw), []string{"text/plain", "text/enriched", "text/markdown"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Incorrect alternatives: %q != %q", got, want)
+	}
+	if !bytes.Contains(raw, []byte("**Hello**")) {
+		t.Errorf("Missing markdown body: %#q", raw)
+	}
+
+	e = prepareEmail()
+	e.Text = []byte("Hello")
+	e.HTML = []byte("<b>Hello</b>")
+	e.AddAlternative("text/markdown", []byte("**Hello**"))
+	raw, err = e.Bytes()
+	if err != nil {
+		t.Fatal("Could not serialize e-mail:", err)
+	}
+	if got, want := alternativeTypes(raw), []string{"text/plain", "text/html", "text/markdown"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Incorrect alternatives: %q != %q", got, want)
+	}
+}
+
+func TestEmailHTMLOnly(t *testing.T) {
+	e := prepareEmail()
+	e.Text = []byte("This is a text.")
+	e.HTML = []byte("<html><body>This is a text.</body></html>")
+	e.HTMLOnly = true
+
+	raw, err := e.Bytes()
+	if err != nil {
+		t.Fatal("Could not serialize e-mail:", err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal("Could not parse rendered message: ", err)
+	}
+	if mt, _, _ := mime.ParseMediaType(msg.Header.Get("Content-Type")); mt != "text/html" {
+		t.Errorf("Content-Type expected \"text/html\", not %q", mt)
+	}
+
+	attachment, err := e.Attach(bytes.NewBufferString("Rad attachment"), "rad.txt", "image/png; charset=utf-8")
+	if err != nil {
+		t.Fatal("Could not add an attachment to the message: ", err)
+	}
+	attachment.HTMLRelated = true
+	raw, err = e.Bytes()
+	if err != nil {
+		t.Fatal("Could not serialize e-mail:", err)
+	}
+	tp := textproto.NewReader(bufio.NewReader(&trimReader{rd: bytes.NewBuffer(raw)}))
+	hdrs, err := tp.ReadMIMEHeader()
+	if err != nil {
+		t.Fatal("Could not parse the headers:", err)
+	}
+	if !strings.HasPrefix(hdrs.Get("Content-Type"), "multipart/related") {
+		t.Error("Envelope Content-Type is not multipart/related: ", hdrs["Content-Type"])
+	}
+	ps, err := parseMIMEParts(hdrs, tp.R)
+	if err != nil {
+		t.Fatal("Could not parse the MIME parts recursively:", err)
+	}
+	for _, part := range ps {
+		if strings.Contains(part.header.Get("Content-Type"), "text/plain") {
+			t.Error("Found a text/plain part in an HTML-only message")
+		}
+	}
+	if len(e.Text) == 0 {
+		t.Error("Rendering an HTML-only message cleared e.Text")
+	}
+}
+
+func TestAttachInline(t *testing.T) {
+	e := prepareEmail()
+	e.CIDDomain = "img.example.com"
+	a, err := e.AttachInline(bytes.NewBufferString("Rad image"), "rad.png", "image/png")
+	if err != nil {
+		t.Fatal("Could not attach inline image: ", err)
+	}
+	b, err := e.AttachInline(bytes.NewBufferString("Rad image"), "rad.png", "image/png")
+	if err != nil {
+		t.Fatal("Could not attach inline image: ", err)
+	}
+	if !a.HTMLRelated {
+		t.Error("Inline attachment is not HTML related")
+	}
+	if !strings.HasSuffix(a.CID(), "@img.example.com") {
+		t.Errorf("Content-ID %q does not use the CID domain", a.CID())
+	}
+	if a.CID() == b.CID() {
+		t.Errorf("Inline attachments share the Content-ID %q", a.CID())
+	}
+	e.HTML = []byte(`<img src="cid:` + a.CID() + `">`)
+	raw, err := e.Bytes()
+	if err != nil {
+		t.Fatal("Could not serialize e-mail:", err)
+	}
+	if !bytes.Contains(raw, []byte("Content-Id: <"+a.CID()+">")) {
+		t.Errorf("Rendered message does not contain Content-ID <%s>:\n%s", a.CID(), raw)
+	}
+
+	e = NewEmail()
+	e.From = "Jordan Wright <test@example.com>"
+	c, err := e.AttachInline(bytes.NewBufferString("Rad image"), "rad.png", "image/png")
+	if err != nil {
+		t.Fatal("Could not attach inline image: ", err)
+	}
+	if !strings.HasSuffix(c.CID(), "@example.com") {
+		t.Errorf("Content-ID %q does not use the From domain", c.CID())
+	}
+}
+
+func TestAttachInlineNoFilename(t *testing.T) {
+	e := prepareEmail()
+	a, err := e.AttachInline(bytes.NewBufferString("Rad background"), "", "image/png")
+	if err != nil {
+		t.Fatal("Could not attach inline image: ", err)
+	}
+	e.HTML = []byte(`<div style="background-image: url(cid:` + a.CID() + `)">Hi</div>`)
+	raw, err := e.Bytes()
+	if err != nil {
+		t.Fatal("Could not serialize e-mail:", err)
+	}
+	if bytes.Contains(raw, []byte("filename=")) {
+		t.Errorf("Rendered message has a filename parameter:\n%s", raw)
+	}
+	tp := textproto.NewReader(bufio.NewReader(&trimReader{rd: bytes.NewBuffer(raw)}))
+	hdrs, err := tp.ReadMIMEHeader()
+	if err != nil {
+		t.Fatal("Could not parse the headers:", err)
+	}
+	ps, err := parseMIMEParts(hdrs, tp.R)
+	if err != nil {
+		t.Fatal("Could not parse the MIME parts recursively:", err)
+	}
+	found := false
+	for _, p := range ps {
+		if !strings.HasPrefix(p.header.Get("Content-Type"), "image/png") {
+			continue
+		}
+		found = true
+		if cd := p.header.Get("Content-Disposition"); cd != "inline" {
+			t.Errorf("Expected Content-Disposition \"inline\", got %q", cd)
+		}
+		if cid := p.header.Get("Content-Id"); cid != "<"+a.CID()+">" {
+			t.Errorf("Expected Content-ID <%s>, got %q", a.CID(), cid)
+		}
+	}
+	if !found {
+		t.Error("Did not find the inline image part")
+	}
+}
+
+func TestAttachInlineLocation(t *testing.T) {
+	e := prepareEmail()
+	e.HTML = []byte(`<img src="http://example.com/logo.png">`)
+	if _, err := e.AttachInlineLocation(bytes.NewBufferString("Rad logo"), "", "logo.png", "image/png"); err == nil {
+		t.Error("Expected an error for an empty Content-Location")
+	}
+	if _, err := e.AttachInlineLocation(bytes.NewBufferString("Rad logo"), "http://example.com/logo.png", "logo.png", "image/png"); err != nil {
+		t.Fatal("Could not attach inline image: ", err)
+	}
+	raw, err := e.Bytes()
+	if err != nil {
+		t.Fatal("Could not serialize e-mail:", err)
+	}
+	if !bytes.Contains(raw, []byte("multipart/related")) {
+		t.Errorf("Rendered message has no multipart/related section:\n%s", raw)
+	}
+	if !bytes.Contains(raw, []byte("Content-Location: http://example.com/logo.png\r\n")) {
+		t.Errorf("Rendered message has no Content-Location header:\n%s", raw)
+	}
+	if bytes.Contains(raw, []byte("Content-Id")) {
+		t.Errorf("Rendered message has an unexpected Content-ID:\n%s", raw)
+	}
+
+	parsed, err := NewEmailFromReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal("Could not parse rendered e-mail:", err)
+	}
+	if len(parsed.Attachments) != 1 {
+		t.Fatalf("Expected 1 attachment, got %d", len(parsed.Attachments))
+	}
+	if loc := parsed.Attachments[0].ContentLocation; loc != "http://example.com/logo.png" {
+		t.Errorf("Expected ContentLocation %q, got %q", "http://example.com/logo.png", loc)
+	}
+}
+
+func TestAttachmentDescription(t *testing.T) {
+	e := prepareEmail()
+	e.Text = []byte("See the attached chart.\n")
+	for _, desc := range []string{"Quarterly sales chart", "Diagramme des ventes trimestrielles – été"} {
+		a, err := e.Attach(bytes.NewBufferString("Rad chart"), "chart.png", "image/png")
+		if err != nil {
+			t.Fatal("Could not add an attachment to the message: ", err)
+		}
+		a.Description = desc
+	}
+	raw, err := e.Bytes()
+	if err != nil {
+		t.Fatal("Could not serialize e-mail:", err)
+	}
+	if !bytes.Contains(raw, []byte("Content-Description: Quarterly sales chart\r\n")) {
+		t.Errorf("Rendered message has no plain Content-Description:\n%s", raw)
+	}
+	if !bytes.Contains(raw, []byte("Content-Description: =?utf-8?q?")) {
+		t.Errorf("Rendered message has no encoded Content-Description:\n%s", raw)
+	}
+	parsed, err := NewEmailFromReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal("Could not parse rendered e-mail:", err)
+	}
+	if len(parsed.Attachments) != 2 {
+		t.Fatalf("Expected 2 attachments, got %d", len(parsed.Attachments))
+	}
+	for i, a := range parsed.Attachments {
+		if a.Description != e.Attachments[i].Description {
+			t.Errorf("Expected Description %q, got %q", e.Attachments[i].Description, a.Description)
+		}
+	}
+}
+
+func TestMHTMLFromReader(t *testing.T) {
+	for _, start := range []string{"", "<page@example.com>"} {
+		ct := `multipart/related; boundary="mhtml"; type="text/html"`
+		if start != "" {
+			ct += `; start="` + start + `"`
+		}
+		raw := []byte("From: sender@example.com\r\n" +
+			"Subject: Saved page\r\n" +
+			"MIME-Version: 1.0\r\n" +
+			"Content-Type: " + ct + "\r\n" +
+			"\r\n" +
+			"--mhtml\r\n" +
+			"Content-Type: text/html\r\n" +
+			"Content-ID: <page@example.com>\r\n" +
+			"Content-Location: http://example.com/\r\n" +
+			"\r\n" +
+			"<img src=\"logo.png\">\r\n" +
+			"--mhtml\r\n" +
+			"Content-Type: image/png; name=\"logo.png\"\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"Content-Location: http://example.com/logo.png\r\n" +
+			"\r\n" +
+			"UmFkIGxvZ28=\r\n" +
+			"--mhtml--\r\n")
+		e, err := NewEmailFromReader(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal("Could not parse MHTML:", err)
+		}
+		if string(e.HTML) != `<img src="logo.png">` {
+			t.Errorf("Incorrect HTML: %#q", e.HTML)
+		}
+		if len(e.Attachments) != 1 {
+			t.Fatalf("Expected 1 attachment, got %d", len(e.Attachments))
+		}
+		at := e.Attachments[0]
+		if !at.HTMLRelated || at.ContentLocation != "http://example.com/logo.png" || at.Filename != "logo.png" || string(at.Content) != "Rad logo" {
+			t.Errorf("Incorrect inline attachment: %+v", at)
+		}
+		rendered, err := e.Bytes()
+		if err != nil {
+			t.Fatal("Could not serialize e-mail:", err)
+		}
+		if !bytes.Contains(rendered, []byte("Content-Disposition: inline")) || !bytes.Contains(rendered, []byte("Content-Location: http://example.com/logo.png\r\n")) {
+			t.Errorf("Inline attachment was not rendered with its Content-Location:\n%s", rendered)
+		}
+	}
+}
+
 func TestEmailHTML(t *testing.T) {
 	e := prepareEmail()
 	e.HTML = []byte("<h1>Fancy Html is supported, too!</h1>\n")
@@ -386,6 +727,250 @@ func TestEmailAttachment(t *testing.T) {
 	}
 }
 
+func TestEmailAttachmentQuotedPrintable(t *testing.T) {
+	e := prepareEmail()
+	a, err := e.Attach(bytes.NewBufferString("Caf\u00e9 = coffee\n"), "menu.txt", "text/plain; charset=utf-8")
+	if err != nil {
+		t.Fatal("Could not add an attachment to the message: ", err)
+	}
+	a.Header.Set("Content-Transfer-Encoding", "quoted-printable")
+	raw, err := e.Bytes()
+	if err != nil {
+		t.Fatal("Could not serialize e-mail:", err)
+	}
+	if !bytes.Contains(raw, []byte("Caf=C3=A9 =3D coffee\r\n")) {
+		t.Fatalf("Attachment is not quoted-printable encoded: %#q", raw)
+	}
+	e2, err := NewEmailFromReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Error parsing email %s", err.Error())
+	}
+	if len(e2.Attachments) != 1 {
+		t.Fatalf("Incorrect number of attachments %d != %d", len(e2.Attachments), 1)
+	}
+	if !bytes.Equal(e2.Attachments[0].Content, []byte("Caf\u00e9 = coffee\r\n")) {
+		t.Fatalf("Incorrect attachment content %#q", e2.Attachments[0].Content)
+	}
+}
+
+func TestEmailPersonalize(t *testing.T) {
+	e := prepareEmail()
+	e.Text = []byte("Hello!\n")
+	e.Headers.Set("X-Campaign", "spring")
+	recipients := []Recipient{
+		{Address: "one@example.com", Headers: textproto.MIMEHeader{"X-Recipient-Id": {"1"}}},
+		{Address: "two@example.com", Headers: textproto.MIMEHeader{"x-recipient-id": {"2"}}},
+	}
+	for i, r := range recipients {
+		raw, err := e.Personalize(r).Bytes()
+		if err != nil {
+			t.Fatal("Failed to render message: ", err)
+		}
+		msg, err := mail.ReadMessage(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal("Could not parse rendered message: ", err)
+		}
+		if got, want := msg.Header.Get("X-Recipient-Id"), fmt.Sprint(i+1); got != want {
+			t.Errorf("Incorrect X-Recipient-Id: %#q != %#q", got, want)
+		}
+		if got, want := msg.Header.Get("To"), "<"+r.Address+">"; got != want {
+			t.Errorf("Incorrect To: %#q != %#q", got, want)
+		}
+		if got := msg.Header.Get("Cc"); got != "" {
+			t.Errorf("Unexpected Cc: %#q", got)
+		}
+		if got := msg.Header.Get("X-Campaign"); got != "spring" {
+			t.Errorf("Incorrect X-Campaign: %#q", got)
+		}
+	}
+	if _, ok := e.Headers["X-Recipient-Id"]; ok {
+		t.Error("Personalize modified the original headers")
+	}
+	if len(e.To) != 1 || e.To[0] != "test@example.com" {
+		t.Errorf("Personalize modified the original recipients: %v", e.To)
+	}
+}
+
+func TestEmailReader(t *testing.T) {
+	e := prepareEmail()
+	e.Text = []byte("Text Body is, of course, supported!\n")
+	e.HTML = []byte("<h1>Fancy Html is supported, too!</h1>\n")
+	e.Headers.Set("Message-Id", "<fixed@example.com>")
+	e.Headers.Set("Date", "Thu, 17 Oct 2019 08:55:37 +0100")
+	if _, err := e.Attach(bytes.NewBufferString("Rad attachment"), "rad.txt", "text/plain; charset=utf-8"); err != nil {
+		t.Fatal("Could not add an attachment to the message: ", err)
+	}
+	want, err := e.Bytes()
+	if err != nil {
+		t.Fatal("Failed to render message: ", err)
+	}
+	r, err := e.Reader()
+	if err != nil {
+		t.Fatal("Failed to create reader: ", err)
+	}
+	defer r.Close()
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal("Failed to read message: ", err)
+	}
+	// The boundaries are random, so only compare the structure up to them.
+	if len(got) != len(want) {
+		t.Fatalf("Reader output length differs from Bytes: %d != %d", len(got), len(want))
+	}
+	e2, err := NewEmailFromReader(bytes.NewReader(got))
+	if err != nil {
+		t.Fatal("Could not parse rendered message: ", err)
+	}
+	if !bytes.Equal(e2.Text, []byte("Text Body is, of course, supported!\r\n")) || len(e2.Attachments) != 1 {
+		t.Fatalf("Reader output is not the rendered message: %#q", got)
+	}
+}
+
+func TestEmailWriteToCount(t *testing.T) {
+	e := prepareEmail()
+	e.Text = []byte("Text Body is, of course, supported!\n")
+	if _, err := e.AttachInline(bytes.NewBufferString("Rad logo"), "logo.png", "image/png"); err != nil {
+		t.Fatal("Could not add an inline attachment to the message: ", err)
+	}
+	// The error for an inline attachment without an HTML body still reports
+	// what was written.
+	var buf bytes.Buffer
+	n, err := e.WriteTo(&buf)
+	if err != errHTMLAttachmentsNoBody {
+		t.Errorf("Expected errHTMLAttachmentsNoBody, got %v", err)
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("WriteTo returned %d, but wrote %d bytes", n, buf.Len())
+	}
+
+	e.HTML = []byte("<img src=\"cid:logo.png\">\n")
+	buf.Reset()
+	if n, err = e.WriteTo(&buf); err != nil {
+		t.Fatal("Failed to render message: ", err)
+	}
+	if n == 0 || n != int64(buf.Len()) {
+		t.Errorf("WriteTo returned %d, but wrote %d bytes", n, buf.Len())
+	}
+}
+
+func TestEmailDryRun(t *testing.T) {
+	e := prepareEmail()
+	e.Text = []byte("Text Body is, of course, supported!\n")
+	e.HTML = []byte("<h1>Fancy Html is supported, too!</h1>\n")
+	if _, err := e.Attach(bytes.NewBufferString("Rad attachment"), "rad.txt", "text/plain; charset=utf-8"); err != nil {
+		t.Fatal("Could not add an attachment to the message: ", err)
+	}
+	if err := e.DryRun(); err != nil {
+		t.Fatal("Unexpected dry run error: ", err)
+	}
+
+	cases := []func(e *Email){
+		func(e *Email) { e.From = "" },
+		func(e *Email) { e.To, e.Cc, e.Bcc = nil, nil, nil },
+		func(e *Email) { e.To = []string{"not an address"} },
+		func(e *Email) { e.Headers.Set("X-Injected", "value\r\nBcc: victim@example.com") },
+		func(e *Email) { e.Headers.Set("X-Long", strings.Repeat("a", 1000)) },
+	}
+	for i, c := range cases {
+		e := prepareEmail()
+		e.Text = []byte("Text Body is, of course, supported!\n")
+		c(e)
+		if err := e.DryRun(); err == nil {
+			t.Errorf("%d: Expected a dry run error", i)
+		}
+	}
+}
+
+func TestEmailWithFooter(t *testing.T) {
+	e := prepareEmail()
+	e.Text = []byte("Hello!\n")
+	e.HTML = []byte("<html><body><p>Hello!</p></BODY></html>")
+	f := e.WithFooter([]byte("-- \nDisclaimer\n"), []byte("<p>Disclaimer</p>"))
+	if want := "Hello!\n-- \nDisclaimer\n"; string(f.Text) != want {
+		t.Errorf("Incorrect text: %#q != %#q", f.Text, want)
+	}
+	if want := "<html><body><p>Hello!</p><p>Disclaimer</p></BODY></html>"; string(f.HTML) != want {
+		t.Errorf("Incorrect HTML: %#q != %#q", f.HTML, want)
+	}
+	if string(e.Text) != "Hello!\n" || string(e.HTML) != "<html><body><p>Hello!</p></BODY></html>" {
+		t.Error("WithFooter modified the original email")
+	}
+
+	// Missing bodies aren't created.
+	e.HTML = nil
+	f = e.WithFooter([]byte("-- \nDisclaimer\n"), []byte("<p>Disclaimer</p>"))
+	if len(f.HTML) != 0 {
+		t.Errorf("Unexpected HTML: %#q", f.HTML)
+	}
+}
+
+func TestEmailFingerprint(t *testing.T) {
+	e := prepareEmail()
+	e.Text = []byte("Hello!\n")
+	if _, err := e.Attach(bytes.NewBufferString("Rad attachment"), "rad.txt", "text/plain; charset=utf-8"); err != nil {
+		t.Fatal("Could not add an attachment to the message: ", err)
+	}
+	raw, err := e.Bytes()
+	if err != nil {
+		t.Fatal("Failed to render message: ", err)
+	}
+	// A re-rendered, re-parsed copy has a different Date, Message-Id and boundary.
+	e2, err := NewEmailFromReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Error parsing email %s", err.Error())
+	}
+	e2.Bcc = e.Bcc
+	e2.Text = e.Text
+	e2.Headers.Set("Date", "Thu, 17 Oct 2019 08:55:37 +0100")
+	e2.Attachments[0].ContentType = e.Attachments[0].ContentType
+	if e.Fingerprint() != e2.Fingerprint() {
+		t.Error("Fingerprints of equivalent emails differ")
+	}
+	e2.Subject = "Different Subject"
+	if e.Fingerprint() == e2.Fingerprint() {
+		t.Error("Fingerprints of different emails are equal")
+	}
+}
+
+func TestCharsetLabel(t *testing.T) {
+	defer func(label string) { CharsetLabel = label }(CharsetLabel)
+	for _, label := range []string{"utf-8", "UTF-8"} {
+		CharsetLabel = label
+		e := prepareEmail()
+		e.From = "Jörg <test@example.com>"
+		e.Subject = "Café"
+		e.Text = []byte("Café\n")
+		e.HTML = []byte("<p>Café</p>\n")
+		a, err := e.Attach(bytes.NewBufferString("Rad attachment"), "rad.txt", "text/plain")
+		if err != nil {
+			t.Fatal("Could not add an attachment to the message: ", err)
+		}
+		a.Description = "Résumé"
+		raw, err := e.Bytes()
+		if err != nil {
+			t.Fatal("Failed to render message: ", err)
+		}
+		other := "UTF-8"
+		if label == "UTF-8" {
+			other = "utf-8"
+		}
+		for _, want := range []string{
+			"From: =?" + label + "?q?J=C3=B6rg?= <test@example.com>\r\n",
+			"Subject: =?" + label + "?q?Caf=C3=A9?=\r\n",
+			"Content-Description: =?" + label + "?q?R=C3=A9sum=C3=A9?=\r\n",
+			"Content-Type: text/plain; charset=" + label + "\r\n",
+			"Content-Type: text/html; charset=" + label + "\r\n",
+		} {
+			if !bytes.Contains(raw, []byte(want)) {
+				t.Errorf("%s: rendered message is missing %q:\n%s", label, want, raw)
+			}
+		}
+		if bytes.Contains(raw, []byte(other)) {
+			t.Errorf("%s: rendered message spells the charset as %s:\n%s", label, other, raw)
+		}
+	}
+}
+
 func TestHeaderEncoding(t *testing.T) {
 	cases := []struct {
 		field string
@@ -410,15 +995,30 @@ func TestHeaderEncoding(t *testing.T) {
 		{
 			field: "Subject",
 			have:  "Subject with a 🐟",
-			want:  "=?UTF-8?q?Subject_with_a_=F0=9F=90=9F?=\r\n",
+			want:  "=?utf-8?q?Subject_with_a_=F0=9F=90=9F?=\r\n",
 		},
 		{
 			field: "Subject",
 			have:  "Subject with only ASCII",
 			want:  "Subject with only ASCII\r\n",
 		},
-	}
-	buff := &bytes.Buffer{}
+		{
+			field: "Reply-To",
+			have:  "Keld Jørn Simonsen <keld@dkuug.dk>",
+			want:  "=?utf-8?q?Keld_J=C3=B8rn_Simonsen?= <keld@dkuug.dk>\r\n",
+		},
+		{
+			field: "X-Custom",
+			have:  "Résumé Service",
+			want:  "=?utf-8?q?R=C3=A9sum=C3=A9_Service?=\r\n",
+		},
+		{
+			field: "X-Custom",
+			have:  "ASCII only (untouched) =?",
+			want:  "ASCII only (untouched) =?\r\n",
+		},
+	}
+	buff := &bytes.Buffer{}
 	for _, c := range cases {
 		header := make(textproto.MIMEHeader)
 		header.Add(c.field, c.have)
@@ -432,6 +1032,402 @@ func TestHeaderEncoding(t *testing.T) {
 	}
 }
 
+func BenchmarkHeaderToBytes(b *testing.B) {
+	header := textproto.MIMEHeader{
+		"From":                      {"Jordan Wright <jmwright798@gmail.com>"},
+		"To":                        {"test@example.com", "Keld Jørn Simonsen <keld@dkuug.dk>"},
+		"Subject":                   {"Awesome Subject"},
+		"Date":                      {"Mon, 02 Jan 2006 15:04:05 -0700"},
+		"Message-Id":                {"<1136239445.123456789.42@localhost>"},
+		"Mime-Version":              {"1.0"},
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+		"X-Mailer":                  {"Go"},
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		headerToBytes(ioutil.Discard, header)
+	}
+}
+
+func TestEmailRawSubject(t *testing.T) {
+	e := prepareEmail()
+	e.Text = []byte("Forwarded message\n")
+	e.SetRawSubject("Fwd: =?utf-8?q?Caf=C3=A9?= ☕")
+	if want := "Fwd: Café ☕"; e.Subject != want {
+		t.Errorf("Incorrect decoded subject: %#q != %#q", e.Subject, want)
+	}
+	raw, err := e.Bytes()
+	if err != nil {
+		t.Fatal("Failed to render message: ", err)
+	}
+	if !bytes.Contains(raw, []byte("Subject: Fwd: =?utf-8?q?Caf=C3=A9?= ☕\r\n")) {
+		t.Errorf("Raw subject was not rendered verbatim: %#q", raw)
+	}
+
+	// Changing the subject falls back to the usual encoding.
+	e.Subject = "Café"
+	raw, err = e.Bytes()
+	if err != nil {
+		t.Fatal("Failed to render message: ", err)
+	}
+	if !bytes.Contains(raw, []byte("Subject: =?utf-8?q?Caf=C3=A9?=\r\n")) {
+		t.Errorf("Changed subject was not encoded: %#q", raw)
+	}
+}
+
+func TestEmailFromReaderRawSubject(t *testing.T) {
+	rawSubject := "=?ISO-8859-1?Q?Caf=E9?= =?UTF-8?B?4piV?= menu"
+	raw := "From: Jordan Wright <jmwright798@gmail.com>\r\n" +
+		"To: test@example.com\r\n" +
+		"Subject: " + rawSubject + "\r\n" +
+		"\r\n" +
+		"Hello!\r\n"
+	e, err := NewEmailFromReader(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal("Could not parse message: ", err)
+	}
+	if want := "Café☕ menu"; e.Subject != want {
+		t.Errorf("Incorrect decoded subject: %#q != %#q", e.Subject, want)
+	}
+	if e.RawSubject != rawSubject {
+		t.Errorf("Incorrect raw subject: %#q != %#q", e.RawSubject, rawSubject)
+	}
+	rendered, err := e.Bytes()
+	if err != nil {
+		t.Fatal("Failed to render message: ", err)
+	}
+	if !bytes.Contains(rendered, []byte("Subject: "+rawSubject+"\r\n")) {
+		t.Errorf("Raw subject was not rendered verbatim: %#q", rendered)
+	}
+}
+
+func TestEmailSetDate(t *testing.T) {
+	e := prepareEmail()
+	e.Text = []byte("Hello!\n")
+	e.Headers.Set("Date", "Thu, 17 Oct 2019 08:55:37 +0100")
+	date := time.Date(2001, time.February, 3, 4, 5, 6, 0, time.FixedZone("", -7*60*60))
+	e.SetDate(date)
+	raw, err := e.Bytes()
+	if err != nil {
+		t.Fatal("Failed to render message: ", err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal("Could not parse rendered message: ", err)
+	}
+	got, err := mail.ParseDate(msg.Header.Get("Date"))
+	if err != nil {
+		t.Fatal("Could not parse rendered date: ", err)
+	}
+	if !got.Equal(date) {
+		t.Errorf("Incorrect date: %v != %v", got, date)
+	}
+	e2, err := NewEmailFromReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Error parsing email %s", err.Error())
+	}
+	if got, err := e2.Date(); err != nil || !got.Equal(date) {
+		t.Errorf("Incorrect parsed date: %v != %v (%v)", got, date, err)
+	}
+}
+
+func TestEmailDraftBcc(t *testing.T) {
+	draft := "From: Jordan Wright <jmwright798@gmail.com>\r\n" +
+		"To: Test <test@example.com>\r\n" +
+		"Bcc: archive@example.com, Secret <secret@example.com>\r\n" +
+		"Cc:\r\n" +
+		"Subject: Draft\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" +
+		"Hello!\r\n"
+	e, err := NewEmailFromReader(strings.NewReader(draft))
+	if err != nil {
+		t.Fatal("Could not parse draft: ", err)
+	}
+	if expected := []string{"archive@example.com", "Secret <secret@example.com>"}; !reflect.DeepEqual(e.Bcc, expected) {
+		t.Errorf("Expected Bcc %q, got %q", expected, e.Bcc)
+	}
+	if len(e.Cc) != 0 {
+		t.Errorf("Expected no Cc from an empty header, got %q", e.Cc)
+	}
+	// A Bcc header set by hand must not be rendered either.
+	e.Headers.Set("Bcc", "other@example.com")
+
+	raw, err := e.Bytes()
+	if err != nil {
+		t.Fatal("Could not serialize e-mail:", err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal("Could not parse rendered message: ", err)
+	}
+	if _, ok := msg.Header["Bcc"]; ok || bytes.Contains(raw, []byte("secret@example.com")) {
+		t.Errorf("Bcc leaked into the rendered message:\n%s", raw)
+	}
+	to, err := addressLists(e.To, e.Cc, e.Bcc)
+	if err != nil {
+		t.Fatal("Could not parse recipients: ", err)
+	}
+	if expected := []string{"test@example.com", "archive@example.com", "secret@example.com"}; !reflect.DeepEqual(to, expected) {
+		t.Errorf("Expected envelope recipients %q, got %q", expected, to)
+	}
+}
+
+func TestEmailBareLineEndings(t *testing.T) {
+	e := prepareEmail()
+	e.Text = []byte("line one\nline two\rline three\r\n")
+	e.HTML = []byte("<p>one</p>\n<p>two</p>\r")
+	e.PreserveEncoding = true
+	e.textEncoding, e.htmlEncoding = "8bit", "7bit"
+	e.To = append(e.To, "Victim <victim@example.com\nBcc: evil@example.com>")
+	a, err := e.Attach(bytes.NewBufferString("a,b\nc,d\n"), "rad.csv", "text/csv")
+	if err != nil {
+		t.Fatal("Could not add an attachment to the message: ", err)
+	}
+	a.Header.Set("Content-Transfer-Encoding", "7bit")
+	raw, err := e.Bytes()
+	if err != nil {
+		t.Fatal("Could not serialize e-mail:", err)
+	}
+	for i, c := range raw {
+		if c == '\n' && (i == 0 || raw[i-1] != '\r') {
+			t.Fatalf("Bare LF at offset %d:\n%q", i, raw)
+		}
+		if c == '\r' && (i == len(raw)-1 || raw[i+1] != '\n') {
+			t.Fatalf("Bare CR at offset %d:\n%q", i, raw)
+		}
+	}
+	if bytes.Contains(raw, []byte("\r\nBcc:")) {
+		t.Errorf("A line break in a header started a new header field:\n%s", raw)
+	}
+	if !bytes.Contains(raw, []byte("line one\r\nline two\r\nline three\r\n")) || !bytes.Contains(raw, []byte("a,b\r\nc,d\r\n")) {
+		t.Errorf("Line endings were not converted to CRLF:\n%q", raw)
+	}
+}
+
+func TestEmailTLSOptional(t *testing.T) {
+	e := prepareEmail()
+	e.Text = []byte("Hello!\n")
+	e.TLSOptional = true
+	raw, err := e.Bytes()
+	if err != nil {
+		t.Fatal("Failed to render message: ", err)
+	}
+	if !bytes.Contains(raw, []byte("Tls-Required: No\r\n")) {
+		t.Errorf("TLS-Required header was not rendered: %#q", raw)
+	}
+	e.RequireTLS = true
+	if raw, err = e.Bytes(); err != nil {
+		t.Fatal("Failed to render message: ", err)
+	}
+	if bytes.Contains(raw, []byte("Tls-Required:")) {
+		t.Errorf("TLS-Required header was rendered with RequireTLS: %#q", raw)
+	}
+	ln := listenSMTP(t, nil)
+	defer ln.Close()
+	if err := e.Send(ln.Addr().String(), nil); err == nil || !strings.Contains(err.Error(), "REQUIRETLS") {
+		t.Errorf("Expected Send to refuse RequireTLS without TLS, got %v", err)
+	}
+}
+
+func TestEmailAddRecipients(t *testing.T) {
+	e := NewEmail()
+	if err := e.AddTo("a@example.com", "B <b@example.com>"); err != nil {
+		t.Fatal("Could not add To recipients: ", err)
+	}
+	if err := e.AddCc("c@example.com"); err != nil {
+		t.Fatal("Could not add Cc recipient: ", err)
+	}
+	if err := e.AddBcc("d@example.com", "not an address"); err == nil {
+		t.Error("Expected an error adding a malformed address")
+	}
+	if err := e.AddTo("e@example.com"); err != nil {
+		t.Fatal("Could not add To recipient: ", err)
+	}
+	if got, want := e.To, []string{"a@example.com", "B <b@example.com>", "e@example.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Incorrect To: %#q != %#q", got, want)
+	}
+	if got, want := e.Cc, []string{"c@example.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Incorrect Cc: %#q != %#q", got, want)
+	}
+	if len(e.Bcc) != 0 {
+		t.Errorf("Bcc should be empty after a failed AddBcc: %#q", e.Bcc)
+	}
+}
+
+func TestEmailPreheader(t *testing.T) {
+	e := prepareEmail()
+	e.Text = []byte("Hello!\n")
+	e.HTML = []byte("<html><body><p>Hello!</p></body></html>")
+	e.SetPreheader("Sale <today> only")
+	raw, err := e.Bytes()
+	if err != nil {
+		t.Fatal("Failed to render message: ", err)
+	}
+	e2, err := NewEmailFromReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Error parsing email %s", err.Error())
+	}
+	if !bytes.HasPrefix(e2.HTML, []byte("<html><body><span style=\"display:none !important;")) {
+		t.Errorf("Preheader span was not added to the top of the HTML body: %#q", e2.HTML)
+	}
+	if !bytes.Contains(e2.HTML, []byte(">Sale &lt;today&gt; only&#847;")) {
+		t.Errorf("Preheader was not escaped in the HTML body: %#q", e2.HTML)
+	}
+	if got, want := string(e2.Text), "Sale <today> only\r\n\r\nHello!\r\n"; got != want {
+		t.Errorf("Incorrect plaintext body: %#q != %#q", got, want)
+	}
+	if got, want := string(e.HTML), "<html><body><p>Hello!</p></body></html>"; got != want {
+		t.Errorf("SetPreheader modified the HTML body: %#q != %#q", got, want)
+	}
+}
+
+func TestEmailOrganizationComments(t *testing.T) {
+	e := prepareEmail()
+	e.Text = []byte("Hello!\n")
+	e.SetOrganization("Société Générale")
+	e.SetComments("Plain ASCII comment")
+	raw, err := e.Bytes()
+	if err != nil {
+		t.Fatal("Failed to render message: ", err)
+	}
+	if !bytes.Contains(raw, []byte("Organization: =?utf-8?q?Soci=C3=A9t=C3=A9_G=C3=A9n=C3=A9rale?=\r\n")) {
+		t.Errorf("Organization was not encoded: %#q", raw)
+	}
+	if !bytes.Contains(raw, []byte("Comments: Plain ASCII comment\r\n")) {
+		t.Errorf("Comments was not rendered: %#q", raw)
+	}
+	e2, err := NewEmailFromReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Error parsing email %s", err.Error())
+	}
+	if got, want := e2.Organization(), "Société Générale"; got != want {
+		t.Errorf("Incorrect Organization: %#q != %#q", got, want)
+	}
+	if got, want := e2.Comments(), "Plain ASCII comment"; got != want {
+		t.Errorf("Incorrect Comments: %#q != %#q", got, want)
+	}
+}
+
+func TestEmailTextLF(t *testing.T) {
+	raw := "From: test@example.com\r\n" +
+		"Subject: Line endings\r\n" +
+		"Content-Type: multipart/alternative; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"Hello,\r\nWorld!=0D=0AAnd a bare =0Dreturn.\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"PHA+SGVsbG8sPC9wPg0KPHA+V29ybGQhPC9wPg0K\r\n" +
+		"--b--\r\n"
+	e, err := NewEmailFromReader(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal("Could not parse message: ", err)
+	}
+	if want := "Hello,\r\nWorld!\r\nAnd a bare \rreturn."; string(e.Text) != want {
+		t.Errorf("Raw text was not kept: %#q != %#q", e.Text, want)
+	}
+	if want := "Hello,\nWorld!\nAnd a bare \nreturn."; string(e.TextLF()) != want {
+		t.Errorf("Incorrect normalized text: %#q != %#q", e.TextLF(), want)
+	}
+	if want := "<p>Hello,</p>\r\n<p>World!</p>\r\n"; string(e.HTML) != want {
+		t.Errorf("Raw HTML was not kept: %#q != %#q", e.HTML, want)
+	}
+	if want := "<p>Hello,</p>\n<p>World!</p>\n"; string(e.HTMLLF()) != want {
+		t.Errorf("Incorrect normalized HTML: %#q != %#q", e.HTMLLF(), want)
+	}
+}
+
+func TestEmailPriority(t *testing.T) {
+	for _, test := range []struct {
+		headers  string
+		expected Priority
+	}{
+		{"", PriorityNormal},
+		{"X-Priority: 1 (Highest)\r\n", PriorityHigh},
+		{"X-Priority: 2\r\n", PriorityHigh},
+		{"X-Priority: 3 (Normal)\r\n", PriorityNormal},
+		{"X-Priority: 5 (Lowest)\r\n", PriorityLow},
+		{"Importance: High\r\n", PriorityHigh},
+		{"Importance: low\r\n", PriorityLow},
+		{"Priority: urgent\r\n", PriorityHigh},
+		{"Priority: non-urgent\r\n", PriorityLow},
+		{"X-Priority: 1\r\nImportance: high\r\nPriority: urgent\r\n", PriorityHigh},
+		{"X-Priority: 1\r\nImportance: low\r\n", PriorityNormal},
+		{"X-Priority: 5\r\nImportance: bogus\r\n", PriorityLow},
+		{"X-Priority: bogus\r\n", PriorityNormal},
+	} {
+		raw := "From: test@example.com\r\n" + test.headers + "Subject: Priority\r\n\r\nHello!\r\n"
+		e, err := NewEmailFromReader(strings.NewReader(raw))
+		if err != nil {
+			t.Fatal("Could not parse message: ", err)
+		}
+		if p := e.Priority(); p != test.expected {
+			t.Errorf("%q: expected priority %d, got %d", test.headers, test.expected, p)
+		}
+	}
+
+	for _, p := range []Priority{PriorityHigh, PriorityLow, PriorityNormal} {
+		e := prepareEmail()
+		e.Text = []byte("Hello!\n")
+		e.SetPriority(PriorityHigh)
+		e.SetPriority(p)
+		raw, err := e.Bytes()
+		if err != nil {
+			t.Fatal("Failed to render message: ", err)
+		}
+		parsed, err := NewEmailFromReader(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal("Could not parse rendered message: ", err)
+		}
+		if got := parsed.Priority(); got != p {
+			t.Errorf("Expected priority %d to round trip, got %d", p, got)
+		}
+		if p == PriorityNormal && bytes.Contains(raw, []byte("Priority:")) {
+			t.Errorf("Normal priority left priority headers:\n%s", raw)
+		}
+	}
+}
+
+func TestEmailKeywords(t *testing.T) {
+	e := prepareEmail()
+	e.Text = []byte("Hello!\n")
+	keywords := []string{"café", "naïve résumé", "archive", "quarterly report", "Ünïcödé keyword that is rather long", "plain"}
+	e.SetKeywords(keywords...)
+	raw, err := e.Bytes()
+	if err != nil {
+		t.Fatal("Failed to render message: ", err)
+	}
+	if !bytes.Contains(raw, []byte("Keywords: =?utf-8?q?caf=C3=A9?=,")) {
+		t.Errorf("Keywords were not encoded: %#q", raw)
+	}
+	i := bytes.Index(raw, []byte("Keywords:"))
+	end := i + bytes.Index(raw[i:], []byte("\r\n"))
+	for bytes.HasPrefix(raw[end+2:], []byte(" ")) {
+		if end-i > 78 {
+			t.Errorf("Keywords line is longer than 78 characters: %q", raw[i:end])
+		}
+		i = end + 2
+		end = i + bytes.Index(raw[i:], []byte("\r\n"))
+	}
+	if end-i > 78 {
+		t.Errorf("Keywords line is longer than 78 characters: %q", raw[i:end])
+	}
+	e2, err := NewEmailFromReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Error parsing email %s", err.Error())
+	}
+	if got := e2.Keywords(); !reflect.DeepEqual(got, keywords) {
+		t.Errorf("Incorrect Keywords: %#q != %#q", got, keywords)
+	}
+}
+
 func TestEmailFromReader(t *testing.T) {
 	ex := &Email{
 		Subject: "Test Subject",
@@ -519,38 +1515,423 @@ d-printable decoding.</div>
 	}
 }
 
+func TestEmailFromReaderRepeatedRecipientHeaders(t *testing.T) {
+	raw := "From: Jordan Wright <jmwright798@gmail.com>\r\n" +
+		"To: one@example.com, \"Wright, Jordan\" <jordan@example.com>\r\n" +
+		"Cc: three@example.com\r\n" +
+		"To: =?UTF-8?Q?Ana=C3=AFs?= <anais@example.com>\r\n" +
+		"Cc: four@example.com\r\n" +
+		"Subject: Split recipients\r\n" +
+		"\r\n" +
+		"Hello!\r\n"
+	e, err := NewEmailFromReader(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal("Could not parse message: ", err)
+	}
+	if got, want := e.To, []string{"one@example.com", `"Wright, Jordan" <jordan@example.com>`, "Anaïs <anais@example.com>"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Incorrect To: %#q != %#q", got, want)
+	}
+	if got, want := e.Cc, []string{"three@example.com", "four@example.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Incorrect Cc: %#q != %#q", got, want)
+	}
+	if _, err := addressLists(e.To, e.Cc); err != nil {
+		t.Errorf("Parsed recipients are not valid addresses: %s", err)
+	}
+}
+
+func TestEmailFromReaderReturnPath(t *testing.T) {
+	for _, test := range []struct {
+		header, expected, sender string
+	}{
+		{"Return-Path: <bounce@x.com>\r\n", "bounce@x.com", "bounce@x.com"},
+		{"Return-Path: <>\r\n", "<>", ""},
+		{"", "", "jmwright798@gmail.com"},
+	} {
+		raw := test.header +
+			"From: Jordan Wright <jmwright798@gmail.com>\r\n" +
+			"To: test@example.com\r\n" +
+			"Subject: Bounce\r\n" +
+			"\r\n" +
+			"Hello!\r\n"
+		e, err := NewEmailFromReader(strings.NewReader(raw))
+		if err != nil {
+			t.Fatal("Could not parse message: ", err)
+		}
+		if e.ReturnPath != test.expected {
+			t.Errorf("Expected ReturnPath %q, got %q", test.expected, e.ReturnPath)
+		}
+		if _, ok := e.Headers["Return-Path"]; ok {
+			t.Errorf("Return-Path was left in the headers: %v", e.Headers)
+		}
+		b, err := e.Bytes()
+		if err != nil {
+			t.Fatal("Could not render message: ", err)
+		}
+		if bytes.Contains(b, []byte("Return-Path:")) {
+			t.Errorf("Rendered message has a Return-Path header:\n%s", b)
+		}
+		if sender, err := e.parseSender(); err != nil || sender != test.sender {
+			t.Errorf("Expected envelope sender %q, got %q (%v)", test.sender, sender, err)
+		}
+	}
+}
+
+func TestEmailGzipRoundTrip(t *testing.T) {
+	e := prepareEmail()
+	e.Text = []byte(strings.Repeat("Text Body is, of course, supported!\r\n", 100))
+	e.HTML = []byte("<h1>Fancy Html is supported, too!</h1>\r\n")
+	if _, err := e.Attach(bytes.NewBufferString("Rad attachment"), "rad.txt", "text/plain; charset=utf-8"); err != nil {
+		t.Fatal("Could not add an attachment to the message: ", err)
+	}
+	raw, err := e.Bytes()
+	if err != nil {
+		t.Fatal("Could not serialize e-mail:", err)
+	}
+	compressed, err := e.BytesGzip()
+	if err != nil {
+		t.Fatal("Could not compress e-mail:", err)
+	}
+	if len(compressed) >= len(raw) {
+		t.Errorf("Compressed message is %d bytes, not smaller than %d", len(compressed), len(raw))
+	}
+	parsed, err := NewEmailFromGzipReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal("Could not parse compressed e-mail:", err)
+	}
+	if parsed.Subject != e.Subject || !bytes.Equal(parsed.Text, e.Text) || !bytes.Equal(parsed.HTML, e.HTML) {
+		t.Errorf("Incorrect round trip: %q %q %q", parsed.Subject, parsed.Text, parsed.HTML)
+	}
+	if len(parsed.Attachments) != 1 || string(parsed.Attachments[0].Content) != "Rad attachment" {
+		t.Errorf("Incorrect attachments: %v", parsed.Attachments)
+	}
+	if _, err := NewEmailFromGzipReader(bytes.NewReader(raw)); err == nil {
+		t.Error("Expected an error for uncompressed input")
+	}
+}
+
+// endlessReader yields a message whose body never ends, counting the bytes
+// which were read from it.
+type endlessReader struct {
+	header []byte
+	read   int64
+}
+
+func (r *endlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		if r.read < int64(len(r.header)) {
+			p[i] = r.header[r.read]
+		} else {
+			p[i] = 'a'
+		}
+		r.read++
+	}
+	return len(p), nil
+}
+
+func TestEmailFromReaderLimit(t *testing.T) {
+	raw := "From: Jordan Wright <jmwright798@gmail.com>\r\n" +
+		"To: test@example.com\r\n" +
+		"Subject: Limits\r\n" +
+		"\r\n" +
+		"Hello!\r\n"
+	e, err := NewEmailFromReaderLimit(strings.NewReader(raw), int64(len(raw)))
+	if err != nil {
+		t.Fatal("Could not parse a message within the limit: ", err)
+	}
+	if string(e.Text) != "Hello!\r\n" {
+		t.Errorf("Unexpected text %q", e.Text)
+	}
+	if _, err := NewEmailFromReaderLimit(strings.NewReader(raw), int64(len(raw)-1)); err != ErrMessageTooLarge {
+		t.Errorf("Expected ErrMessageTooLarge, got %v", err)
+	}
+
+	const limit = 1 << 20
+	r := &endlessReader{header: []byte("Subject: Endless\r\n\r\n")}
+	if _, err := NewEmailFromReaderLimit(r, limit); err != ErrMessageTooLarge {
+		t.Errorf("Expected ErrMessageTooLarge for an endless message, got %v", err)
+	}
+	if r.read > limit+1 {
+		t.Errorf("Read %d bytes from an endless message, more than the limit of %d", r.read, limit)
+	}
+}
+
+func TestRawHeadersEmailFromReader(t *testing.T) {
+	headers := "From: Jordan Wright <jmwright798@gmail.com>\r\n" +
+		"To: jmwright798@gmail.com\r\n" +
+		"subject: Folded\r\n" +
+		"  subject line\r\n" +
+		"DKIM-Signature: v=1; a=rsa-sha256;\r\n" +
+		"\tb=abc\r\n"
+	raw := []byte(headers + "\r\nThis is a test message!")
+	e, err := NewEmailFromReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Error creating email %s", err.Error())
+	}
+	if string(e.RawHeaders) != headers {
+		t.Fatalf("Incorrect raw headers: %#q != %#q", e.RawHeaders, headers)
+	}
+	if e.Subject != "Folded subject line" {
+		t.Fatalf("Incorrect subject: %#q", e.Subject)
+	}
+	if !bytes.Equal(e.Text, []byte("This is a test message!")) {
+		t.Fatalf("Incorrect text: %#q", e.Text)
+	}
+}
+
+func TestStripTraceHeaders(t *testing.T) {
+	raw := []byte("Received: from mx1.internal.example.com by mx2.internal.example.com\r\n" +
+		"Received: from [10.0.0.1] by mx1.internal.example.com\r\n" +
+		"X-Originating-IP: [10.0.0.1]\r\n" +
+		"Authentication-Results: mx2.internal.example.com; spf=pass\r\n" +
+		"Delivered-To: recipient@example.com\r\n" +
+		"X-Custom: keep me\r\n" +
+		"From: sender@example.com\r\n" +
+		"To: recipient@example.com\r\n" +
+		"Subject: Hello\r\n" +
+		"\r\n" +
+		"Hello!\r\n")
+	e, err := NewEmailFromReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Error creating email %s", err.Error())
+	}
+	e.StripTraceHeaders()
+	out, err := e.Bytes()
+	if err != nil {
+		t.Fatal("Failed to render message: ", err)
+	}
+	for _, h := range []string{"Received:", "X-Originating-Ip:", "Authentication-Results:", "Delivered-To:", "10.0.0.1"} {
+		if bytes.Contains(out, []byte(h)) {
+			t.Errorf("Rendered message still contains %q: %#q", h, out)
+		}
+	}
+	if !bytes.Contains(out, []byte("X-Custom: keep me\r\n")) {
+		t.Errorf("Rendered message is missing X-Custom: %#q", out)
+	}
+	e.StripHeaders("x-custom")
+	if _, ok := e.Headers["X-Custom"]; ok {
+		t.Error("StripHeaders didn't remove X-Custom")
+	}
+}
+
+func TestInvalidCharsetEmailFromReader(t *testing.T) {
+	for _, charset := range []string{"utf-8", "shift_jis", "x-unknown"} {
+		raw := "From: <a@example.com>\r\n" +
+			"Subject: Test\r\n" +
+			"Content-Type: text/plain; charset=" + charset + "\r\n" +
+			"\r\n" +
+			"Caf\xe9 \x82\xa0\xff\r\n"
+		e, err := NewEmailFromReader(strings.NewReader(raw))
+		if err != nil {
+			t.Fatalf("Error parsing email %s", err.Error())
+		}
+		if !utf8.Valid(e.Text) {
+			t.Errorf("Text with charset %s is not valid UTF-8: %q", charset, e.Text)
+		}
+		if !bytes.HasPrefix(e.Text, []byte("Caf\uFFFD ")) {
+			t.Errorf("Invalid bytes with charset %s were not replaced: %q", charset, e.Text)
+		}
+	}
+}
+
 func TestNonAsciiEmailFromReader(t *testing.T) {
 	ex := &Email{
 		Subject: "Test Subject",
 		To:      []string{"Anaïs <anais@example.org>"},
 		Cc:      []string{"Patrik Fältström <paf@example.com>"},
-		From:    "Mrs ValÃ©rie Dupont <valerie.dupont@example.com>",
+		From:    "Mrs Valérie Dupont <valerie.dupont@example.com>",
 		Text:    []byte("This is a test message!"),
 	}
-	raw := []byte(`
-	MIME-Version: 1.0
-Subject: =?UTF-8?Q?Test Subject?=
-From: Mrs =?ISO-8859-1?Q?Val=C3=A9rie=20Dupont?= <valerie.dupont@example.com>
-To: =?utf-8?q?Ana=C3=AFs?= <anais@example.org>
-Cc: =?ISO-8859-1?Q?Patrik_F=E4ltstr=F6m?= <paf@example.com>
-Content-type: text/plain; charset=ISO-8859-1
+	raw := []byte(`
+	MIME-Version: 1.0
+Subject: =?UTF-8?Q?Test Subject?=
+From: Mrs =?ISO-8859-1?Q?Val=C3=A9rie=20Dupont?= <valerie.dupont@example.com>
+To: =?utf-8?q?Ana=C3=AFs?= <anais@example.org>
+Cc: =?ISO-8859-1?Q?Patrik_F=E4ltstr=F6m?= <paf@example.com>
+Content-type: text/plain; charset=ISO-8859-1
+
+This is a test message!`)
+	e, err := NewEmailFromReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Error creating email %s", err.Error())
+	}
+	if e.Subject != ex.Subject {
+		t.Fatalf("Incorrect subject. %#q != %#q", e.Subject, ex.Subject)
+	}
+	if e.From != ex.From {
+		t.Fatalf("Incorrect \"From\": %#q != %#q", e.From, ex.From)
+	}
+	if e.To[0] != ex.To[0] {
+		t.Fatalf("Incorrect \"To\": %#q != %#q", e.To, ex.To)
+	}
+	if e.Cc[0] != ex.Cc[0] {
+		t.Fatalf("Incorrect \"Cc\": %#q != %#q", e.Cc, ex.Cc)
+	}
+}
+
+func TestEmailFromReaderAddressDecoding(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"=?utf-8?q?Ana=C3=AFs?= <anais@example.org>", "Anaïs <anais@example.org>"},
+		{"=?ISO-8859-1?Q?Patrik_F=E4ltstr=F6m?= <paf@example.com>", "Patrik Fältström <paf@example.com>"},
+		// UTF-8 bytes mislabeled as Latin-1.
+		{"Mrs =?ISO-8859-1?Q?Val=C3=A9rie=20Dupont?= <valerie.dupont@example.com>", "Mrs Valérie Dupont <valerie.dupont@example.com>"},
+		// Malformed and unknown encoded-words are kept as they are.
+		{"=?x-unknown?q?Bob?= <bob@example.com>", "=?x-unknown?q?Bob?= <bob@example.com>"},
+		{"=?utf-8?b?!!!?= <bob@example.com>", "=?utf-8?b?!!!?= <bob@example.com>"},
+	}
+	for _, tt := range tests {
+		raw := "From: " + tt.header + "\r\n" +
+			"To: " + tt.header + "\r\n" +
+			"Cc: " + tt.header + "\r\n" +
+			"Reply-To: " + tt.header + "\r\n" +
+			"\r\n" +
+			"Hello\r\n"
+		e, err := NewEmailFromReader(strings.NewReader(raw))
+		if err != nil {
+			t.Fatalf("Error parsing %#q: %s", tt.header, err)
+		}
+		if e.From != tt.want {
+			t.Errorf("Incorrect \"From\" for %#q: %#q != %#q", tt.header, e.From, tt.want)
+		}
+		for name, got := range map[string][]string{"To": e.To, "Cc": e.Cc, "Reply-To": e.ReplyTo} {
+			if len(got) != 1 || got[0] != tt.want {
+				t.Errorf("Incorrect %q for %#q: %#q != %#q", name, tt.header, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestCharsetEmailFromReader(t *testing.T) {
+	raw := []byte("From: sender@example.com\r\n" +
+		"To: recipient@example.com\r\n" +
+		"Subject: =?windows-1252?q?=93Caf=E9=94?=\r\n" +
+		"Content-Type: multipart/alternative; boundary=abc123\r\n" +
+		"\r\n" +
+		"--abc123\r\n" +
+		"Content-Type: text/plain; charset=ISO-8859-1\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"Caf=E9\r\n" +
+		"--abc123\r\n" +
+		"Content-Type: text/html; charset=windows-1252\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"<p>Caf=E9 =80</p>\r\n" +
+		"--abc123--\r\n")
+	e, err := NewEmailFromReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Error creating email %s", err.Error())
+	}
+	if want := "“Café”"; e.Subject != want {
+		t.Errorf("Incorrect subject: %#q != %#q", e.Subject, want)
+	}
+	if want := "Café"; string(e.Text) != want {
+		t.Errorf("Incorrect text: %#q != %#q", e.Text, want)
+	}
+	if want := "<p>Café €</p>"; string(e.HTML) != want {
+		t.Errorf("Incorrect HTML: %#q != %#q", e.HTML, want)
+	}
+}
+
+func TestUndeclaredCharsetEmailFromReader(t *testing.T) {
+	raw := []byte("From: sender@example.com\r\n" +
+		"To: recipient@example.com\r\n" +
+		"Subject: Test\r\n" +
+		"Content-Type: multipart/alternative; boundary=abc123\r\n" +
+		"\r\n" +
+		"--abc123\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"Content-Transfer-Encoding: 8bit\r\n" +
+		"\r\n" +
+		"Caf\xc3\xa9 \xe2\x82\xac\r\n" +
+		"--abc123\r\n" +
+		"Content-Type: text/html; charset=us-ascii\r\n" +
+		"Content-Transfer-Encoding: 8bit\r\n" +
+		"\r\n" +
+		"<p>Caf\xe9 \x80</p>\r\n" +
+		"--abc123--\r\n")
+	e, err := NewEmailFromReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Error creating email %s", err.Error())
+	}
+	if want := "Café €"; string(e.Text) != want {
+		t.Errorf("Incorrect text: %#q != %#q", e.Text, want)
+	}
+	if want := "<p>Café €</p>"; string(e.HTML) != want {
+		t.Errorf("Incorrect HTML: %#q != %#q", e.HTML, want)
+	}
+}
 
-This is a test message!`)
+func TestPreserveEncodingEmailFromReader(t *testing.T) {
+	raw := []byte("From: sender@example.com\r\n" +
+		"To: recipient@example.com\r\n" +
+		"Subject: Test\r\n" +
+		"Content-Type: multipart/alternative; boundary=abc123\r\n" +
+		"\r\n" +
+		"--abc123\r\n" +
+		"Content-Type: text/plain; charset=us-ascii\r\n" +
+		"Content-Transfer-Encoding: 7bit\r\n" +
+		"\r\n" +
+		"Hello\r\n" +
+		"--abc123\r\n" +
+		"Content-Type: text/html; charset=UTF-8\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"PHA+SGVsbG88L3A+\r\n" +
+		"--abc123--\r\n")
 	e, err := NewEmailFromReader(bytes.NewReader(raw))
 	if err != nil {
 		t.Fatalf("Error creating email %s", err.Error())
 	}
-	if e.Subject != ex.Subject {
-		t.Fatalf("Incorrect subject. %#q != %#q", e.Subject, ex.Subject)
+	e.PreserveEncoding = true
+	out, err := e.Bytes()
+	if err != nil {
+		t.Fatal("Failed to render message: ", err)
 	}
-	if e.From != ex.From {
-		t.Fatalf("Incorrect \"From\": %#q != %#q", e.From, ex.From)
+	if !bytes.Contains(out, []byte("Content-Transfer-Encoding: base64\r\nContent-Type: text/html; charset=utf-8\r\n\r\nPHA+SGVsbG88L3A+\r\n")) {
+		t.Errorf("HTML body was not written as base64: %#q", out)
 	}
-	if e.To[0] != ex.To[0] {
-		t.Fatalf("Incorrect \"To\": %#q != %#q", e.To, ex.To)
+	if !bytes.Contains(out, []byte("Content-Transfer-Encoding: 7bit\r\nContent-Type: text/plain; charset=utf-8\r\n\r\nHello\r\n")) {
+		t.Errorf("Text body was not written as 7bit: %#q", out)
 	}
-	if e.Cc[0] != ex.Cc[0] {
-		t.Fatalf("Incorrect \"Cc\": %#q != %#q", e.Cc, ex.Cc)
+	e.PreserveEncoding = false
+	if out, err = e.Bytes(); err != nil {
+		t.Fatal("Failed to render message: ", err)
+	}
+	if bytes.Contains(out, []byte("Content-Transfer-Encoding: base64")) {
+		t.Errorf("HTML body was written as base64 without PreserveEncoding: %#q", out)
+	}
+}
+
+func TestEncodedWordWhitespaceEmailFromReader(t *testing.T) {
+	cases := []struct {
+		subject string
+		want    string
+	}{
+		{"=?utf-8?q?Caf=C3=A9_?= =?utf-8?q?au_lait?=", "Café au lait"},
+		{"=?utf-8?q?Caf?=\r\n =?utf-8?q?=C3=A9?=", "Café"},
+		{"=?utf-8?b?Q2Fm?=\t=?utf-8?b?w6k=?=", "Café"},
+		{"Re: =?utf-8?q?Caf=C3=A9?= au lait", "Re: Café au lait"},
+		{"=?utf-8?q?Caf=C3=A9?= =?iso-8859-1?q?cr=E8me?=", "Cafécrème"},
+	}
+	for _, c := range cases {
+		raw := []byte("From: =?utf-8?q?Fran=C3=A7ois?= =?utf-8?q?_Dupont?= <francois@example.com>\r\n" +
+			"To: recipient@example.com\r\n" +
+			"Subject: " + c.subject + "\r\n" +
+			"\r\n" +
+			"Hello!\r\n")
+		e, err := NewEmailFromReader(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatalf("Error creating email %s", err.Error())
+		}
+		if e.Subject != c.want {
+			t.Errorf("Incorrect subject: %#q != %#q", e.Subject, c.want)
+		}
+		if want := "François Dupont <francois@example.com>"; e.From != want {
+			t.Errorf("Incorrect \"From\": %#q != %#q", e.From, want)
+		}
 	}
 }
 
@@ -728,6 +2109,363 @@ TGV0J3MganVzdCBwcmV0ZW5kIHRoaXMgaXMgcmF3IEpQRUcgZGF0YS4=
 	}
 }
 
+func TestAttachWriter(t *testing.T) {
+	e := NewEmail()
+	w, a, err := e.AttachWriter("report.csv", "text/csv")
+	if err != nil {
+		t.Fatal("Could not create attachment writer: ", err)
+	}
+	for _, row := range []string{"a,b\n", "1,2\n", "3,4\n"} {
+		if _, err := io.WriteString(w, row); err != nil {
+			t.Fatal("Could not write to attachment: ", err)
+		}
+	}
+	if len(e.Attachments) != 0 {
+		t.Errorf("Attachment was added before Close")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal("Could not close attachment writer: ", err)
+	}
+	if len(e.Attachments) != 1 || e.Attachments[0] != a {
+		t.Fatalf("Attachment was not added on Close")
+	}
+	if got, want := string(a.Content), "a,b\n1,2\n3,4\n"; got != want {
+		t.Errorf("Incorrect attachment content: %#q != %#q", got, want)
+	}
+	if _, err := w.Write([]byte("5,6\n")); err == nil {
+		t.Error("Expected an error writing to a closed attachment writer")
+	}
+}
+
+func TestAttachmentLimits(t *testing.T) {
+	e := NewEmail()
+	e.SetAttachmentLimits(2, 10)
+	if _, err := e.Attach(strings.NewReader("12345"), "a.txt", "text/plain"); err != nil {
+		t.Fatal("Could not add an attachment to the message: ", err)
+	}
+	if _, err := e.Attach(strings.NewReader("123456"), "b.txt", "text/plain"); err == nil {
+		t.Error("Expected an error exceeding the attachment size limit")
+	}
+	if _, err := e.Attach(strings.NewReader("12345"), "b.txt", "text/plain"); err != nil {
+		t.Fatal("Could not add an attachment to the message: ", err)
+	}
+	if _, err := e.Attach(strings.NewReader(""), "c.txt", "text/plain"); err == nil {
+		t.Error("Expected an error exceeding the attachment count limit")
+	}
+	if len(e.Attachments) != 2 {
+		t.Errorf("Incorrect number of attachments: %d != 2", len(e.Attachments))
+	}
+}
+
+func TestAttachmentReader(t *testing.T) {
+	e := NewEmail()
+	content := bytes.Repeat([]byte("Rad attachment\x00\xff"), 1000)
+	a, err := e.Attach(bytes.NewReader(content), "rad.bin", "application/octet-stream")
+	if err != nil {
+		t.Fatal("Could not add an attachment to the message: ", err)
+	}
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, a.Reader()); err != nil {
+		t.Fatal("Could not copy attachment: ", err)
+	}
+	if !bytes.Equal(buf.Bytes(), a.Content) {
+		t.Errorf("Attachment reader did not return the content")
+	}
+}
+
+func TestEmbeddedEmailFromReader(t *testing.T) {
+	inner := prepareEmail()
+	inner.Subject = "Original subject"
+	inner.Text = []byte("Original body\n")
+	innerRaw, err := inner.Bytes()
+	if err != nil {
+		t.Fatal("Failed to render message: ", err)
+	}
+	e := prepareEmail()
+	e.Subject = "Fwd: Original subject"
+	e.Text = []byte("See below\n")
+	if _, err := e.Attach(bytes.NewReader(innerRaw), "original.eml", "message/rfc822"); err != nil {
+		t.Fatal("Could not add an attachment to the message: ", err)
+	}
+	raw, err := e.Bytes()
+	if err != nil {
+		t.Fatal("Failed to render message: ", err)
+	}
+	e2, err := NewEmailFromReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Error parsing email %s", err.Error())
+	}
+	if len(e2.Embedded) != 1 {
+		t.Fatalf("Incorrect number of embedded messages: %d != 1", len(e2.Embedded))
+	}
+	if got, want := e2.Embedded[0].Subject, inner.Subject; got != want {
+		t.Errorf("Incorrect embedded subject: %#q != %#q", got, want)
+	}
+	if got, want := string(e2.Embedded[0].Text), "Original body\r\n"; got != want {
+		t.Errorf("Incorrect embedded text: %#q != %#q", got, want)
+	}
+	if len(e2.Attachments) != 1 || !bytes.Equal(e2.Attachments[0].Content, innerRaw) {
+		t.Errorf("Embedded message was not kept as an attachment")
+	}
+}
+
+func TestAttachMessage(t *testing.T) {
+	for _, tt := range []struct{ cte, text string }{
+		{"7bit", "Numbers attached.\r\n"},
+		{"8bit", "Données jointes.\r\n"},
+	} {
+		// A body kept in its original 8bit encoding makes the rendered
+		// message non-ASCII.
+		inner, err := NewEmailFromReader(strings.NewReader("From: <a@example.com>\r\n" +
+			"Subject: Numbers\r\n" +
+			"Content-Type: text/plain; charset=utf-8\r\n" +
+			"Content-Transfer-Encoding: " + tt.cte + "\r\n" +
+			"\r\n" + tt.text))
+		if err != nil {
+			t.Fatalf("Error parsing email %s", err.Error())
+		}
+		inner.PreserveEncoding = true
+		e := prepareEmail()
+		e.Text = []byte("FYI\n")
+		a, err := e.AttachMessage(inner)
+		if err != nil {
+			t.Fatal("Could not attach message: ", err)
+		}
+		if got := a.Header.Get("Content-Transfer-Encoding"); got != tt.cte {
+			t.Errorf("Incorrect Content-Transfer-Encoding: %q != %q", got, tt.cte)
+		}
+		raw, err := e.Bytes()
+		if err != nil {
+			t.Fatal("Failed to render message: ", err)
+		}
+		if !bytes.Contains(raw, []byte(tt.text)) {
+			t.Errorf("Attached message was encoded:\n%s", raw)
+		}
+		e2, err := NewEmailFromReader(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatalf("Error parsing email %s", err.Error())
+		}
+		if len(e2.Embedded) != 1 || string(e2.Embedded[0].Text) != tt.text {
+			t.Errorf("Attached message was not embedded")
+		}
+	}
+}
+
+func TestMalformedEmbeddedEmailFromReader(t *testing.T) {
+	// The embedded message is multipart, but has no boundary.
+	inner := "From: <a@example.com>\r\nContent-Type: multipart/mixed\r\n\r\nBody\r\n"
+	for _, disposition := range []string{"", "Content-Disposition: attachment; filename=\"original.eml\"\r\n"} {
+		raw := []byte("From: <b@example.com>\r\n" +
+			"Subject: Fwd: Broken\r\n" +
+			"MIME-Version: 1.0\r\n" +
+			"Content-Type: multipart/mixed; boundary=\"b1\"\r\n" +
+			"\r\n" +
+			"--b1\r\n" +
+			"Content-Type: text/plain\r\n" +
+			"\r\n" +
+			"See below\r\n" +
+			"--b1\r\n" +
+			"Content-Type: message/rfc822\r\n" +
+			disposition +
+			"\r\n" +
+			inner +
+			"--b1--\r\n")
+		e, err := NewEmailFromReader(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatalf("Error parsing email %s", err.Error())
+		}
+		if string(e.Text) != "See below" {
+			t.Errorf("Incorrect text: %#q", e.Text)
+		}
+		if len(e.Embedded) != 0 {
+			t.Errorf("Malformed message was embedded")
+		}
+		if len(e.Attachments) != 1 || string(e.Attachments[0].Content) != strings.TrimSuffix(inner, "\r\n") {
+			t.Errorf("Malformed message was not kept as an attachment")
+		}
+	}
+}
+
+func TestMultipleHTMLPartsEmailFromReader(t *testing.T) {
+	raw := []byte(`From: no-reply@example.com
+To: tester@example.org
+Subject: Newsletter
+MIME-Version: 1.0
+Content-Type: multipart/mixed; boundary=abc123
+
+--abc123
+Content-Type: text/html; charset=UTF-8
+
+<p>The actual newsletter</p>
+--abc123
+Content-Type: text/html; charset=UTF-8
+
+
+--abc123--
+`)
+	e, err := NewEmailFromReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Error when parsing email %s", err.Error())
+	}
+	if !bytes.Equal(e.HTML, []byte("<p>The actual newsletter</p>")) {
+		t.Fatalf("Incorrect HTML: %#q != %#q", e.HTML, "<p>The actual newsletter</p>")
+	}
+}
+
+func TestRegisterContentType(t *testing.T) {
+	contentTypesMu.Lock()
+	saved := make(map[string]string, len(contentTypes))
+	for ext, ct := range contentTypes {
+		saved[ext] = ct
+	}
+	contentTypesMu.Unlock()
+	defer func() {
+		contentTypesMu.Lock()
+		contentTypes = saved
+		contentTypesMu.Unlock()
+	}()
+
+	RegisterContentType("x-test", "application/x-test")
+	f, err := ioutil.TempFile("", "attachment-*.X-TEST")
+	if err != nil {
+		t.Fatal("Could not create temporary file: ", err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+	e := prepareEmail()
+	a, err := e.AttachFile(f.Name())
+	if err != nil {
+		t.Fatal("Could not attach file: ", err)
+	}
+	if a.ContentType != "application/x-test" {
+		t.Errorf("Incorrect content type: %#q", a.ContentType)
+	}
+	if ct := contentTypeByExtension(".webp"); ct != "image/webp" {
+		t.Errorf("Incorrect built in content type: %#q", ct)
+	}
+	// A registered type overrides the built in one.
+	RegisterContentType(".WEBP", "image/x-webp")
+	if ct := contentTypeByExtension(".webp"); ct != "image/x-webp" {
+		t.Errorf("Incorrect registered content type: %#q", ct)
+	}
+}
+
+func TestAttachFileAs(t *testing.T) {
+	f, err := ioutil.TempFile("", "tmp_*")
+	if err != nil {
+		t.Fatal("Could not create temporary file: ", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("%PDF-1.4")
+	f.Close()
+
+	e := prepareEmail()
+	a, err := e.AttachFileAs(f.Name(), "Invoice-2024.pdf")
+	if err != nil {
+		t.Fatal("Could not attach file: ", err)
+	}
+	if a.Filename != "Invoice-2024.pdf" {
+		t.Errorf("Incorrect filename: %#q", a.Filename)
+	}
+	if a.ContentType != "application/pdf" {
+		t.Errorf("Incorrect content type: %#q", a.ContentType)
+	}
+	raw, err := e.Bytes()
+	if err != nil {
+		t.Fatal("Failed to render message: ", err)
+	}
+	if !bytes.Contains(raw, []byte(`Content-Disposition: attachment;`)) || !bytes.Contains(raw, []byte(`filename="Invoice-2024.pdf"`)) {
+		t.Errorf("Missing display name in Content-Disposition: %#q", raw)
+	}
+	if bytes.Contains(raw, []byte(filepath.Base(f.Name()))) {
+		t.Errorf("Name of the file on disk leaked into the message: %#q", raw)
+	}
+}
+
+func TestAttachFileModificationDate(t *testing.T) {
+	f, err := ioutil.TempFile("", "attachment-*.txt")
+	if err != nil {
+		t.Fatal("Could not create temporary file: ", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("Rad attachment")
+	f.Close()
+	mtime := time.Date(2001, time.February, 3, 4, 5, 6, 0, time.UTC)
+	if err := os.Chtimes(f.Name(), mtime, mtime); err != nil {
+		t.Fatal("Could not set modification time: ", err)
+	}
+
+	e := prepareEmail()
+	a, err := e.AttachFile(f.Name())
+	if err != nil {
+		t.Fatal("Could not attach file: ", err)
+	}
+	a.CreationDate = mtime.Add(-time.Hour)
+	raw, err := e.Bytes()
+	if err != nil {
+		t.Fatal("Failed to render message: ", err)
+	}
+	if !bytes.Contains(raw, []byte("modification-date=\"Sat, 03 Feb 2001 04:05:06 +0000\"")) {
+		t.Errorf("Missing modification-date parameter: %#q", raw)
+	}
+	e2, err := NewEmailFromReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Error parsing email %s", err.Error())
+	}
+	if len(e2.Attachments) != 1 {
+		t.Fatalf("Incorrect number of attachments %d != %d", len(e2.Attachments), 1)
+	}
+	if got := e2.Attachments[0].ModificationDate; !got.Equal(mtime) {
+		t.Errorf("Incorrect modification date: %v != %v", got, mtime)
+	}
+	if got := e2.Attachments[0].CreationDate; !got.Equal(a.CreationDate) {
+		t.Errorf("Incorrect creation date: %v != %v", got, a.CreationDate)
+	}
+}
+
+func TestEmailSaveAttachments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "attachments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	e := NewEmail()
+	names := []string{"report.pdf", "../../etc/passwd", `..\..\evil.exe`, ".hidden", "report.pdf", ""}
+	for _, name := range names {
+		if _, err := e.Attach(bytes.NewBufferString("content of "+name), name, "application/octet-stream"); err != nil {
+			t.Fatal("Could not add an attachment to the message: ", err)
+		}
+	}
+	paths, err := e.SaveAttachments(dir)
+	if err != nil {
+		t.Fatal("Could not save attachments: ", err)
+	}
+	if len(paths) != len(names) {
+		t.Fatalf("Expected %d saved attachments, got %d", len(names), len(paths))
+	}
+	seen := map[string]bool{}
+	for i, path := range paths {
+		if filepath.Dir(path) != filepath.Clean(dir) {
+			t.Errorf("Attachment %q was saved outside %s: %s", names[i], dir, path)
+		}
+		if strings.HasPrefix(filepath.Base(path), ".") {
+			t.Errorf("Attachment %q was saved as a hidden file: %s", names[i], path)
+		}
+		if seen[path] {
+			t.Errorf("Attachment %q overwrote %s", names[i], path)
+		}
+		seen[path] = true
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != "content of "+names[i] {
+			t.Errorf("Attachment %q was saved with content %q", names[i], content)
+		}
+	}
+}
+
 func ExampleGmail() {
 	e := NewEmail()
 	e.From = "Jordan Wright <test@gmail.com>"
@@ -760,6 +2498,72 @@ func Test_base64Wrap(t *testing.T) {
 	}
 }
 
+func TestWriteBase64(t *testing.T) {
+	for _, size := range []int{0, 1, 56, 57, 58, 1000} {
+		b := bytes.Repeat([]byte{0xfe, 'a', '\n'}, size)[:size]
+		var want, got bytes.Buffer
+		base64Wrap(&want, b)
+		WriteBase64(&got, b)
+		if !bytes.Equal(got.Bytes(), want.Bytes()) {
+			t.Errorf("WriteBase64 does not match base64Wrap for size %d: %#q != %#q", size, got.Bytes(), want.Bytes())
+		}
+	}
+}
+
+func TestWriteQuotedPrintable(t *testing.T) {
+	b := []byte(strings.Repeat("Caf\xc3\xa9 = caf\xc3\xa9, ", 10) + "\r\nEnd.")
+	var want, got bytes.Buffer
+	if err := quotePrintEncode(&want, b); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteQuotedPrintable(&got, b); err != nil {
+		t.Fatal("WriteQuotedPrintable returned an error: ", err)
+	}
+	if !bytes.Equal(got.Bytes(), want.Bytes()) {
+		t.Errorf("WriteQuotedPrintable does not match quotePrintEncode: %#q != %#q", got.Bytes(), want.Bytes())
+	}
+	for _, line := range strings.Split(got.String(), "\r\n") {
+		if len(line) > MaxLineLength {
+			t.Errorf("Line is longer than %d characters: %#q", MaxLineLength, line)
+		}
+	}
+	decoded, err := ioutil.ReadAll(quotedprintable.NewReader(&got))
+	if err != nil || !bytes.Equal(decoded, b) {
+		t.Errorf("Incorrect round trip: %#q (%v)", decoded, err)
+	}
+}
+
+func Test_base64WrapReader(t *testing.T) {
+	for _, size := range []int{0, 1, 56, 57, 58, 114, 1000, 57*64 - 1, 57 * 64, 57*64 + 1, 128 * 1024} {
+		file := make([]byte, size)
+		if _, err := rand.Read(file); err != nil {
+			t.Fatal(err)
+		}
+		var want, got bytes.Buffer
+		base64Wrap(&want, file)
+		if err := base64WrapReader(&got, bytes.NewReader(file)); err != nil {
+			t.Fatalf("base64WrapReader returned an error for size %d: %s", size, err)
+		}
+		if !bytes.Equal(got.Bytes(), want.Bytes()) {
+			t.Fatalf("Streamed encoding does not match base64Wrap for size %d", size)
+		}
+	}
+
+	// Attachments are encoded with it, and a failed write isn't lost.
+	at := &Attachment{Content: make([]byte, 1000), Header: textproto.MIMEHeader{}}
+	at.Header.Set("Content-Transfer-Encoding", "base64")
+	var want, got bytes.Buffer
+	base64Wrap(&want, at.Content)
+	if err := at.writeContent(&got); err != nil || !bytes.Equal(got.Bytes(), want.Bytes()) {
+		t.Errorf("Incorrect attachment encoding: %v\n%s", err, got.Bytes())
+	}
+	pr, pw := io.Pipe()
+	pr.Close()
+	if err := at.writeContent(pw); err != io.ErrClosedPipe {
+		t.Errorf("Expected io.ErrClosedPipe, got %v", err)
+	}
+}
+
 // *Since the mime library in use by ```email``` is now in the stdlib, this test is deprecated
 func Test_quotedPrintEncode(t *testing.T) {
 	var buf bytes.Buffer
@@ -788,6 +2592,43 @@ func Test_quotedPrintEncode(t *testing.T) {
 	}
 }
 
+func Test_quotedPrintableWordWrap(t *testing.T) {
+	text := []byte("Dear reader!\n\n" +
+		"This is a test email to try and capture some of the corner cases that exist within\n" +
+		"the quoted-printable encoding.\n" +
+		"There are some wacky parts like =, and this input assumes UNIX line breaks so\r\n" +
+		"it can come out a little weird.  Also, we need to support unicode so here's a fish: 🐟\n" +
+		strings.Repeat("x", 100) + " trailing space \n")
+	expected := []byte("Dear reader!\r\n\r\n" +
+		"This is a test email to try and capture some of the corner cases that =\r\n" +
+		"exist within\r\n" +
+		"the quoted-printable encoding.\r\n" +
+		"There are some wacky parts like =3D, and this input assumes UNIX line =\r\n" +
+		"breaks so\r\n" +
+		"it can come out a little weird.  Also, we need to support unicode so =\r\n" +
+		"here's a fish: =F0=9F=90=9F\r\n" +
+		strings.Repeat("x", 75) + "=\r\n" + strings.Repeat("x", 25) + " trailing space=20\r\n")
+	var buf bytes.Buffer
+	if err := quotedPrintableWordWrap(&buf, text); err != nil {
+		t.Fatal("quotedPrintableWordWrap: ", err)
+	}
+	if b := buf.Bytes(); !bytes.Equal(b, expected) {
+		t.Errorf("quotedPrintableWordWrap generated incorrect results: %#q != %#q", b, expected)
+	}
+	for _, line := range strings.Split(buf.String(), "\r\n") {
+		if len(line) > MaxLineLength {
+			t.Errorf("Line is longer than %d characters: %#q", MaxLineLength, line)
+		}
+	}
+	decoded, err := ioutil.ReadAll(quotedprintable.NewReader(&buf))
+	if err != nil {
+		t.Fatal("Error decoding: ", err)
+	}
+	if want := strings.Replace(strings.Replace(string(text), "\r\n", "\n", -1), "\n", "\r\n", -1); string(decoded) != want {
+		t.Errorf("Decoded text doesn't match: %#q != %#q", decoded, want)
+	}
+}
+
 func TestMultipartNoContentType(t *testing.T) {
 	raw := []byte(`From: Mikhail Gusarov <dottedmag@dottedmag.net>
 To: notmuch@notmuchmail.org
@@ -837,6 +2678,56 @@ Testing!
 	}
 }
 
+func TestMultipartPaddedBoundary(t *testing.T) {
+	tests := []struct {
+		param    string
+		boundary string
+	}{
+		{`"abc123 "`, "abc123"},
+		{"\"abc123\t\"", "abc123"},
+		{`"\"abc123\""`, "abc123"},
+		{`" abc123"`, " abc123"},
+		{`"abc 123"`, "abc 123"},
+	}
+	for _, test := range tests {
+		testMultipartPaddedBoundary(t, test.param, test.boundary)
+	}
+}
+
+func testMultipartPaddedBoundary(t *testing.T, param, boundary string) {
+	raw := []byte("From: sender@example.com\r\n" +
+		"To: recipient@example.com\r\n" +
+		"Subject: Padded boundary\r\n" +
+		"Content-Type: multipart/alternative; boundary=" + param + "\r\n" +
+		"\r\n" +
+		"--" + boundary + "\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Hello\r\n" +
+		"--" + boundary + "\r\n" +
+		"Content-Type: text/html\r\n" +
+		"\r\n" +
+		"<p>Hello</p>\r\n" +
+		"--" + boundary + "--\r\n")
+	e, err := NewEmailFromReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Error creating email with boundary %s: %s", param, err.Error())
+	}
+	if string(e.Text) != "Hello" {
+		t.Errorf("Incorrect text: %#q != %#q", e.Text, "Hello")
+	}
+	if string(e.HTML) != "<p>Hello</p>" {
+		t.Errorf("Incorrect HTML: %#q != %#q", e.HTML, "<p>Hello</p>")
+	}
+	if s := e.Summary(); !s.HasText || !s.HasHTML || len(s.ContentTypes) != 2 {
+		t.Errorf("Incorrect summary: %+v", s)
+	}
+	p, err := e.PartByPath("2")
+	if err != nil || p == nil || string(p.Body) != "<p>Hello</p>" {
+		t.Errorf("Incorrect part 2: %v, %v", p, err)
+	}
+}
+
 func TestNoMultipartHTMLContentTypeBase64Encoding(t *testing.T) {
 	raw := []byte(`MIME-Version: 1.0
 From: no-reply@example.com
@@ -896,6 +2787,67 @@ func Benchmark_base64Wrap(b *testing.B) {
 	}
 }
 
+func TestEmailSmallASCIIText(t *testing.T) {
+	e := NewEmail()
+	e.From = "sender@example.com"
+	e.To = []string{"recipient@example.com"}
+	e.Subject = "Your code"
+	e.Text = []byte("Your code is 123456.\nIt expires in 10 minutes.\n")
+	raw, err := e.Bytes()
+	if err != nil {
+		t.Fatal("Could not serialize e-mail:", err)
+	}
+	for _, h := range []string{"Content-Type: text/plain; charset=us-ascii\r\n", "Content-Transfer-Encoding: 7bit\r\n"} {
+		if !bytes.Contains(raw, []byte(h)) {
+			t.Errorf("Missing header %#q in %#q", h, raw)
+		}
+	}
+	if !bytes.HasSuffix(raw, []byte("\r\n\r\nYour code is 123456.\r\nIt expires in 10 minutes.\r\n")) {
+		t.Errorf("Body not written as is: %#q", raw)
+	}
+	parsed, err := NewEmailFromReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal("Could not parse e-mail:", err)
+	}
+	if want := "Your code is 123456.\r\nIt expires in 10 minutes.\r\n"; string(parsed.Text) != want {
+		t.Errorf("Incorrect text: %#q != %#q", parsed.Text, want)
+	}
+
+	// Anything which needs encoding still goes through the usual path.
+	e.Text = []byte("Your code is 123456 – it expires soon.")
+	if raw, err = e.Bytes(); err != nil {
+		t.Fatal("Could not serialize e-mail:", err)
+	}
+	if !bytes.Contains(raw, []byte("Content-Transfer-Encoding: quoted-printable\r\n")) {
+		t.Errorf("Non-ASCII text not quoted-printable: %#q", raw)
+	}
+}
+
+func BenchmarkBytesSmallText(b *testing.B) {
+	e := NewEmail()
+	e.From = "sender@example.com"
+	e.To = []string{"recipient@example.com"}
+	e.Subject = "Your receipt"
+	e.Text = bytes.Repeat([]byte("1 x Widget, size medium, colour blue ........ $10.00\n"), 60)
+	b.Run("7bit", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := e.Bytes(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("quoted-printable", func(b *testing.B) {
+		// The same message, written the way it was before the 7bit path.
+		qp := *e
+		qp.PreserveEncoding, qp.textEncoding = true, "quoted-printable"
+		for i := 0; i < b.N; i++ {
+			if _, err := qp.Bytes(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
 func TestParseSender(t *testing.T) {
 	var cases = []struct {
 		e      Email
@@ -922,6 +2874,21 @@ func TestParseSender(t *testing.T) {
 			"good@sender.com",
 			false,
 		},
+		{
+			Email{ReturnPath: "bounce@test.com", Sender: "sender@test.com", From: "from@test.com"},
+			"bounce@test.com",
+			false,
+		},
+		{
+			Email{ReturnPath: "<>", From: "from@test.com"},
+			"",
+			false,
+		},
+		{
+			Email{ReturnPath: "bad_address_return_path", Sender: "sender@test.com"},
+			"",
+			true,
+		},
 	}
 
 	for i, testcase := range cases {
@@ -0,0 +1,59 @@
+package email
+
+import (
+	"io"
+	"mime/multipart"
+	"net/textproto"
+)
+
+// partEmitter receives the MIME structure of a message as it is rendered:
+// multipart entities are opened and closed around the parts they contain, and
+// each leaf part is given its header and then its encoded body. The header
+// passed for the outermost entity is the message header; nested entities are
+// given a nil header to open a multipart entity with.
+type partEmitter interface {
+	// openMultipart starts a multipart entity of the given subtype, e.g.
+	// "mixed", which may include parameters other than the boundary.
+	openMultipart(subtype string, header textproto.MIMEHeader) error
+	// leaf starts a single part and returns the writer for its body.
+	leaf(header textproto.MIMEHeader) (io.Writer, error)
+	// closeMultipart ends the innermost open multipart entity.
+	closeMultipart() error
+}
+
+// byteEmitter is the partEmitter which writes the message as bytes.
+type byteEmitter struct {
+	w           io.Writer
+	writeHeader func(io.Writer, textproto.MIMEHeader)
+	open        []*multipart.Writer
+}
+
+func (b *byteEmitter) openMultipart(subtype string, header textproto.MIMEHeader) error {
+	mw := multipart.NewWriter(b.w)
+	ct := "multipart/" + subtype + ";\r\n boundary=" + mw.Boundary()
+	if len(b.open) == 0 {
+		header.Set("Content-Type", ct)
+		if _, err := b.leaf(header); err != nil {
+			return err
+		}
+	} else if _, err := b.leaf(textproto.MIMEHeader{"Content-Type": {ct}}); err != nil {
+		return err
+	}
+	b.open = append(b.open, mw)
+	return nil
+}
+
+func (b *byteEmitter) leaf(header textproto.MIMEHeader) (io.Writer, error) {
+	if len(b.open) > 0 {
+		return b.open[len(b.open)-1].CreatePart(header)
+	}
+	b.writeHeader(b.w, header)
+	_, err := io.WriteString(b.w, "\r\n")
+	return b.w, err
+}
+
+func (b *byteEmitter) closeMultipart() error {
+	mw := b.open[len(b.open)-1]
+	b.open = b.open[:len(b.open)-1]
+	return mw.Close()
+}
@@ -0,0 +1,94 @@
+package email
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// recordingEmitter is a partEmitter which records the structure of a message.
+type recordingEmitter struct {
+	events []string
+}
+
+func (r *recordingEmitter) openMultipart(subtype string, header textproto.MIMEHeader) error {
+	event := "open " + subtype
+	if header != nil {
+		event += " (message)"
+	}
+	r.events = append(r.events, event)
+	return nil
+}
+
+func (r *recordingEmitter) leaf(header textproto.MIMEHeader) (io.Writer, error) {
+	ct := strings.SplitN(header.Get("Content-Type"), ";", 2)[0]
+	if header.Get("From") != "" {
+		ct += " (message)"
+	}
+	r.events = append(r.events, ct)
+	return ioutil.Discard, nil
+}
+
+func (r *recordingEmitter) closeMultipart() error {
+	r.events = append(r.events, "close")
+	return nil
+}
+
+func TestEmitParts(t *testing.T) {
+	tests := []struct {
+		text, html  bool
+		related     bool
+		attachments bool
+		expected    []string
+	}{
+		{text: true, expected: []string{"text/plain (message)"}},
+		{html: true, expected: []string{"text/html (message)"}},
+		{text: true, html: true, expected: []string{"open alternative (message)", "text/plain", "text/html", "close"}},
+		{html: true, related: true, expected: []string{"open related (message)", "text/html", "image/png", "close"}},
+		{text: true, attachments: true, expected: []string{"open mixed (message)", "text/plain", "application/pdf", "close"}},
+		{text: true, html: true, related: true, attachments: true, expected: []string{
+			"open mixed (message)",
+			"open alternative",
+			"text/plain",
+			"open related",
+			"text/html",
+			"image/png",
+			"close",
+			"close",
+			"application/pdf",
+			"close",
+		}},
+		{expected: []string{"text/plain (message)"}},
+	}
+	for i, test := range tests {
+		e := prepareEmail()
+		if test.text {
+			e.Text = []byte("Hello!")
+		}
+		if test.html {
+			e.HTML = []byte("<b>Hello!</b>")
+		}
+		if test.related {
+			a, _ := e.Attach(bytes.NewBufferString("image"), "rad.png", "image/png")
+			a.HTMLRelated = true
+		}
+		if test.attachments {
+			e.Attach(bytes.NewBufferString("document"), "rad.pdf", "application/pdf")
+		}
+		headers, err := e.msgHeaders()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := &recordingEmitter{}
+		if err := e.emitParts(r, headers); err != nil {
+			t.Fatalf("%d: could not emit parts: %s", i, err)
+		}
+		if !reflect.DeepEqual(r.events, test.expected) {
+			t.Errorf("%d: expected structure %q, got %q", i, test.expected, r.events)
+		}
+	}
+}
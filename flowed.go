@@ -0,0 +1,141 @@
+package email
+
+import (
+	"bytes"
+	"strings"
+	"unicode/utf8"
+)
+
+// flowedLineLen is the length at which format=flowed text is wrapped, as
+// recommended by RFC 3676, section 4.2.
+const flowedLineLen = 72
+
+// toFlowed encodes text as format=flowed (RFC 3676). Long lines are wrapped
+// at spaces into soft line breaks, which end with a space, and lines starting
+// with a space or "From " are space-stuffed. Lines starting with ">" are taken
+// to be quoted, and their quote depth is kept.
+//
+// If delSp is true, the text is encoded for DelSp=yes: a space is added at each
+// soft line break, to be deleted when it is decoded, so that lines without
+// spaces, such as CJK text, can be wrapped between any two characters.
+func toFlowed(text []byte, delSp bool) []byte {
+	var b bytes.Buffer
+	s := strings.Replace(string(text), "\r\n", "\n", -1)
+	lines := strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+	for _, line := range lines {
+		q := quoteDepth(line)
+		prefix := line[:q]
+		content := line[q:]
+		if q > 0 {
+			content = strings.TrimPrefix(content, " ")
+		}
+		// Trailing spaces would mark a soft line break, except in the
+		// signature separator.
+		if content != "-- " {
+			content = strings.TrimRight(content, " ")
+		}
+		// Deeply quoted lines are allowed to be longer, rather than squeezed.
+		width := flowedLineLen - len(prefix) - 1
+		if width < flowedLineLen/2 {
+			width = flowedLineLen / 2
+		}
+		for {
+			seg, rest := splitFlowed(content, width, delSp)
+			b.WriteString(prefix)
+			if q > 0 || strings.HasPrefix(seg, " ") || strings.HasPrefix(seg, "From ") {
+				b.WriteString(" ")
+			}
+			b.WriteString(seg + "\r\n")
+			if rest == "" {
+				break
+			}
+			content = rest
+		}
+	}
+	return b.Bytes()
+}
+
+// splitFlowed splits s after the last space which leaves the first part at
+// most n bytes long, or if there is none, after the first space. Words are
+// never broken, so the first part is longer than n if s starts with a long
+// word.
+//
+// If delSp is true, s is split after the last space or, failing that, the
+// last whole character that fits, and a space is added to the first part.
+func splitFlowed(s string, n int, delSp bool) (string, string) {
+	if len(s) <= n || s == "-- " {
+		return s, ""
+	}
+	if delSp {
+		i := strings.LastIndex(s[:n-1], " ") + 1
+		if i <= 1 {
+			for i = n - 1; i > 1 && !utf8.RuneStart(s[i]); i-- {
+			}
+		}
+		return s[:i] + " ", s[i:]
+	}
+	i := strings.LastIndex(s[:n], " ")
+	if i <= 0 {
+		j := strings.Index(s[n:], " ")
+		if j < 0 {
+			return s, ""
+		}
+		i = n + j
+	}
+	return s[:i+1], s[i+1:]
+}
+
+// fromFlowed decodes format=flowed text (RFC 3676), joining soft line breaks
+// back into paragraphs and removing space-stuffing. If delSp is true, the
+// space before each soft line break is removed as well. Quoted paragraphs
+// are written with a space after their quote marks.
+func fromFlowed(text []byte, delSp bool) []byte {
+	eol := "\n"
+	if bytes.Contains(text, []byte("\r\n")) {
+		eol = "\r\n"
+	}
+	var b bytes.Buffer
+	var para string
+	paraDepth := -1
+	flush := func() {
+		if paraDepth < 0 {
+			return
+		}
+		b.WriteString(strings.Repeat(">", paraDepth))
+		if paraDepth > 0 && para != "" {
+			b.WriteString(" ")
+		}
+		b.WriteString(para + eol)
+		para, paraDepth = "", -1
+	}
+	s := strings.Replace(string(text), "\r\n", "\n", -1)
+	for _, line := range strings.Split(strings.TrimSuffix(s, "\n"), "\n") {
+		q := quoteDepth(line)
+		content := strings.TrimPrefix(line[q:], " ")
+		soft := strings.HasSuffix(content, " ") && content != "-- "
+		if soft && delSp {
+			content = content[:len(content)-1]
+		}
+		// A change in quote depth ends the paragraph, even after a soft
+		// line break.
+		if paraDepth >= 0 && q != paraDepth {
+			flush()
+		}
+		para += content
+		paraDepth = q
+		if !soft {
+			flush()
+		}
+	}
+	flush()
+	return b.Bytes()
+}
+
+// quoteDepth returns the number of quote marks at the start of line.
+func quoteDepth(line string) int {
+	q := 0
+	for q < len(line) && line[q] == '>' {
+		q++
+	}
+	return q
+}
@@ -0,0 +1,99 @@
+package email
+
+import (
+	"bytes"
+	"mime"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestToFlowed(t *testing.T) {
+	long := strings.Repeat("word ", 30) + "end"
+	flowed := string(toFlowed([]byte(long+"\n From here\nFrom me\n> quoted \n-- \nsig\n"), false))
+	lines := strings.Split(strings.TrimSuffix(flowed, "\r\n"), "\r\n")
+	for _, line := range lines {
+		if len(line) > flowedLineLen {
+			t.Errorf("Line is longer than %d: %q", flowedLineLen, line)
+		}
+	}
+	expected := []string{"  From here", " From me", "> quoted", "-- ", "sig"}
+	if tail := lines[len(lines)-len(expected):]; strings.Join(tail, "|") != strings.Join(expected, "|") {
+		t.Errorf("Expected lines %q, got %q", expected, tail)
+	}
+	for _, line := range lines[:len(lines)-len(expected)-1] {
+		if !strings.HasSuffix(line, " ") {
+			t.Errorf("Wrapped line %q does not end with a soft line break", line)
+		}
+	}
+	if got := string(fromFlowed([]byte(flowed), false)); got != long+"\r\n From here\r\nFrom me\r\n> quoted\r\n-- \r\nsig\r\n" {
+		t.Errorf("Unexpected unflowed text %q", got)
+	}
+}
+
+func TestFromFlowedDelSp(t *testing.T) {
+	got := string(fromFlowed([]byte("Hello \nworld\n>> deep \n> shallow\n"), true))
+	if expected := "Helloworld\n>> deep\n> shallow\n"; got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+}
+
+func TestEmailFlowedText(t *testing.T) {
+	e := prepareEmail()
+	e.Text = []byte(strings.Repeat("The quick brown fox jumps over the lazy dog. ", 5) + "\n\nFrom the desk of Jordan\n")
+	e.FlowedText = true
+	raw, err := e.Bytes()
+	if err != nil {
+		t.Fatal("Could not serialize e-mail:", err)
+	}
+	parsed, err := NewEmailFromReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal("Could not parse rendered message: ", err)
+	}
+	mt, params, err := mime.ParseMediaType(parsed.Headers.Get("Content-Type"))
+	if err != nil || mt != "text/plain" || params["format"] != "flowed" {
+		t.Errorf("Unexpected Content-Type %q", parsed.Headers.Get("Content-Type"))
+	}
+	if !parsed.FlowedText {
+		t.Error("Parsed message is not marked as flowed")
+	}
+	expected := strings.TrimRight(strings.Repeat("The quick brown fox jumps over the lazy dog. ", 5), " ") + "\r\n\r\nFrom the desk of Jordan\r\n"
+	if string(parsed.Text) != expected {
+		t.Errorf("Expected text %q, got %q", expected, parsed.Text)
+	}
+}
+
+func TestEmailFlowedDelSp(t *testing.T) {
+	e := prepareEmail()
+	e.Text = []byte(strings.Repeat("日本語のテキストは単語の間に空白がありません。", 6) + "\r\n")
+	e.FlowedText = true
+	e.FlowedDelSp = true
+	raw, err := e.Bytes()
+	if err != nil {
+		t.Fatal("Could not serialize e-mail:", err)
+	}
+	parsed, err := NewEmailFromReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal("Could not parse rendered message: ", err)
+	}
+	_, params, _ := mime.ParseMediaType(parsed.Headers.Get("Content-Type"))
+	if params["format"] != "flowed" || params["delsp"] != "yes" {
+		t.Errorf("Unexpected Content-Type %q", parsed.Headers.Get("Content-Type"))
+	}
+	if !parsed.FlowedDelSp {
+		t.Error("Parsed message is not marked as delsp=yes")
+	}
+	if !bytes.Equal(parsed.Text, e.Text) {
+		t.Errorf("Expected text %q, got %q", e.Text, parsed.Text)
+	}
+
+	flowed := toFlowed(e.Text, true)
+	if bytes.Count(flowed, []byte("\r\n")) < 2 {
+		t.Errorf("CJK text was not wrapped: %q", flowed)
+	}
+	for _, line := range bytes.Split(flowed, []byte("\r\n")) {
+		if !utf8.Valid(line) {
+			t.Errorf("Line %q was wrapped within a character", line)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package email
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// keyCache remembers the idempotency keys of recent successful sends, up to
+// a maximum number of keys and for a limited time, evicting the least
+// recently used keys first.
+type keyCache struct {
+	mu      sync.Mutex
+	size    int
+	window  time.Duration
+	order   *list.List // of *keyEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+// keyEntry is a send with an idempotency key, which is in progress until
+// done is closed.
+type keyEntry struct {
+	key  string
+	sent time.Time // when the send succeeded, or zero while in progress
+	done chan struct{}
+	err  error
+}
+
+func newKeyCache(size int, window time.Duration) *keyCache {
+	return &keyCache{
+		size:    size,
+		window:  window,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// do calls send unless a send with the same key succeeded within the window,
+// in which case it returns nil without sending. If a send with the same key
+// is in progress, do waits for it and returns its result. Failed sends are
+// forgotten, so that they can be retried.
+func (c *keyCache) do(key string, send func() error) error {
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		ent := el.Value.(*keyEntry)
+		if ent.sent.IsZero() || time.Since(ent.sent) < c.window {
+			c.order.MoveToFront(el)
+			c.mu.Unlock()
+			<-ent.done
+			return ent.err
+		}
+		c.remove(el)
+	}
+	ent := &keyEntry{key: key, done: make(chan struct{})}
+	el := c.order.PushFront(ent)
+	c.entries[key] = el
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+	c.mu.Unlock()
+
+	err := send()
+
+	c.mu.Lock()
+	ent.err = err
+	if err == nil {
+		ent.sent = time.Now()
+	} else if c.entries[key] == el {
+		c.remove(el)
+	}
+	c.mu.Unlock()
+	close(ent.done)
+	return err
+}
+
+// remove forgets the key of el. c.mu must be held.
+func (c *keyCache) remove(el *list.Element) {
+	ent := c.order.Remove(el).(*keyEntry)
+	if c.entries[ent.key] == el {
+		delete(c.entries, ent.key)
+	}
+}
@@ -0,0 +1,93 @@
+package email
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestKeyCache(t *testing.T) {
+	c := newKeyCache(2, time.Hour)
+	var sends int32
+	send := func() error {
+		atomic.AddInt32(&sends, 1)
+		return nil
+	}
+	for i := 0; i < 3; i++ {
+		if err := c.do("a", send); err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+	}
+	if sends != 1 {
+		t.Errorf("Expected 1 send for a repeated key, got %d", sends)
+	}
+
+	// A failed send is forgotten, so that it can be retried.
+	sendErr := errors.New("connection reset")
+	if err := c.do("b", func() error { return sendErr }); err != sendErr {
+		t.Errorf("Expected the send error, got %v", err)
+	}
+	if err := c.do("b", send); err != nil || sends != 2 {
+		t.Errorf("Failed send was not retried: %v, %d sends", err, sends)
+	}
+
+	// "a" was used less recently than "b", so it is evicted by "c".
+	c.do("c", send)
+	c.do("a", send)
+	if sends != 4 {
+		t.Errorf("Expected the least recently used key to be evicted, got %d sends", sends)
+	}
+	c.do("c", send)
+	if sends != 4 {
+		t.Errorf("Expected a recently used key to be kept, got %d sends", sends)
+	}
+}
+
+func TestKeyCacheWindow(t *testing.T) {
+	c := newKeyCache(10, 10*time.Millisecond)
+	sends := 0
+	send := func() error {
+		sends++
+		return nil
+	}
+	c.do("a", send)
+	c.do("a", send)
+	time.Sleep(20 * time.Millisecond)
+	c.do("a", send)
+	if sends != 2 {
+		t.Errorf("Expected the key to expire after the window, got %d sends", sends)
+	}
+}
+
+func TestKeyCacheConcurrent(t *testing.T) {
+	c := newKeyCache(10, time.Hour)
+	var sends int32
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- c.do("a", func() error {
+				atomic.AddInt32(&sends, 1)
+				<-release
+				return nil
+			})
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error("Unexpected error: ", err)
+		}
+	}
+	if sends != 1 {
+		t.Errorf("Expected 1 send for concurrent sends with the same key, got %d", sends)
+	}
+}
@@ -0,0 +1,48 @@
+package email
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// emailFields has the fields of Email, but not its methods, so that it can be
+// marshaled without recursing into Email.MarshalJSON.
+type emailFields Email
+
+// emailJSON is the JSON representation of an Email. Bodies and attachment
+// content are encoded as base64, as usual for []byte.
+type emailJSON struct {
+	*emailFields
+	Date      *time.Time `json:",omitempty"`
+	Preheader string     `json:",omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler. Along with the exported fields, it
+// includes the values set with SetDate and SetPreheader, so
+// that an Email can be stored as a draft and restored with UnmarshalJSON.
+// The report parts of a parsed multipart/report are not included.
+func (e *Email) MarshalJSON() ([]byte, error) {
+	v := emailJSON{
+		emailFields: (*emailFields)(e),
+		Preheader:   e.preheader,
+	}
+	if !e.date.IsZero() {
+		v.Date = &e.date
+	}
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON implements json.Unmarshaler for the representation produced
+// by MarshalJSON.
+func (e *Email) UnmarshalJSON(data []byte) error {
+	v := emailJSON{emailFields: (*emailFields)(e)}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	e.preheader = v.Preheader
+	e.date = time.Time{}
+	if v.Date != nil {
+		e.date = *v.Date
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package email
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEmailJSON(t *testing.T) {
+	e := prepareEmail()
+	e.Text = []byte("Hello!\n")
+	e.HTML = []byte("<p>Hello!</p>")
+	e.Headers.Add("X-Tag", "one")
+	e.Headers.Add("X-Tag", "two")
+	e.SetDate(time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC))
+	e.SetPreheader("Preview")
+	if _, err := e.Attach(bytes.NewReader([]byte("\x00\x01binary\xff")), "a.bin", "application/octet-stream"); err != nil {
+		t.Fatal("Could not add an attachment to the message: ", err)
+	}
+	e.Attachments[0].Header.Set("Content-Id", "<a.bin>")
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal("Failed to marshal email: ", err)
+	}
+	e2 := &Email{}
+	if err := json.Unmarshal(data, e2); err != nil {
+		t.Fatal("Failed to unmarshal email: ", err)
+	}
+	if !reflect.DeepEqual(e, e2) {
+		t.Errorf("Email did not round trip:\n%#v\n%#v", e, e2)
+	}
+	if got := e2.Headers["X-Tag"]; len(got) != 2 {
+		t.Errorf("Multiple header values were not preserved: %#q", got)
+	}
+}
@@ -0,0 +1,102 @@
+package email
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// PoolStats are the send latencies of a Pool, as returned by Pool.Stats. The
+// latency of a send is the time from acquiring a connection until the server
+// accepted the message; failed sends aren't included.
+type PoolStats struct {
+	Sends      int64         // The number of successful sends
+	AvgLatency time.Duration // Moving average, weighted towards recent sends
+	P50        time.Duration // Median latency, rounded up to a histogram bucket
+	P90        time.Duration // 90th percentile latency, rounded up to a histogram bucket
+	P99        time.Duration // 99th percentile latency, rounded up to a histogram bucket
+	Max        time.Duration // The longest latency seen
+}
+
+// latencyBuckets is the number of histogram buckets, whose upper bounds
+// double from 1ms; the last bucket holds everything longer.
+const latencyBuckets = 20
+
+// latencyWeight is the weight of each new latency in the moving average, as
+// a power of two: 1/2^3.
+const latencyWeight = 3
+
+// latencyStats records send latencies with atomic operations only, so that
+// sends don't contend over a lock to be measured.
+type latencyStats struct {
+	count   int64
+	avg     int64 // nanoseconds
+	max     int64 // nanoseconds
+	buckets [latencyBuckets]int64
+
+	slowThreshold time.Duration
+	onSlow        func(d time.Duration)
+}
+
+// bucketBound returns the upper bound of histogram bucket i.
+func bucketBound(i int) time.Duration {
+	return time.Millisecond << uint(i)
+}
+
+func (s *latencyStats) observe(d time.Duration) {
+	i := 0
+	for i < latencyBuckets-1 && d > bucketBound(i) {
+		i++
+	}
+	atomic.AddInt64(&s.buckets[i], 1)
+	if atomic.AddInt64(&s.count, 1) == 1 {
+		atomic.StoreInt64(&s.avg, int64(d))
+	} else {
+		for {
+			old := atomic.LoadInt64(&s.avg)
+			if atomic.CompareAndSwapInt64(&s.avg, old, old+(int64(d)-old)>>latencyWeight) {
+				break
+			}
+		}
+	}
+	for {
+		old := atomic.LoadInt64(&s.max)
+		if int64(d) <= old || atomic.CompareAndSwapInt64(&s.max, old, int64(d)) {
+			break
+		}
+	}
+	if s.onSlow != nil && d > s.slowThreshold {
+		s.onSlow(d)
+	}
+}
+
+func (s *latencyStats) stats() PoolStats {
+	var counts [latencyBuckets]int64
+	var total int64
+	for i := range counts {
+		counts[i] = atomic.LoadInt64(&s.buckets[i])
+		total += counts[i]
+	}
+	st := PoolStats{
+		Sends:      total,
+		AvgLatency: time.Duration(atomic.LoadInt64(&s.avg)),
+		Max:        time.Duration(atomic.LoadInt64(&s.max)),
+	}
+	percentile := func(q int64) time.Duration {
+		// The smallest bucket holding at least q percent of the sends.
+		var seen int64
+		for i, n := range counts {
+			seen += n
+			if seen*100 >= q*total {
+				if i == latencyBuckets-1 || bucketBound(i) > st.Max {
+					return st.Max
+				}
+				return bucketBound(i)
+			}
+		}
+		return st.Max
+	}
+	if total > 0 {
+		st.P50, st.P90, st.P99 = percentile(50), percentile(90), percentile(99)
+	}
+	return st
+}
@@ -0,0 +1,74 @@
+package email
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyStats(t *testing.T) {
+	var slow []time.Duration
+	s := &latencyStats{slowThreshold: time.Second, onSlow: func(d time.Duration) {
+		slow = append(slow, d)
+	}}
+	if st := s.stats(); st != (PoolStats{}) {
+		t.Errorf("Stats without sends aren't empty: %+v", st)
+	}
+	for i := 0; i < 98; i++ {
+		s.observe(3 * time.Millisecond)
+	}
+	s.observe(100 * time.Millisecond)
+	s.observe(3 * time.Second)
+	st := s.stats()
+	if st.Sends != 100 {
+		t.Errorf("Incorrect number of sends: %d != 100", st.Sends)
+	}
+	if st.P50 != 4*time.Millisecond || st.P90 != 4*time.Millisecond {
+		t.Errorf("Incorrect P50 and P90: %s, %s != 4ms", st.P50, st.P90)
+	}
+	if st.P99 != 128*time.Millisecond {
+		t.Errorf("Incorrect P99: %s != 128ms", st.P99)
+	}
+	if st.Max != 3*time.Second {
+		t.Errorf("Incorrect maximum: %s != 3s", st.Max)
+	}
+	// The average follows recent sends.
+	if st.AvgLatency <= 100*time.Millisecond || st.AvgLatency >= 3*time.Second {
+		t.Errorf("Incorrect moving average: %s", st.AvgLatency)
+	}
+	if len(slow) != 1 || slow[0] != 3*time.Second {
+		t.Errorf("Incorrect slow sends reported: %v", slow)
+	}
+}
+
+func TestPoolOnSlowSend(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.Close()
+	s.mu.Lock()
+	s.stall = 200 * time.Millisecond
+	s.mu.Unlock()
+	p, err := NewPool(s.addr(), 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	var slow []time.Duration
+	p.SetOnSlowSend(100*time.Millisecond, func(d time.Duration) {
+		slow = append(slow, d)
+	})
+
+	for _, to := range []string{"fast@example.com", "stall@example.com"} {
+		e := NewEmail()
+		e.From = "sender@example.org"
+		e.To = []string{to}
+		e.Text = []byte("Hello")
+		if err := p.Send(e, 5*time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(slow) != 1 || slow[0] < 200*time.Millisecond {
+		t.Errorf("Incorrect slow sends reported: %v", slow)
+	}
+	if st := p.Stats(); st.Sends != 2 || st.Max < 200*time.Millisecond {
+		t.Errorf("Incorrect stats: %+v", st)
+	}
+}
@@ -0,0 +1,245 @@
+package email
+
+import (
+	"bytes"
+	"errors"
+	"html"
+	"strings"
+)
+
+// ErrMalformedHTML is returned by RewriteLinks when the HTML body ends inside
+// a tag, so its links can't be found reliably.
+var ErrMalformedHTML = errors.New("Malformed HTML: unterminated tag")
+
+// ErrNoHTMLBody is returned by InjectTrackingPixel when the message has no
+// HTML body to add the pixel to.
+var ErrNoHTMLBody = errors.New("No HTML body found in the message")
+
+// LinkOptions are optional parameters of RewriteLinksWithOptions.
+type LinkOptions struct {
+	Src     bool     // Also rewrite src attributes, such as those of images
+	Schemes []string // Schemes to rewrite even though they are skipped by default, such as "mailto"
+}
+
+// skippedSchemes are the link schemes RewriteLinks leaves alone unless asked
+// to, as they don't point to anything a redirect could stand in for.
+var skippedSchemes = []string{"mailto", "tel", "cid"}
+
+// RewriteLinks replaces the URL of every href attribute in the HTML body with
+// the result of fn, such as a click tracking redirect. fn is called with the
+// unescaped URL; links with the mailto, tel and cid schemes are skipped. The
+// rest of the markup, including comments and the contents of script and style
+// elements, is kept byte for byte.
+func (e *Email) RewriteLinks(fn func(url string) string) error {
+	return e.RewriteLinksWithOptions(fn, nil)
+}
+
+// RewriteLinksWithOptions is like RewriteLinks, but can also rewrite src
+// attributes and the otherwise skipped schemes. A nil opts behaves exactly
+// like RewriteLinks.
+func (e *Email) RewriteLinksWithOptions(fn func(url string) string, opts *LinkOptions) error {
+	if opts == nil {
+		opts = &LinkOptions{}
+	}
+	b, err := rewriteLinks(e.HTML, fn, opts)
+	if err != nil {
+		return err
+	}
+	e.HTML = b
+	return nil
+}
+
+// InjectTrackingPixel adds a 1x1 image loaded from url, such as an open
+// tracking pixel, just before the last </body> tag of the HTML body, or at the
+// end if there is none. It returns ErrNoHTMLBody, and leaves the message
+// unchanged, if there is no HTML body.
+func (e *Email) InjectTrackingPixel(url string) error {
+	if len(e.HTML) == 0 {
+		return ErrNoHTMLBody
+	}
+	pixel := `<img src="` + html.EscapeString(url) + `" width="1" height="1" alt="" style="border:0;width:1px;height:1px">`
+	i := lastIndexFold(e.HTML, "</body")
+	if i < 0 {
+		i = len(e.HTML)
+	}
+	b := make([]byte, 0, len(e.HTML)+len(pixel))
+	b = append(b, e.HTML[:i]...)
+	b = append(b, pixel...)
+	e.HTML = append(b, e.HTML[i:]...)
+	return nil
+}
+
+func rewriteLinks(b []byte, fn func(string) string, opts *LinkOptions) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Grow(len(b))
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '<')
+		if i < 0 {
+			buf.Write(b)
+			break
+		}
+		buf.Write(b[:i])
+		b = b[i:]
+		if bytes.HasPrefix(b, []byte("<!--")) {
+			end := bytes.Index(b[4:], []byte("-->"))
+			if end < 0 {
+				buf.Write(b)
+				break
+			}
+			buf.Write(b[:4+end+3])
+			b = b[4+end+3:]
+			continue
+		}
+		name := tagName(b[1:])
+		if name == "" {
+			// A stray "<", or an end tag, doctype or the like, none of
+			// which has links.
+			buf.WriteByte('<')
+			b = b[1:]
+			continue
+		}
+		n, err := rewriteTag(&buf, b, fn, opts)
+		if err != nil {
+			return nil, err
+		}
+		b = b[n:]
+		if name == "script" || name == "style" {
+			// Raw text, which may contain anything but its end tag.
+			end := indexFold(b, "</"+name)
+			if end < 0 {
+				end = len(b)
+			}
+			buf.Write(b[:end])
+			b = b[end:]
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// tagName returns the lowercased name of the start tag b begins with, or ""
+// if it doesn't begin with one.
+func tagName(b []byte) string {
+	n := 0
+	for n < len(b) && (b[n] >= 'a' && b[n] <= 'z' || b[n] >= 'A' && b[n] <= 'Z' || n > 0 && (b[n] >= '0' && b[n] <= '9' || b[n] == '-')) {
+		n++
+	}
+	return strings.ToLower(string(b[:n]))
+}
+
+// rewriteTag writes the start tag b begins with to buf, with its link
+// attributes rewritten, and returns the length of the tag.
+func rewriteTag(buf *bytes.Buffer, b []byte, fn func(string) string, opts *LinkOptions) (int, error) {
+	i := 1 + len(tagName(b[1:]))
+	written := 0
+	for {
+		for i < len(b) && isHTMLSpace(b[i]) {
+			i++
+		}
+		if i >= len(b) {
+			return 0, ErrMalformedHTML
+		}
+		if b[i] == '>' {
+			buf.Write(b[written : i+1])
+			return i + 1, nil
+		}
+		if b[i] == '/' {
+			i++
+			continue
+		}
+		start := i
+		for i < len(b) && !isHTMLSpace(b[i]) && b[i] != '=' && b[i] != '>' && b[i] != '/' {
+			i++
+		}
+		attr := strings.ToLower(string(b[start:i]))
+		for i < len(b) && isHTMLSpace(b[i]) {
+			i++
+		}
+		if i >= len(b) || b[i] != '=' {
+			continue
+		}
+		i++
+		for i < len(b) && isHTMLSpace(b[i]) {
+			i++
+		}
+		if i >= len(b) {
+			return 0, ErrMalformedHTML
+		}
+		var valStart, valEnd int
+		quote := b[i]
+		if quote == '"' || quote == '\'' {
+			end := bytes.IndexByte(b[i+1:], quote)
+			if end < 0 {
+				return 0, ErrMalformedHTML
+			}
+			valStart, valEnd = i+1, i+1+end
+			i = valEnd + 1
+		} else {
+			quote = 0
+			valStart = i
+			for i < len(b) && !isHTMLSpace(b[i]) && b[i] != '>' {
+				i++
+			}
+			valEnd = i
+		}
+		if attr != "href" && !(attr == "src" && opts.Src) {
+			continue
+		}
+		url := html.UnescapeString(string(b[valStart:valEnd]))
+		if isSkippedLink(url, opts.Schemes) {
+			continue
+		}
+		rewritten := fn(url)
+		if rewritten == url {
+			continue
+		}
+		buf.Write(b[written:valStart])
+		if quote == 0 {
+			// Unquoted values can't hold all URLs, so add quotes.
+			buf.WriteString(`"` + html.EscapeString(rewritten) + `"`)
+		} else {
+			buf.WriteString(html.EscapeString(rewritten))
+		}
+		written = valEnd
+	}
+}
+
+// isSkippedLink reports whether url has one of the skipped schemes which
+// isn't in allowed.
+func isSkippedLink(url string, allowed []string) bool {
+	url = strings.TrimSpace(url)
+	for _, s := range skippedSchemes {
+		if len(url) > len(s) && url[len(s)] == ':' && strings.EqualFold(url[:len(s)], s) {
+			for _, a := range allowed {
+				if strings.EqualFold(a, s) {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func isHTMLSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+// indexFold is like bytes.Index, but case-insensitive.
+func indexFold(b []byte, sep string) int {
+	for i := 0; i+len(sep) <= len(b); i++ {
+		if bytes.EqualFold(b[i:i+len(sep)], []byte(sep)) {
+			return i
+		}
+	}
+	return -1
+}
+
+// lastIndexFold is like bytes.LastIndex, but case-insensitive.
+func lastIndexFold(b []byte, sep string) int {
+	for i := len(b) - len(sep); i >= 0; i-- {
+		if bytes.EqualFold(b[i:i+len(sep)], []byte(sep)) {
+			return i
+		}
+	}
+	return -1
+}
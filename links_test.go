@@ -0,0 +1,78 @@
+package email
+
+import (
+	"testing"
+)
+
+func TestRewriteLinks(t *testing.T) {
+	e := NewEmail()
+	e.HTML = []byte(`<!DOCTYPE html><p class=x>Hi <A HREF="https://example.com/a?x=1&amp;y=2">a</A>, ` +
+		`<a title='t' href='https://example.com/b'>b</a> <a href=https://example.com/c>c</a> ` +
+		`<a href="mailto:bob@example.com">m</a> <a href="tel:+15555550100">t</a> ` +
+		`<img src="cid:logo"><img src="https://example.com/i.png" alt="href=x"></p>` +
+		`<!-- <a href="https://example.com/comment"> --><script>var s = '<a href="https://example.com/s">';</script>`)
+	var seen []string
+	err := e.RewriteLinks(func(url string) string {
+		seen = append(seen, url)
+		return "https://track.example.net/?u=" + url
+	})
+	if err != nil {
+		t.Fatalf("Error rewriting links: %s", err)
+	}
+	want := `<!DOCTYPE html><p class=x>Hi <A HREF="https://track.example.net/?u=https://example.com/a?x=1&amp;y=2">a</A>, ` +
+		`<a title='t' href='https://track.example.net/?u=https://example.com/b'>b</a> <a href="https://track.example.net/?u=https://example.com/c">c</a> ` +
+		`<a href="mailto:bob@example.com">m</a> <a href="tel:+15555550100">t</a> ` +
+		`<img src="cid:logo"><img src="https://example.com/i.png" alt="href=x"></p>` +
+		`<!-- <a href="https://example.com/comment"> --><script>var s = '<a href="https://example.com/s">';</script>`
+	if string(e.HTML) != want {
+		t.Errorf("Incorrect HTML:\n%s\n!=\n%s", e.HTML, want)
+	}
+	if len(seen) != 3 || seen[0] != "https://example.com/a?x=1&y=2" {
+		t.Errorf("Incorrect URLs passed to the callback: %q", seen)
+	}
+
+	e.HTML = []byte(`<a href="mailto:bob@example.com">m</a><img src="cid:logo"><img src="https://example.com/i.png">`)
+	err = e.RewriteLinksWithOptions(func(url string) string { return url + "#x" }, &LinkOptions{Src: true, Schemes: []string{"MAILTO"}})
+	if err != nil {
+		t.Fatalf("Error rewriting links: %s", err)
+	}
+	want = `<a href="mailto:bob@example.com#x">m</a><img src="cid:logo"><img src="https://example.com/i.png#x">`
+	if string(e.HTML) != want {
+		t.Errorf("Incorrect HTML with options:\n%s\n!=\n%s", e.HTML, want)
+	}
+
+	e.HTML = []byte(`<a href="https://example.com/`)
+	if err := e.RewriteLinks(func(url string) string { return url }); err != ErrMalformedHTML {
+		t.Errorf("Expected ErrMalformedHTML for an unterminated tag, got %v", err)
+	}
+}
+
+func TestInjectTrackingPixel(t *testing.T) {
+	pixel := `<img src="https://track.example.net/o?id=1&amp;m=2" width="1" height="1" alt="" style="border:0;width:1px;height:1px">`
+	tests := []struct {
+		html string
+		want string
+	}{
+		{"<html><body><p>Hi</p></body></html>", "<html><body><p>Hi</p>" + pixel + "</body></html>"},
+		{"<HTML><BODY><p>Hi</p></BODY></HTML>", "<HTML><BODY><p>Hi</p>" + pixel + "</BODY></HTML>"},
+		{"<p>Hi</p>", "<p>Hi</p>" + pixel},
+	}
+	for _, tt := range tests {
+		e := NewEmail()
+		e.HTML = []byte(tt.html)
+		if err := e.InjectTrackingPixel("https://track.example.net/o?id=1&m=2"); err != nil {
+			t.Fatalf("Error injecting tracking pixel: %s", err)
+		}
+		if string(e.HTML) != tt.want {
+			t.Errorf("Incorrect HTML: %#q != %#q", e.HTML, tt.want)
+		}
+	}
+	e := NewEmail()
+	e.Text = []byte("Hi")
+	if err := e.InjectTrackingPixel("https://track.example.net/o"); err != ErrNoHTMLBody {
+		t.Errorf("Expected ErrNoHTMLBody, got %v", err)
+	}
+	if len(e.HTML) != 0 {
+		t.Errorf("HTML body added to a text-only message: %#q", e.HTML)
+	}
+}
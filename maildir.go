@@ -0,0 +1,99 @@
+package email
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// MaildirMessage is a message read from a Maildir.
+type MaildirMessage struct {
+	Path  string // path of the message file
+	New   bool   // whether the message is in the "new" subdirectory, rather than "cur"
+	Flags string // Maildir flags from the ":2," suffix of the file name, e.g. "FS" for flagged and seen
+	Email *Email
+}
+
+// MaildirReader reads the messages of a Maildir one at a time, so that a large
+// Maildir need not be held in memory.
+type MaildirReader struct {
+	paths []string
+	news  int
+}
+
+// OpenMaildir lists the messages in the "new" and "cur" subdirectories of the
+// Maildir at dir, which are then read with Next.
+func OpenMaildir(dir string) (*MaildirReader, error) {
+	mr := &MaildirReader{}
+	for _, sub := range []string{"new", "cur"} {
+		infos, err := ioutil.ReadDir(filepath.Join(dir, sub))
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		for _, fi := range infos {
+			// Skip anything which isn't a message, such as editor backups.
+			if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+				continue
+			}
+			names = append(names, fi.Name())
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			mr.paths = append(mr.paths, filepath.Join(dir, sub, name))
+		}
+		if sub == "new" {
+			mr.news = len(mr.paths)
+		}
+	}
+	return mr, nil
+}
+
+// Next parses and returns the next message, or io.EOF when there are none left.
+func (mr *MaildirReader) Next() (*MaildirMessage, error) {
+	if len(mr.paths) == 0 {
+		return nil, io.EOF
+	}
+	path := mr.paths[0]
+	m := &MaildirMessage{Path: path, New: mr.news > 0}
+	mr.paths = mr.paths[1:]
+	if mr.news > 0 {
+		mr.news--
+	}
+	if i := strings.LastIndex(filepath.Base(path), ":2,"); i >= 0 {
+		m.Flags = filepath.Base(path)[i+len(":2,"):]
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if m.Email, err = NewEmailFromReader(f); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ReadMaildir reads all of the messages in the Maildir at dir, those in "new"
+// first, followed by those in "cur".
+func ReadMaildir(dir string) ([]*MaildirMessage, error) {
+	mr, err := OpenMaildir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var msgs []*MaildirMessage
+	for {
+		m, err := mr.Next()
+		if err == io.EOF {
+			return msgs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+}
@@ -0,0 +1,62 @@
+package email
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadMaildir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"new/1700000002.M1P1.host":      "Subject: Unread\r\n\r\nHello\r\n",
+		"cur/1700000000.M1P1.host:2,FS": "Subject: Flagged\r\n\r\nHello\r\n",
+		"cur/1700000001.M1P1.host:2,":   "Subject: Unseen\r\n\r\nHello\r\n",
+		"cur/.1700000003.M1P1.host:2,S": "Subject: Hidden\r\n\r\nHello\r\n",
+		"tmp/1700000004.M1P1.host":      "Subject: Delivering\r\n\r\nHello\r\n",
+	}
+	for _, sub := range []string{"new", "cur", "tmp"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	msgs, err := ReadMaildir(dir)
+	if err != nil {
+		t.Fatal("Could not read Maildir: ", err)
+	}
+	expected := []struct {
+		subject string
+		new     bool
+		flags   string
+	}{
+		{"Unread", true, ""},
+		{"Flagged", false, "FS"},
+		{"Unseen", false, ""},
+	}
+	if len(msgs) != len(expected) {
+		t.Fatalf("Expected %d messages, got %d", len(expected), len(msgs))
+	}
+	for i, want := range expected {
+		m := msgs[i]
+		if m.Email.Subject != want.subject || m.New != want.new || m.Flags != want.flags {
+			t.Errorf("Message %d: got subject %q, new %v, flags %q, expected %q, %v, %q",
+				i, m.Email.Subject, m.New, m.Flags, want.subject, want.new, want.flags)
+		}
+	}
+
+	if _, err := ReadMaildir(filepath.Join(dir, "missing")); err == nil {
+		t.Error("Expected an error reading a missing Maildir")
+	}
+}
@@ -0,0 +1,192 @@
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// Part is a single MIME entity of a message, with its decoded body.
+type Part struct {
+	Header textproto.MIMEHeader
+	Body   []byte
+}
+
+// PartByPath returns the MIME part of the message at path, which is a list of
+// part numbers separated by dots, as in IMAP (RFC 3501, section 6.4.5). For
+// example, "1.2" is the second part of the first part of the message. The
+// body of a message which isn't multipart is part "1", and the parts of an
+// encapsulated message/rfc822 part are numbered below it.
+//
+// Messages parsed with NewEmailFromReader are addressed as they were read, as
+// long as their bodies and attachments are unchanged; otherwise the message
+// is rendered with Bytes first, so that the parts are always current.
+func (e *Email) PartByPath(path string) (*Part, error) {
+	var nums []int
+	for _, s := range strings.Split(path, ".") {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("Invalid MIME part path %q", path)
+		}
+		nums = append(nums, n)
+	}
+
+	root, err := e.rootEntity()
+	if err != nil {
+		return nil, err
+	}
+	p, err := partByPath(root.Header, root.Body, nums)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return nil, fmt.Errorf("No MIME part found at %q", path)
+	}
+	return p, nil
+}
+
+// rootEntity returns the header and undecoded body of e as it was parsed, or
+// otherwise as it is rendered.
+func (e *Email) rootEntity() (*Part, error) {
+	if e.rawBody != nil && e.contentSum() == e.rawSum {
+		return e.rawBody, nil
+	}
+	raw, err := e.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	return readEntity(raw)
+}
+
+// contentSum returns a hash of the content of e which makes up its MIME
+// parts, so that changes to it since it was parsed can be detected.
+func (e *Email) contentSum() uint64 {
+	h := fnv.New64a()
+	field := func(b []byte) {
+		var n [8]byte
+		binary.LittleEndian.PutUint64(n[:], uint64(len(b)))
+		h.Write(n[:])
+		h.Write(b)
+	}
+	field(e.Text)
+	field(e.HTML)
+	field([]byte(e.Headers.Get("Content-Type")))
+	field([]byte(e.preheader))
+	if e.HTMLOnly {
+		h.Write([]byte{1})
+	}
+	for _, a := range e.Attachments {
+		field([]byte(a.Filename))
+		field([]byte(a.ContentType))
+		field(a.Content)
+	}
+	for _, a := range e.alternatives {
+		field([]byte(a.contentType))
+		field(a.body)
+	}
+	return h.Sum64()
+}
+
+// readEntity splits a MIME entity into its header and undecoded body.
+func readEntity(raw []byte) (*Part, error) {
+	br := bufio.NewReader(bytes.NewReader(raw))
+	h, err := textproto.NewReader(br).ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(br)
+	if err != nil {
+		return nil, err
+	}
+	return &Part{Header: h, Body: body}, nil
+}
+
+// partByPath finds the part at path in the entity with the header h and
+// undecoded body, returning nil if there is none.
+func partByPath(h textproto.MIMEHeader, body []byte, path []int) (*Part, error) {
+	ct, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		ct = "text/plain"
+	}
+	if !strings.HasPrefix(ct, "multipart/") {
+		if path[0] != 1 {
+			return nil, nil
+		}
+		return subPart(h, body, path[1:])
+	}
+	boundary, err := boundaryParam(params)
+	if err != nil {
+		return nil, err
+	}
+	mr := multipart.NewReader(bytes.NewReader(body), boundary)
+	for i := 1; ; i++ {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if i < path[0] {
+			continue
+		}
+		b, err := ioutil.ReadAll(p)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := p.Header["Content-Type"]; !ok {
+			p.Header.Set("Content-Type", defaultContentType)
+		}
+		if len(path) > 1 {
+			if pct, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type")); strings.HasPrefix(pct, "multipart/") {
+				return partByPath(p.Header, b, path[1:])
+			}
+		}
+		return subPart(p.Header, b, path[1:])
+	}
+}
+
+// subPart returns the leaf part with the header h and undecoded body if path
+// is empty, or otherwise the part at path in the message it encapsulates.
+func subPart(h textproto.MIMEHeader, body []byte, path []int) (*Part, error) {
+	decoded, err := decodeBody(h, body)
+	if err != nil {
+		return nil, err
+	}
+	if len(path) == 0 {
+		return &Part{Header: h, Body: decoded}, nil
+	}
+	if ct, _, _ := mime.ParseMediaType(h.Get("Content-Type")); ct != "message/rfc822" {
+		return nil, nil
+	}
+	inner, err := readEntity(decoded)
+	if err != nil {
+		return nil, err
+	}
+	return partByPath(inner.Header, inner.Body, path)
+}
+
+// decodeBody decodes body according to the Content-Transfer-Encoding in h.
+func decodeBody(h textproto.MIMEHeader, body []byte) ([]byte, error) {
+	var r io.Reader
+	switch strings.ToLower(h.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, bytes.NewReader(body))
+	case "quoted-printable":
+		r = quotedprintable.NewReader(bytes.NewReader(body))
+	default:
+		return body, nil
+	}
+	return ioutil.ReadAll(r)
+}
@@ -0,0 +1,102 @@
+package email
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPartByPath(t *testing.T) {
+	inner := prepareEmail()
+	inner.Subject = "Inner"
+	inner.Text = []byte("Inner text")
+	inner.HTML = []byte("<p>Inner HTML</p>")
+	innerRaw, err := inner.Bytes()
+	if err != nil {
+		t.Fatal("Failed to render message: ", err)
+	}
+
+	e := prepareEmail()
+	e.Text = []byte("Outer text")
+	e.HTML = []byte("<p>Outer HTML</p>")
+	if _, err := e.Attach(bytes.NewReader([]byte("\x00\x01binary")), "a.bin", "application/octet-stream"); err != nil {
+		t.Fatal("Could not add an attachment to the message: ", err)
+	}
+	if _, err := e.Attach(bytes.NewReader(innerRaw), "inner.eml", "message/rfc822"); err != nil {
+		t.Fatal("Could not add an attachment to the message: ", err)
+	}
+	raw, err := e.Bytes()
+	if err != nil {
+		t.Fatal("Failed to render message: ", err)
+	}
+	parsed, err := NewEmailFromReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Error parsing email %s", err.Error())
+	}
+
+	var cases = []struct {
+		path string
+		want string
+	}{
+		{"1.1", "Outer text"},
+		{"1.2", "<p>Outer HTML</p>"},
+		{"2", "\x00\x01binary"},
+		{"3.1", "Inner text"},
+		{"3.2", "<p>Inner HTML</p>"},
+	}
+	for _, testcase := range cases {
+		for _, m := range []*Email{parsed, e} {
+			p, err := m.PartByPath(testcase.path)
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", testcase.path, err)
+				continue
+			}
+			if got := string(p.Body); got != testcase.want {
+				t.Errorf("%s: incorrect body: %#q != %#q", testcase.path, got, testcase.want)
+			}
+		}
+	}
+	if p, err := parsed.PartByPath("3"); err != nil || !bytes.Equal(p.Body, innerRaw) {
+		t.Errorf("Encapsulated message was not returned for its own path: %v", err)
+	}
+	for _, path := range []string{"4", "1.3", "2.1", "0", "a.b", ""} {
+		if _, err := parsed.PartByPath(path); err == nil {
+			t.Errorf("%q: expected an error", path)
+		}
+	}
+}
+
+func TestPartByPathAfterChanges(t *testing.T) {
+	raw := []byte("From: <a@example.com>\r\n" +
+		"Subject: Parts\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/alternative; boundary=\"b1\"\r\n" +
+		"\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Hello\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/html\r\n" +
+		"\r\n" +
+		"<p>Hello</p>\r\n" +
+		"--b1--\r\n")
+	e, err := NewEmailFromReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Error parsing email %s", err.Error())
+	}
+	// Changes to the headers leave the parts as they were read.
+	e.Subject = "Changed"
+	if p, err := e.PartByPath("2"); err != nil || string(p.Body) != "<p>Hello</p>" {
+		t.Errorf("Incorrect part 2 as read: %v, %v", p, err)
+	}
+	e.HTML = []byte("<p>Goodbye</p>")
+	if p, err := e.PartByPath("2"); err != nil || string(p.Body) != "<p>Goodbye</p>" {
+		t.Errorf("Part 2 is stale after changing the HTML: %v, %v", p, err)
+	}
+	if _, err := e.Attach(bytes.NewReader([]byte("data")), "a.txt", "text/plain"); err != nil {
+		t.Fatal("Could not add an attachment to the message: ", err)
+	}
+	if p, err := e.PartByPath("2"); err != nil || string(p.Body) != "data" {
+		t.Errorf("Added attachment is missing: %v, %v", p, err)
+	}
+}
@@ -1,13 +1,18 @@
 package email
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/mail"
 	"net/smtp"
 	"net/textproto"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -15,20 +20,31 @@ import (
 
 type Pool struct {
 	addr          string
-	auth          smtp.Auth
+	authFunc      func() (smtp.Auth, error)
 	max           int
 	created       int
 	clients       chan *client
 	rebuild       chan struct{}
-	mut           *sync.Mutex
+	mut           *sync.Mutex // guards created and lastBuildErr
 	lastBuildErr  *timestampedErr
 	closing       chan struct{}
 	tlsConfig     *tls.Config
 	helloHostname string
+	dialTimeout   time.Duration
+	maxRecipients int
+	footerText    []byte
+	footerHTML    []byte
+	defaultFrom   string
+	trace         func(event string)
+	sentKeys      *keyCache
+	latency       *latencyStats
+	waitMu        sync.Mutex
+	waiters       []chan struct{}
 }
 
 type client struct {
 	*smtp.Client
+	conn      net.Conn
 	failCount int
 }
 
@@ -42,22 +58,95 @@ const maxFails = 4
 var (
 	ErrClosed  = errors.New("pool closed")
 	ErrTimeout = errors.New("timed out")
+
+	// ErrSendTimeout is returned by Pool.Send when a connection was acquired,
+	// but the SMTP conversation did not complete within the timeout.
+	ErrSendTimeout = errors.New("timed out sending message")
 )
 
+// PartialSendError is returned by Pool.Send when the message was delivered to
+// some of its recipients but not others, either because the server rejected
+// some recipients, or because one of several transactions failed. It is also
+// returned when a failed connection left the later transactions of a split
+// message unattempted.
+type PartialSendError struct {
+	Delivered    []string // Recipients which the message was delivered to
+	Failed       []string // Recipients which were rejected, or whose transaction failed
+	NotAttempted []string // Recipients of the transactions which were never started
+	Err          error    // The first error which caused a recipient to fail
+
+	origins map[string]string
+}
+
+// Origin returns the field, "To", "Cc" or "Bcc", in which the recipient addr
+// was given, so that e.g. a failed Bcc to an archive address can be treated
+// differently. If addr was given in several fields, the first of them is
+// returned; if it isn't known, "" is returned.
+func (e *PartialSendError) Origin(addr string) string {
+	return e.origins[addr]
+}
+
+func (e *PartialSendError) Error() string {
+	return fmt.Sprintf("sent to %d of %d recipients: %s", len(e.Delivered), len(e.Delivered)+len(e.Failed)+len(e.NotAttempted), e.Err)
+}
+
+// SendError is returned when sending the content of a message fails, and
+// tells how far the transfer got, so that a message which the server may have
+// accepted isn't sent twice.
+type SendError struct {
+	Written  int   // Bytes of the message accepted for sending before the failure
+	Size     int   // Size of the message in bytes
+	Complete bool  // Whether the whole message, with its terminator, was sent
+	Err      error // The error which caused the failure
+}
+
+func (e *SendError) Error() string {
+	if e.Complete {
+		return fmt.Sprintf("sending message of %d bytes: %s", e.Size, e.Err)
+	}
+	return fmt.Sprintf("sending message: interrupted after %d of %d bytes: %s", e.Written, e.Size, e.Err)
+}
+
+// Rejected reports whether the server responded with an error, so that the
+// message wasn't accepted, and sending it again unchanged won't help.
+func (e *SendError) Rejected() bool {
+	_, ok := e.Err.(*textproto.Error)
+	return ok
+}
+
+// Retryable reports whether the connection failed before the whole message
+// was sent, so that the server can't have accepted it, and it may be sent
+// again. If the message was sent but no response was received, it may have
+// been accepted, and neither Rejected nor Retryable is true.
+func (e *SendError) Retryable() bool {
+	return !e.Complete && !e.Rejected()
+}
+
 func NewPool(address string, count int, auth smtp.Auth, opt_tlsConfig ...*tls.Config) (pool *Pool, err error) {
 	pool = &Pool{
 		addr:    address,
-		auth:    auth,
 		max:     count,
 		clients: make(chan *client, count),
 		rebuild: make(chan struct{}),
 		closing: make(chan struct{}),
 		mut:     &sync.Mutex{},
+		latency: &latencyStats{},
+	}
+	if auth != nil {
+		pool.authFunc = func() (smtp.Auth, error) { return auth, nil }
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
 	}
 	if len(opt_tlsConfig) == 1 {
+		// The whole config is used, e.g. with client certificates for relays
+		// which require them, but the server name defaults to the host.
 		pool.tlsConfig = opt_tlsConfig[0]
-	} else if host, _, e := net.SplitHostPort(address); e != nil {
-		return nil, e
+		if pool.tlsConfig.ServerName == "" {
+			pool.tlsConfig = pool.tlsConfig.Clone()
+			pool.tlsConfig.ServerName = host
+		}
 	} else {
 		pool.tlsConfig = &tls.Config{ServerName: host}
 	}
@@ -77,21 +166,136 @@ func (p *Pool) SetHelloHostname(h string) {
 	p.helloHostname = h
 }
 
-func (p *Pool) get(timeout time.Duration) *client {
-	select {
-	case c := <-p.clients:
-		return c
-	default:
-	}
+// SetAuthFunc optionally sets a function which is called for a fresh smtp.Auth
+// each time a new connection is built, replacing the smtp.Auth given to
+// NewPool. This allows credentials which expire, such as OAuth2 access
+// tokens, to be refreshed.
+func (p *Pool) SetAuthFunc(f func() (smtp.Auth, error)) {
+	p.authFunc = f
+}
 
-	if p.created < p.max {
-		p.makeOne()
+// SetAuthMechanisms optionally sets several smtp.Auth mechanisms in order of
+// preference, replacing the smtp.Auth given to NewPool. Each time a new
+// connection is built, the first mechanism which the server advertises in its
+// AUTH extension is used, e.g. LOGIN as a fallback for servers which don't
+// support XOAUTH2. Mechanisms are tried by calling their Start method, and
+// those which return an error, such as smtp.PlainAuth without TLS, are
+// skipped.
+func (p *Pool) SetAuthMechanisms(auths ...smtp.Auth) {
+	p.authFunc = func() (smtp.Auth, error) {
+		return &negotiatedAuth{auths: auths}, nil
 	}
+}
+
+// SetDialTimeout optionally sets the maximum amount of time that building a new
+// connection may take, including the TCP connect, STARTTLS and AUTH. By
+// default there is no timeout.
+func (p *Pool) SetDialTimeout(d time.Duration) {
+	p.dialTimeout = d
+}
+
+// SetFooter optionally sets a footer, such as a disclaimer, which is appended
+// to the plaintext and HTML bodies of every message sent by the pool (see
+// Email.WithFooter). The messages passed to Send are not modified.
+func (p *Pool) SetFooter(text, html []byte) {
+	p.footerText = text
+	p.footerHTML = html
+}
 
+// SetTrace optionally sets a function which is called with each SMTP command
+// the pool sends and each response line it receives, as "C: <command>" and
+// "S: <response>", for diagnosing problems with a server. Credentials sent
+// during AUTH are redacted, and message content is summarized by its length.
+// The server's greeting and the EHLO sent straight after STARTTLS are not
+// reported, as net/smtp handles them internally.
+func (p *Pool) SetTrace(f func(event string)) {
+	p.trace = f
+}
+
+// SetDefaultFrom optionally sets the address used as the From header and the
+// envelope sender of messages sent with an empty From, such as the identity
+// the pool authenticates as. The messages passed to Send are not modified.
+func (p *Pool) SetDefaultFrom(from string) {
+	p.defaultFrom = from
+}
+
+// SetIdempotencyCache optionally enables SendIdempotent, which remembers the
+// keys of up to size successful sends for the given window, forgetting the
+// least recently used keys first.
+func (p *Pool) SetIdempotencyCache(size int, window time.Duration) {
+	p.sentKeys = newKeyCache(size, window)
+}
+
+// SetOnSlowSend optionally sets a function which is called with the latency
+// of each successful send that takes longer than threshold, such as to warn
+// that the server is slowing down. It is called synchronously, before the
+// send returns.
+func (p *Pool) SetOnSlowSend(threshold time.Duration, f func(d time.Duration)) {
+	p.latency.slowThreshold = threshold
+	p.latency.onSlow = f
+}
+
+// Stats returns the latencies of the sends made through the pool so far.
+func (p *Pool) Stats() PoolStats {
+	return p.latency.stats()
+}
+
+// SetMaxRecipientsPerMessage optionally limits the number of recipients in a
+// single SMTP transaction. Messages with more recipients are sent in several
+// transactions over the same connection; if some of them fail, the others
+// are still sent, and a *PartialSendError tells which recipients were
+// delivered, failed or never attempted. If the server advertises a lower
+// limit with the LIMITS extension (RFC 9422), that is used instead. By
+// default, only the advertised limit applies.
+func (p *Pool) SetMaxRecipientsPerMessage(n int) {
+	p.maxRecipients = n
+}
+
+func (p *Pool) get(timeout time.Duration) *client {
 	var deadline <-chan time.Time
 	if timeout >= 0 {
 		deadline = time.After(timeout)
 	}
+	return p.wait(deadline, nil)
+}
+
+// wait returns a connection, or nil if deadline passes, done is closed or the
+// Pool is closed first. Callers are served in the order in which they started
+// waiting, so that none of them is starved when the Pool is busy, but each of
+// them starts building a connection if there is none to spare, so that a cold
+// Pool dials in parallel rather than one connection at a time.
+func (p *Pool) wait(deadline <-chan time.Time, done <-chan struct{}) *client {
+	turn := p.enqueue()
+	defer p.dequeue(turn)
+	if len(p.clients) == 0 {
+		p.makeOne()
+	}
+	select {
+	case <-turn:
+	default:
+		for ready := false; !ready; {
+			select {
+			case <-turn:
+				ready = true
+			case <-p.rebuild:
+				p.makeOne()
+			case <-deadline:
+				return nil
+			case <-done:
+				return nil
+			case <-p.closing:
+				return nil
+			}
+		}
+	}
+
+	select {
+	case c := <-p.clients:
+		return c
+	default:
+	}
+
+	p.makeOne()
 
 	for {
 		select {
@@ -101,12 +305,52 @@ func (p *Pool) get(timeout time.Duration) *client {
 			p.makeOne()
 		case <-deadline:
 			return nil
+		case <-done:
+			return nil
 		case <-p.closing:
 			return nil
 		}
 	}
 }
 
+// enqueue adds a caller to the queue of those waiting for a connection. The
+// returned channel is closed when the caller reaches the front of the queue.
+func (p *Pool) enqueue() chan struct{} {
+	p.waitMu.Lock()
+	defer p.waitMu.Unlock()
+	turn := make(chan struct{})
+	if len(p.waiters) == 0 {
+		close(turn)
+	}
+	p.waiters = append(p.waiters, turn)
+	return turn
+}
+
+// dequeue removes a caller from the queue, and if it was at the front, lets
+// the next one take its turn.
+func (p *Pool) dequeue(turn chan struct{}) {
+	p.waitMu.Lock()
+	defer p.waitMu.Unlock()
+	for i, w := range p.waiters {
+		if w != turn {
+			continue
+		}
+		p.waiters = append(p.waiters[:i], p.waiters[i+1:]...)
+		if i == 0 && len(p.waiters) > 0 {
+			close(p.waiters[0])
+		}
+		return
+	}
+}
+
+// Waiting returns the number of callers currently waiting for a connection,
+// which can be used to detect that the Pool is too small for the load.
+func (p *Pool) Waiting() int {
+	p.waitMu.Lock()
+	defer p.waitMu.Unlock()
+	return len(p.waiters)
+}
+
 func shouldReuse(err error) bool {
 	// certainly not perfect, but might be close:
 	//  - EOF: clearly, the connection went down
@@ -142,14 +386,15 @@ func (p *Pool) replace(c *client) {
 }
 
 func (p *Pool) inc() bool {
-	if p.created >= p.max {
-		return false
-	}
+	return p.incTo(p.max)
+}
 
+// incTo is like inc, but also stops once there are n connections.
+func (p *Pool) incTo(n int) bool {
 	p.mut.Lock()
 	defer p.mut.Unlock()
 
-	if p.created >= p.max {
+	if p.created >= p.max || p.created >= n {
 		return false
 	}
 	p.created++
@@ -173,13 +418,48 @@ func (p *Pool) makeOne() {
 			if c, err := p.build(); err == nil {
 				p.clients <- c
 			} else {
-				p.lastBuildErr = &timestampedErr{err, time.Now()}
+				p.setBuildErr(err)
 				p.dec()
 			}
 		}
 	}()
 }
 
+// Warm builds connections until the Pool has n of them, or its maximum if
+// that is lower, so that the first sends don't have to wait for them. The
+// connections are built concurrently, and Warm returns once they are ready,
+// with the first error that occurred building them.
+func (p *Pool) Warm(n int) error {
+	select {
+	case <-p.closing:
+		return ErrClosed
+	default:
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, p.max)
+	for p.incTo(n) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := p.build()
+			if err != nil {
+				p.dec()
+				errs <- err
+				return
+			}
+			p.clients <- c
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		p.setBuildErr(err)
+		return err
+	}
+	return nil
+}
+
 func startTLS(c *client, t *tls.Config) (bool, error) {
 	if ok, _ := c.Extension("STARTTLS"); !ok {
 		return false, nil
@@ -204,60 +484,106 @@ func addAuth(c *client, auth smtp.Auth) (bool, error) {
 	return true, nil
 }
 
-func (p *Pool) build() (*client, error) {
-	cl, err := smtp.Dial(p.addr)
+// dial connects to the server and greets it, with the hello hostname if one
+// was set. The connection's deadline is left set to the dial timeout, or ctx's
+// deadline if that is sooner, for the rest of the handshake.
+func (p *Pool) dial(ctx context.Context) (*client, error) {
+	d := net.Dialer{Timeout: p.dialTimeout}
+	conn, err := d.DialContext(ctx, "tcp", p.addr)
+	if err != nil {
+		return nil, err
+	}
+	// Bound the whole handshake, not just the connect.
+	deadline, ok := ctx.Deadline()
+	if p.dialTimeout > 0 && (!ok || time.Now().Add(p.dialTimeout).Before(deadline)) {
+		deadline = time.Now().Add(p.dialTimeout)
+	}
+	conn.SetDeadline(deadline)
+	host, _, _ := net.SplitHostPort(p.addr)
+	cl, err := smtp.NewClient(conn, host)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
+	if p.trace != nil {
+		traceClient(cl, p.trace)
+	}
+
 	// Is there a custom hostname for doing a HELLO with the SMTP server?
 	if p.helloHostname != "" {
-		cl.Hello(p.helloHostname)
+		if err := cl.Hello(p.helloHostname); err != nil {
+			cl.Close()
+			return nil, err
+		}
 	}
+	return &client{cl, conn, 0}, nil
+}
 
-	c := &client{cl, 0}
+func (p *Pool) build() (*client, error) {
+	c, err := p.dial(context.Background())
+	if err != nil {
+		return nil, err
+	}
 
-	if _, err := startTLS(c, p.tlsConfig); err != nil {
+	if ok, err := startTLS(c, p.tlsConfig); err != nil {
 		c.Close()
 		return nil, err
+	} else if ok && p.trace != nil {
+		traceClient(c.Client, p.trace)
 	}
 
-	if p.auth != nil {
-		if _, err := addAuth(c, p.auth); err != nil {
+	if p.authFunc != nil {
+		auth, err := p.authFunc()
+		if err != nil {
 			c.Close()
 			return nil, err
 		}
+		if auth != nil {
+			if _, err := addAuth(c, auth); err != nil {
+				c.Close()
+				return nil, err
+			}
+		}
 	}
 
+	c.conn.SetDeadline(time.Time{})
 	return c, nil
 }
 
 func (p *Pool) maybeReplace(err error, c *client) {
-	if err == nil {
-		c.failCount = 0
+	if reusable(err, c) {
 		p.replace(c)
 		return
 	}
+	p.dec()
+	c.Close()
+}
+
+// reusable reports whether c can be used again after an operation on it
+// returned err, resetting it if necessary.
+func reusable(err error, c *client) bool {
+	if pe, ok := err.(*PartialSendError); ok {
+		err = pe.Err
+	}
+	if se, ok := err.(*SendError); ok {
+		err = se.Err
+	}
+	if err == nil {
+		c.failCount = 0
+		return true
+	}
 
 	c.failCount++
 	if c.failCount >= maxFails {
-		goto shutdown
+		return false
 	}
 
 	if !shouldReuse(err) {
-		goto shutdown
-	}
-
-	if err := c.Reset(); err != nil {
-		goto shutdown
+		return false
 	}
 
-	p.replace(c)
-	return
-
-shutdown:
-	p.dec()
-	c.Close()
+	return c.Reset() == nil
 }
 
 func (p *Pool) failedToGet(startTime time.Time) error {
@@ -267,63 +593,731 @@ func (p *Pool) failedToGet(startTime time.Time) error {
 	default:
 	}
 
-	if p.lastBuildErr != nil && startTime.Before(p.lastBuildErr.ts) {
-		return p.lastBuildErr.err
+	p.mut.Lock()
+	last := p.lastBuildErr
+	p.mut.Unlock()
+	if last != nil && startTime.Before(last.ts) {
+		return last.err
 	}
 
 	return ErrTimeout
 }
 
+func (p *Pool) setBuildErr(err error) {
+	p.mut.Lock()
+	p.lastBuildErr = &timestampedErr{err, time.Now()}
+	p.mut.Unlock()
+}
+
 // Send sends an email via a connection pulled from the Pool. The timeout may
 // be <0 to indicate no timeout. Otherwise reaching the timeout will produce
 // and error building a connection that occurred while we were waiting, or
-// otherwise ErrTimeout.
-func (p *Pool) Send(e *Email, timeout time.Duration) (err error) {
+// otherwise ErrTimeout. The timeout also bounds the SMTP conversation once a
+// connection has been acquired; if that runs over, ErrSendTimeout is returned.
+func (p *Pool) Send(e *Email, timeout time.Duration) error {
+	_, err := p.send(e, timeout, nil)
+	return err
+}
+
+// SendIdempotent is like Send, but if a message with the same key, such as a
+// job or Message-Id, was sent successfully within the window set with
+// SetIdempotencyCache, it returns nil without sending e again. This makes it
+// safe to retry a send which may have succeeded. If a send with the same key
+// is in progress, SendIdempotent waits for it and returns its result. Failed
+// sends are not remembered. Without a cache, or with an empty key, it behaves
+// exactly like Send.
+func (p *Pool) SendIdempotent(key string, e *Email, timeout time.Duration) error {
+	if p.sentKeys == nil || key == "" {
+		return p.Send(e, timeout)
+	}
+	return p.sentKeys.do(key, func() error {
+		return p.Send(e, timeout)
+	})
+}
+
+// MailOptions are optional parameters of the SMTP MAIL command. Each one is
+// only sent if the server advertises the matching extension; otherwise the
+// send fails before the transaction is started, except for EnvelopeID, which
+// is only informational and is left out.
+type MailOptions struct {
+	Size       int    // Declared message size in bytes, SIZE= (RFC 1870); 0 to omit
+	UTF8       bool   // Require SMTPUTF8 for internationalized addresses (RFC 6531)
+	RequireTLS bool   // Require TLS on every hop of the delivery, REQUIRETLS (RFC 8689)
+	Auth       string // Identity the message is submitted on behalf of, AUTH= (RFC 4954); "<>" if unknown
+	EnvelopeID string // Identifier returned in delivery status notifications, ENVID= (RFC 3461); omitted without DSN
+}
+
+// SendWithOptions is like Send, but passes opts as parameters of the MAIL
+// command. A nil opts behaves exactly like Send.
+func (p *Pool) SendWithOptions(e *Email, timeout time.Duration, opts *MailOptions) error {
+	_, err := p.send(e, timeout, opts)
+	return err
+}
+
+// SendInfo describes the connection a message was sent over.
+type SendInfo struct {
+	TLS        bool   // Whether the connection was encrypted with TLS
+	TLSVersion uint16 // The negotiated TLS version, e.g. tls.VersionTLS13
+	Cipher     uint16 // The negotiated cipher suite, e.g. tls.TLS_AES_128_GCM_SHA256
+}
+
+// SendWithInfo is like Send, but also reports whether the message was sent
+// over a TLS connection, and which version and cipher suite were negotiated.
+func (p *Pool) SendWithInfo(e *Email, timeout time.Duration) (SendInfo, error) {
+	return p.send(e, timeout, nil)
+}
+
+func (p *Pool) send(e *Email, timeout time.Duration, opts *MailOptions) (info SendInfo, err error) {
 	start := time.Now()
 	c := p.get(timeout)
 	if c == nil {
-		return p.failedToGet(start)
+		return info, p.failedToGet(start)
 	}
+	info, err = p.sendOn(c, start, e, timeout, opts)
+	p.maybeReplace(err, c)
+	return
+}
 
+// sendOn sends e over c, which has been acquired from the Pool. If timeout
+// is > 0, the conversation must complete within timeout of start.
+func (p *Pool) sendOn(c *client, start time.Time, e *Email, timeout time.Duration, opts *MailOptions) (info SendInfo, err error) {
 	defer func() {
-		p.maybeReplace(err, c)
+		err = sendTimeoutErr(err)
 	}()
+	sendStart := time.Now()
+	defer func() {
+		if err == nil {
+			p.latency.observe(time.Since(sendStart))
+		}
+	}()
+
+	if timeout > 0 {
+		c.conn.SetDeadline(start.Add(timeout))
+		defer c.conn.SetDeadline(time.Time{})
+	}
+
+	if state, ok := c.TLSConnectionState(); ok {
+		info = SendInfo{TLS: true, TLSVersion: state.Version, Cipher: state.CipherSuite}
+	}
 
 	recipients, err := addressLists(e.To, e.Cc, e.Bcc)
 	if err != nil {
 		return
 	}
 
+	if e.From == "" && p.defaultFrom != "" {
+		e = e.Clone()
+		e.From = p.defaultFrom
+	}
+
+	if len(p.footerText) > 0 || len(p.footerHTML) > 0 {
+		e = e.WithFooter(p.footerText, p.footerHTML)
+	}
+
+	// Send attachments unencoded if the server can accept binary content,
+	// unless an encoding other than the default was asked for.
+	binary := supportsBinaryMIME(c) && len(e.Attachments) > 0
+	if binary {
+		e = e.Clone()
+		for _, a := range e.Attachments {
+			if cte := a.Header.Get("Content-Transfer-Encoding"); cte == "" || a.defaultEncoding && cte == "base64" {
+				a.Header.Set("Content-Transfer-Encoding", "binary")
+			}
+		}
+	}
+
 	msg, err := e.Bytes()
 	if err != nil {
 		return
 	}
 
-	from, err := emailOnly(e.From)
+	from, err := e.parseSender()
 	if err != nil {
 		return
 	}
-	if err = c.Mail(from); err != nil {
+
+	if e.RequireTLS || e.EnvelopeID != "" {
+		var o MailOptions
+		if opts != nil {
+			o = *opts
+		}
+		o.RequireTLS = o.RequireTLS || e.RequireTLS
+		if o.EnvelopeID == "" {
+			o.EnvelopeID = e.EnvelopeID
+		}
+		opts = &o
+	}
+	mailCmd, err := mailCommand(c.Client, from, opts, binary)
+	if err != nil {
 		return
 	}
 
+	max := p.maxRecipientsFor(c)
+	var delivered, failed, notAttempted []string
+	var firstErr error
+	for sent := 0; sent < len(recipients); {
+		batch := recipients[sent:]
+		if max > 0 && len(batch) > max {
+			batch = batch[:max]
+		}
+		sent += len(batch)
+		txErr := sendTransaction(c, mailCmd, batch, msg, binary)
+		if txErr == nil {
+			delivered = append(delivered, batch...)
+			continue
+		}
+		if pe, ok := txErr.(*PartialSendError); ok {
+			delivered = append(delivered, pe.Delivered...)
+			failed = append(failed, pe.Failed...)
+			txErr = pe.Err
+		} else {
+			failed = append(failed, batch...)
+		}
+		if firstErr == nil {
+			firstErr = txErr
+		}
+		// The remaining recipients get their own transactions as long as
+		// the server only refused this one.
+		if sent < len(recipients) && (!isRejection(txErr) || c.Reset() != nil) {
+			notAttempted = recipients[sent:]
+			break
+		}
+	}
+	if err = firstErr; err != nil && (len(delivered) > 0 || len(notAttempted) > 0) {
+		err = &PartialSendError{Delivered: delivered, Failed: failed, NotAttempted: notAttempted, Err: err, origins: recipientOrigins(e)}
+	}
+	return
+}
+
+// isRejection reports whether err is the server refusing a command or a
+// message, after which the connection can still be used.
+func isRejection(err error) bool {
+	if se, ok := err.(*SendError); ok {
+		return se.Rejected()
+	}
+	_, ok := err.(*textproto.Error)
+	return ok
+}
+
+// sendTimeoutErr replaces an error caused by the connection deadline passing
+// with ErrSendTimeout.
+func sendTimeoutErr(err error) error {
+	if pe, ok := err.(*PartialSendError); ok {
+		pe.Err = sendTimeoutErr(pe.Err)
+		return pe
+	}
+	if se, ok := err.(*SendError); ok {
+		se.Err = sendTimeoutErr(se.Err)
+		return se
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return ErrSendTimeout
+	}
+	return err
+}
+
+// maxRecipientsFor returns the maximum number of recipients per transaction
+// on c, or 0 if there is no limit.
+func (p *Pool) maxRecipientsFor(c *client) int {
+	max := p.maxRecipients
+	if ok, params := c.Extension("LIMITS"); ok {
+		for _, param := range strings.Fields(params) {
+			if !strings.HasPrefix(strings.ToUpper(param), "RCPTMAX=") {
+				continue
+			}
+			if n, err := strconv.Atoi(param[len("RCPTMAX="):]); err == nil && n > 0 && (max <= 0 || n < max) {
+				max = n
+			}
+		}
+	}
+	return max
+}
+
+// sendTransaction sends msg to the recipients in a single SMTP transaction,
+// pipelining the commands if the server supports it. Binary messages are sent
+// with BDAT. Whether pipelined or not, if only some of the recipients are
+// rejected, the message is still sent to the others and a *PartialSendError
+// is returned; if all of them are, the first rejection is.
+func sendTransaction(c *client, mailCmd string, recipients []string, msg []byte, binary bool) error {
+	if binary {
+		return sendBinary(c, mailCmd, recipients, msg)
+	}
+	if ok, _ := c.Extension("PIPELINING"); ok {
+		return sendPipelined(c, mailCmd, recipients, msg)
+	}
+
+	if err := textCmd(c.Text, 250, "%s", mailCmd); err != nil {
+		return err
+	}
+	accepted, rejected, rcptErr, err := sendRcpts(c.Rcpt, recipients)
+	if err != nil {
+		return err
+	}
+	if len(accepted) == 0 {
+		return rcptErr
+	}
+	if err := textCmd(c.Text, 354, "DATA"); err != nil {
+		return err
+	}
+	if err := writeData(c.Text, msg); err != nil {
+		return err
+	}
+	if rcptErr != nil {
+		return &PartialSendError{Delivered: accepted, Failed: rejected, Err: rcptErr}
+	}
+	return nil
+}
+
+// sendRcpts sends a RCPT command for each of the recipients with rcpt, one at
+// a time. Like a pipelined transaction, it carries on past recipients which
+// the server rejects, returning the first rejection as rcptErr; any other
+// error ends the transaction and is returned as err.
+func sendRcpts(rcpt func(string) error, recipients []string) (accepted, rejected []string, rcptErr, err error) {
 	for _, recip := range recipients {
-		if err = c.Rcpt(recip); err != nil {
-			return
+		if err := rcpt(recip); err != nil {
+			if _, ok := err.(*textproto.Error); !ok {
+				return nil, nil, nil, err
+			}
+			if rcptErr == nil {
+				rcptErr = err
+			}
+			rejected = append(rejected, recip)
+			continue
 		}
+		accepted = append(accepted, recip)
 	}
+	return accepted, rejected, rcptErr, nil
+}
 
-	w, err := c.Data()
+// writeData sends msg once the server has accepted the DATA command, and reads
+// the server's response to it. If either fails, a *SendError is returned.
+func writeData(text *textproto.Conn, msg []byte) error {
+	w := text.DotWriter()
+	n, err := w.Write(msg)
+	if err == nil {
+		err = w.Close()
+	}
 	if err != nil {
-		return
+		return &SendError{Written: n, Size: len(msg), Err: err}
+	}
+	if _, _, err := text.ReadResponse(250); err != nil {
+		return &SendError{Written: n, Size: len(msg), Complete: true, Err: err}
 	}
-	if _, err = w.Write(msg); err != nil {
+	return nil
+}
+
+// WithClient runs fn with a connection from the Pool, for issuing commands
+// which the package doesn't support, such as provider-specific extensions.
+// The connection is already authenticated and using TLS if configured, and
+// is reset with RSET and returned to the Pool afterwards, or replaced if fn
+// returns an error that indicates it is unusable. fn must not Quit or Close
+// the client.
+//
+// WithClient waits as long as necessary for a connection.
+func (p *Pool) WithClient(fn func(c *smtp.Client) error) (err error) {
+	start := time.Now()
+	c := p.get(-1)
+	if c == nil {
+		return p.failedToGet(start)
+	}
+
+	defer func() {
+		if err == nil {
+			// fn may have left a transaction open.
+			p.maybeReplace(c.Reset(), c)
+			return
+		}
+		p.maybeReplace(err, c)
+	}()
+
+	return fn(c.Client)
+}
+
+// Conn is a connection acquired from a Pool with Acquire, which can be used to
+// send several messages before it is released.
+type Conn struct {
+	p *Pool
+	c *client
+}
+
+var errConnReleased = errors.New("connection released or closed")
+
+// Acquire waits for a connection from the Pool until ctx is done, in the
+// order in which callers started waiting. This lets callers apply their own
+// backpressure, e.g. by giving up on a send rather than queueing behind a
+// busy Pool. The connection must be returned to the Pool with Release.
+func (p *Pool) Acquire(ctx context.Context) (*Conn, error) {
+	start := time.Now()
+	c := p.wait(nil, ctx.Done())
+	if c == nil {
+		if err := p.failedToGet(start); err != ErrTimeout {
+			return nil, err
+		}
+		return nil, ctx.Err()
+	}
+	return &Conn{p: p, c: c}, nil
+}
+
+// Send sends e over the connection, like Pool.Send. If the connection is found
+// to be unusable, it is closed and replaced in the Pool, and later calls
+// return an error.
+func (c *Conn) Send(e *Email, timeout time.Duration) error {
+	if c.c == nil {
+		return errConnReleased
+	}
+	_, err := c.p.sendOn(c.c, time.Now(), e, timeout, nil)
+	if !reusable(err, c.c) {
+		c.p.dec()
+		c.c.Close()
+		c.c = nil
+	}
+	return err
+}
+
+// Release returns the connection to the Pool. It may be called more than once.
+func (c *Conn) Release() {
+	if c.c == nil {
 		return
 	}
+	c.p.replace(c.c)
+	c.c = nil
+}
 
-	err = w.Close()
+// SendBatch sends a personalized copy of e to each of the recipients (see
+// Email.Personalize), using the given timeout for each send. The returned
+// slice holds the result of each send, in the same order as recipients.
+func (p *Pool) SendBatch(e *Email, recipients []Recipient, timeout time.Duration) []error {
+	errs := make([]error, len(recipients))
+	for i, r := range recipients {
+		errs[i] = p.Send(e.Personalize(r), timeout)
+	}
+	return errs
+}
 
-	return
+// SendIndividually sends a separate copy of e to each of its To, Cc and Bcc
+// recipients, in its own transaction and addressed only to that recipient
+// (see Email.Personalize), so that recipients can't see each other even in the
+// envelope. Each copy keeps the recipient in the field it was given in, so a
+// Cc recipient's copy has them in its Cc header, and a Bcc recipient's copy
+// has no To or Cc header at all. The timeout applies to each send.
+//
+// If some copies are sent but others fail, a *PartialSendError is returned
+// with the first error.
+func (p *Pool) SendIndividually(e *Email, timeout time.Duration) error {
+	var delivered, failed []string
+	var firstErr error
+	seen := make(map[string]bool)
+	for field, list := range [][]string{e.To, e.Cc, e.Bcc} {
+		for _, full := range list {
+			addr, err := emailOnly(full)
+			if err != nil {
+				return err
+			}
+			if seen[addr] {
+				continue
+			}
+			seen[addr] = true
+			c := e.Personalize(Recipient{Address: full})
+			switch field {
+			case 1:
+				c.To, c.Cc = nil, c.To
+			case 2:
+				c.To, c.Bcc = nil, c.To
+			}
+			if err := p.Send(c, timeout); err != nil {
+				failed = append(failed, addr)
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			delivered = append(delivered, addr)
+		}
+	}
+	if len(seen) == 0 {
+		return errors.New("Must specify at least one From address and one To address")
+	}
+	if firstErr != nil && len(delivered) > 0 {
+		return &PartialSendError{Delivered: delivered, Failed: failed, Err: firstErr, origins: recipientOrigins(e)}
+	}
+	return firstErr
+}
+
+// VerifyRecipient checks whether the server would accept a message from from
+// to to, by issuing MAIL and RCPT commands and then resetting the transaction
+// with RSET, without sending any content. It returns nil if the recipient
+// was accepted, or otherwise the server's response as a *textproto.Error,
+// whose Code is 5xx if the recipient was rejected permanently and 4xx if it
+// was rejected temporarily, e.g. by greylisting. The timeout behaves as for
+// Send.
+//
+// Use this sparingly. Many servers accept every recipient at this stage, and
+// only bounce messages later, so an accepted recipient may still not exist.
+// Worse, servers and blocklists treat repeated probing without delivery as
+// directory harvesting, and may throttle, reject or blocklist the sender or
+// its IP address, harming the deliverability of real messages.
+func (p *Pool) VerifyRecipient(from, to string, timeout time.Duration) (err error) {
+	fromAddr, err := emailOnly(from)
+	if err != nil {
+		return err
+	}
+	toAddr, err := emailOnly(to)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	c := p.get(timeout)
+	if c == nil {
+		return p.failedToGet(start)
+	}
+	if timeout > 0 {
+		c.conn.SetDeadline(start.Add(timeout))
+		defer c.conn.SetDeadline(time.Time{})
+	}
+
+	mailCmd, err := mailCommand(c.Client, fromAddr, nil, false)
+	if err == nil {
+		err = textCmd(c.Text, 250, "%s", mailCmd)
+	}
+	if err == nil {
+		err = c.Rcpt(toAddr)
+	}
+	// A rejection is the answer rather than a failure of the connection,
+	// so it doesn't count towards replacing it.
+	if _, ok := err.(*textproto.Error); ok || err == nil {
+		if resetErr := c.Reset(); resetErr != nil {
+			p.dec()
+			c.Close()
+			return sendTimeoutErr(resetErr)
+		}
+		p.replace(c)
+		return err
+	}
+	p.maybeReplace(err, c)
+	return sendTimeoutErr(err)
+}
+
+// supportsBinaryMIME reports whether binary content may be sent on c (RFC 3030).
+func supportsBinaryMIME(c *client) bool {
+	binary, _ := c.Extension("BINARYMIME")
+	chunking, _ := c.Extension("CHUNKING")
+	return binary && chunking
+}
+
+// bdatChunkLen is the length of the BDAT chunks sent by sendBinary.
+const bdatChunkLen = 1 << 20
+
+// sendBinary sends msg, which may contain binary content, to the recipients in
+// a single SMTP transaction using BODY=BINARYMIME and BDAT chunks. Rejected
+// recipients are handled as by sendTransaction.
+func sendBinary(c *client, mailCmd string, recipients []string, msg []byte) error {
+	if err := textCmd(c.Text, 250, "%s", mailCmd); err != nil {
+		return err
+	}
+	accepted, rejected, rcptErr, err := sendRcpts(func(recip string) error {
+		return textCmd(c.Text, 25, "RCPT TO:<%s>", recip)
+	}, recipients)
+	if err != nil {
+		return err
+	}
+	if len(accepted) == 0 {
+		return rcptErr
+	}
+	cr := NewChunkedReader(bytes.NewReader(msg), bdatChunkLen)
+	written := 0
+	for {
+		chunk, err := cr.ReadChunk()
+		if err != nil && err != io.EOF {
+			return err
+		}
+		last := err == io.EOF
+		sent, err := sendChunk(c.Text, chunk, last)
+		if sent {
+			written += len(chunk)
+		}
+		if err != nil {
+			return &SendError{Written: written, Size: len(msg), Complete: sent && last, Err: err}
+		}
+		if last && rcptErr != nil {
+			return &PartialSendError{Delivered: accepted, Failed: rejected, Err: rcptErr}
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// sendChunk sends chunk with a BDAT command and reads the response, reporting
+// whether the chunk was sent.
+func sendChunk(text *textproto.Conn, chunk []byte, last bool) (bool, error) {
+	id := text.Next()
+	text.StartRequest(id)
+	if last {
+		fmt.Fprintf(text.W, "BDAT %d LAST\r\n", len(chunk))
+	} else {
+		fmt.Fprintf(text.W, "BDAT %d\r\n", len(chunk))
+	}
+	text.W.Write(chunk)
+	err := text.W.Flush()
+	text.EndRequest(id)
+	if err != nil {
+		return false, err
+	}
+	text.StartResponse(id)
+	defer text.EndResponse(id)
+	_, _, err = text.ReadResponse(250)
+	return true, err
+}
+
+// mailCommand builds the MAIL command for a transaction from the sender and
+// opts, checking each option against the extensions advertised by c. The body
+// is declared as BINARYMIME if binary is set, or 8BITMIME when supported.
+func mailCommand(c *smtp.Client, from string, opts *MailOptions, binary bool) (string, error) {
+	if opts == nil {
+		opts = &MailOptions{}
+	}
+	cmd := "MAIL FROM:<" + from + ">"
+	if binary {
+		cmd += " BODY=BINARYMIME"
+	} else if ok, _ := c.Extension("8BITMIME"); ok {
+		cmd += " BODY=8BITMIME"
+	}
+	if opts.Size > 0 {
+		ok, param := c.Extension("SIZE")
+		if !ok {
+			return "", errors.New("Server does not support the SIZE extension")
+		}
+		if max, err := strconv.Atoi(param); err == nil && max > 0 && opts.Size > max {
+			return "", fmt.Errorf("Message size %d exceeds the server limit of %d bytes", opts.Size, max)
+		}
+		cmd += " SIZE=" + strconv.Itoa(opts.Size)
+	}
+	if ok, _ := c.Extension("SMTPUTF8"); ok {
+		cmd += " SMTPUTF8"
+	} else if opts.UTF8 {
+		return "", errors.New("Server does not support the SMTPUTF8 extension")
+	}
+	if opts.RequireTLS {
+		if _, ok := c.TLSConnectionState(); !ok {
+			return "", errors.New("REQUIRETLS can only be used over a TLS connection")
+		}
+		if ok, _ := c.Extension("REQUIRETLS"); !ok {
+			return "", errors.New("Server does not support the REQUIRETLS extension")
+		}
+		cmd += " REQUIRETLS"
+	}
+	if opts.Auth != "" {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return "", errors.New("Server does not support the AUTH extension")
+		}
+		cmd += " AUTH=" + xtext(opts.Auth)
+	}
+	if opts.EnvelopeID != "" {
+		if ok, _ := c.Extension("DSN"); ok {
+			cmd += " ENVID=" + xtext(opts.EnvelopeID)
+		}
+	}
+	return cmd, nil
+}
+
+// xtext encodes s as an ESMTP parameter value (RFC 3461, section 4). The
+// special value "<>" is passed through unchanged.
+func xtext(s string) string {
+	if s == "<>" {
+		return s
+	}
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < '!' || c > '~' || c == '+' || c == '=' {
+			fmt.Fprintf(&b, "+%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// textCmd sends a command and reads its response, expecting expectCode.
+func textCmd(text *textproto.Conn, expectCode int, format string, args ...interface{}) error {
+	id, err := text.Cmd(format, args...)
+	if err != nil {
+		return err
+	}
+	text.StartResponse(id)
+	defer text.EndResponse(id)
+	_, _, err = text.ReadResponse(expectCode)
+	return err
+}
+
+// sendPipelined sends msg to the recipients in a single SMTP transaction,
+// writing the MAIL, RCPT and DATA commands together before reading their
+// responses (RFC 2920). If only some of the recipients are rejected, the
+// message is still sent to the others and a *PartialSendError is returned.
+func sendPipelined(c *client, mailCmd string, recipients []string, msg []byte) error {
+	text := c.Text
+	text.W.WriteString(mailCmd + "\r\n")
+	for _, recip := range recipients {
+		text.W.WriteString("RCPT TO:<" + recip + ">\r\n")
+	}
+	text.W.WriteString("DATA\r\n")
+	if err := text.W.Flush(); err != nil {
+		return err
+	}
+
+	// Every response must be read to keep the conversation in sync, even
+	// after a failure.
+	_, _, mailErr := text.ReadResponse(250)
+	var accepted, rejected []string
+	var rcptErr error
+	for _, recip := range recipients {
+		if _, _, err := text.ReadResponse(25); err != nil {
+			if _, ok := err.(*textproto.Error); !ok {
+				return err
+			}
+			if rcptErr == nil {
+				rcptErr = err
+			}
+			rejected = append(rejected, recip)
+			continue
+		}
+		accepted = append(accepted, recip)
+	}
+	if _, _, err := text.ReadResponse(354); err != nil {
+		switch {
+		case mailErr != nil:
+			return mailErr
+		case rcptErr != nil:
+			return rcptErr
+		}
+		return err
+	}
+
+	// A server may answer DATA even though there is nothing to deliver to,
+	// in which case the message is left out (RFC 2920, section 3.1).
+	if mailErr != nil || (rcptErr != nil && len(accepted) == 0) {
+		text.W.WriteString(".\r\n")
+		if err := text.W.Flush(); err != nil {
+			return err
+		}
+		if _, _, err := text.ReadResponse(0); err != nil {
+			if _, ok := err.(*textproto.Error); !ok {
+				return err
+			}
+		}
+		if mailErr != nil {
+			return mailErr
+		}
+		return rcptErr
+	}
+	if err := writeData(text, msg); err != nil {
+		return err
+	}
+	if rcptErr != nil {
+		return &PartialSendError{Delivered: accepted, Failed: rejected, Err: rcptErr}
+	}
+	return nil
 }
 
 func emailOnly(full string) (string, error) {
@@ -334,6 +1328,8 @@ func emailOnly(full string) (string, error) {
 	return addr.Address, nil
 }
 
+// addressLists returns the bare addresses of lists, in the order given, which
+// is the order of the RCPT commands when e.To, e.Cc and e.Bcc are passed.
 func addressLists(lists ...[]string) ([]string, error) {
 	length := 0
 	for _, lst := range lists {
@@ -354,14 +1350,45 @@ func addressLists(lists ...[]string) ([]string, error) {
 	return combined, nil
 }
 
+// recipientOrigins maps the recipient addresses of e to the field, "To", "Cc"
+// or "Bcc", in which they were first given.
+func recipientOrigins(e *Email) map[string]string {
+	origins := make(map[string]string)
+	for _, f := range []struct {
+		name string
+		list []string
+	}{{"To", e.To}, {"Cc", e.Cc}, {"Bcc", e.Bcc}} {
+		for _, full := range f.list {
+			if addr, err := emailOnly(full); err == nil {
+				if _, ok := origins[addr]; !ok {
+					origins[addr] = f.name
+				}
+			}
+		}
+	}
+	return origins
+}
+
 // Close immediately changes the pool's state so no new connections will be
 // created, then gets and closes the existing ones as they become available.
 func (p *Pool) Close() {
 	close(p.closing)
 
-	for p.created > 0 {
-		c := <-p.clients
-		c.Quit()
-		p.dec()
+	for {
+		p.mut.Lock()
+		created := p.created
+		p.mut.Unlock()
+		if created == 0 {
+			return
+		}
+		select {
+		case c := <-p.clients:
+			c.Quit()
+			p.dec()
+		case <-p.rebuild:
+			// A connection failed to build, and won't arrive.
+		case <-time.After(50 * time.Millisecond):
+			// In case it failed before we started waiting.
+		}
 	}
 }
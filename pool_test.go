@@ -0,0 +1,979 @@
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTx is a transaction received by a fakeServer.
+type fakeTx struct {
+	from string
+	rcpt []string
+	data string
+}
+
+// fakeServer is an in-memory SMTP server which advertises ext after EHLO. It
+// rejects recipients containing "bad" with 550 and those containing "grey"
+// with 450, stalls before answering DATA for recipients containing "stall",
+// rejects the content of messages to recipients containing "spam" with 554,
+// and drops the connection on recipients containing "drop". Like a real
+// server, it refuses a MAIL command inside a transaction, and it rejects
+// senders containing "bad".
+type fakeServer struct {
+	ln  net.Listener
+	ext []string
+
+	mu       sync.Mutex    // guards the fields below
+	stall    time.Duration // how long to stall for "stall" recipients
+	dropQuit bool          // close connections on QUIT without a reply
+	lax      bool          // answer DATA with 354 even without a valid transaction
+	conns    int
+	cmds     []string
+	txs      []fakeTx
+}
+
+func newFakeServer(t *testing.T, ext ...string) *fakeServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{ln: ln, ext: ext, stall: 2 * time.Second}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns++
+			s.mu.Unlock()
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *fakeServer) addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *fakeServer) Close() {
+	s.ln.Close()
+}
+
+// commands returns the commands received so far.
+func (s *fakeServer) commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.cmds...)
+}
+
+// transactions returns the transactions received so far.
+func (s *fakeServer) transactions() []fakeTx {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]fakeTx(nil), s.txs...)
+}
+
+func (s *fakeServer) serve(c net.Conn) {
+	defer c.Close()
+	s.mu.Lock()
+	stall, dropQuit, lax := s.stall, s.dropQuit, s.lax
+	s.mu.Unlock()
+	r := bufio.NewReader(c)
+	w := func(l string) { c.Write([]byte(l + "\r\n")) }
+	w("220 fake ESMTP")
+	var tx *fakeTx
+	finish := func(reply string) {
+		if !strings.Contains(strings.Join(tx.rcpt, ","), "spam") {
+			s.mu.Lock()
+			s.txs = append(s.txs, *tx)
+			s.mu.Unlock()
+		} else {
+			reply = "554 5.7.1 Message rejected"
+		}
+		tx = nil
+		w(reply)
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		s.mu.Lock()
+		s.cmds = append(s.cmds, line)
+		s.mu.Unlock()
+		up := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(up, "EHLO"):
+			lines := append([]string{"fake"}, s.ext...)
+			for i, l := range lines {
+				if i == len(lines)-1 {
+					w("250 " + l)
+				} else {
+					w("250-" + l)
+				}
+			}
+		case strings.HasPrefix(up, "HELO"):
+			w("250 fake")
+		case strings.HasPrefix(up, "AUTH"):
+			w("235 2.7.0 Authentication successful")
+		case strings.HasPrefix(up, "MAIL FROM:"):
+			if tx != nil {
+				w("503 5.5.1 Nested MAIL command")
+				continue
+			}
+			if strings.Contains(line, "bad") {
+				w("550 5.1.8 Sender rejected")
+				continue
+			}
+			tx = &fakeTx{from: line[len("MAIL FROM:"):]}
+			w("250 2.1.0 Ok")
+		case strings.HasPrefix(up, "RCPT TO:"):
+			switch {
+			case tx == nil:
+				w("503 5.5.1 Need MAIL command")
+			case strings.Contains(line, "drop"):
+				return
+			case strings.Contains(line, "grey"):
+				w("450 4.2.0 Try again later")
+			case strings.Contains(line, "bad"):
+				w("550 5.1.1 No such user")
+			default:
+				tx.rcpt = append(tx.rcpt, line[len("RCPT TO:"):])
+				w("250 2.1.5 Ok")
+			}
+		case up == "DATA" && lax && (tx == nil || len(tx.rcpt) == 0):
+			// Like some broken servers, accept the data of a transaction
+			// which can't be delivered. The lines are recorded as commands.
+			w("354 Go ahead")
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				s.mu.Lock()
+				s.cmds = append(s.cmds, strings.TrimRight(l, "\r\n"))
+				s.mu.Unlock()
+				if l == ".\r\n" {
+					break
+				}
+			}
+			tx = nil
+			w("554 5.5.1 No valid recipients")
+		case up == "DATA":
+			if tx == nil || len(tx.rcpt) == 0 {
+				w("554 5.5.1 No valid recipients")
+				continue
+			}
+			if strings.Contains(strings.Join(tx.rcpt, ","), "stall") {
+				time.Sleep(stall)
+			}
+			w("354 Go ahead")
+			var b bytes.Buffer
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				b.WriteString(l)
+			}
+			tx.data = b.String()
+			finish("250 2.0.0 Queued")
+		case strings.HasPrefix(up, "BDAT "):
+			var n int
+			fmt.Sscanf(line[len("BDAT "):], "%d", &n)
+			buf := make([]byte, n)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return
+			}
+			if tx == nil {
+				w("503 5.5.1 Need MAIL command")
+				continue
+			}
+			tx.data += string(buf)
+			if strings.HasSuffix(up, " LAST") {
+				finish("250 2.0.0 Queued")
+			} else {
+				w("250 2.0.0 Chunk received")
+			}
+		case up == "RSET":
+			tx = nil
+			w("250 2.0.0 Ok")
+		case up == "NOOP":
+			w("250 2.0.0 Ok")
+		case up == "QUIT":
+			if !dropQuit {
+				w("221 2.0.0 Bye")
+			}
+			return
+		default:
+			w("502 5.5.2 Command not recognized")
+		}
+	}
+}
+
+func TestPoolRejectedRecipientsAcrossBatches(t *testing.T) {
+	for _, ext := range [][]string{nil, {"PIPELINING"}, {"CHUNKING", "BINARYMIME"}} {
+		s := newFakeServer(t, ext...)
+		p, err := NewPool(s.addr(), 1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.SetMaxRecipientsPerMessage(2)
+		e := NewEmail()
+		e.From = "sender@example.org"
+		e.To = []string{"bad1@example.com", "bad2@example.com", "c@example.com", "d@example.com", "bad3@example.com", "e@example.com"}
+		e.Text = []byte("Hello")
+		if len(ext) > 1 {
+			e.Attach(bytes.NewReader([]byte{0, 1, 2}), "f.bin", "application/octet-stream")
+		}
+		err = p.Send(e, 5*time.Second)
+		pe, ok := err.(*PartialSendError)
+		if !ok {
+			t.Fatalf("%v: expected a *PartialSendError, got %#v", ext, err)
+		}
+		if want := []string{"c@example.com", "d@example.com", "e@example.com"}; !reflect.DeepEqual(pe.Delivered, want) {
+			t.Errorf("%v: Delivered = %q, want %q", ext, pe.Delivered, want)
+		}
+		if want := []string{"bad1@example.com", "bad2@example.com", "bad3@example.com"}; !reflect.DeepEqual(pe.Failed, want) {
+			t.Errorf("%v: Failed = %q, want %q", ext, pe.Failed, want)
+		}
+		if txs := s.transactions(); len(txs) != 2 {
+			t.Errorf("%v: got %d transactions, want 2", ext, len(txs))
+		}
+		p.Close()
+		s.Close()
+	}
+}
+
+func TestPoolPipelinedDataWithoutTransaction(t *testing.T) {
+	s := newFakeServer(t, "PIPELINING")
+	defer s.Close()
+	s.mu.Lock()
+	s.lax = true
+	s.mu.Unlock()
+	p, err := NewPool(s.addr(), 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	for _, test := range []struct {
+		from, to string
+		code     int
+	}{
+		{"bad@example.org", "one@example.com", 550},
+		{"sender@example.org", "bad@example.com", 550},
+	} {
+		e := NewEmail()
+		e.From = test.from
+		e.To = []string{test.to}
+		e.Text = []byte("Hello")
+		err := p.Send(e, 5*time.Second)
+		if tpErr, ok := err.(*textproto.Error); !ok || tpErr.Code != test.code {
+			t.Errorf("From %s to %s: expected a %d error, got %#v", test.from, test.to, test.code, err)
+		}
+	}
+	cmds := s.commands()
+	for i, cmd := range cmds {
+		if cmd == "DATA" && (i+1 >= len(cmds) || cmds[i+1] != ".") {
+			t.Errorf("Message was sent without a transaction: %q", cmds)
+			break
+		}
+	}
+	if txs := s.transactions(); len(txs) != 0 {
+		t.Errorf("Got %d transactions, want none", len(txs))
+	}
+}
+
+func TestPoolNotAttemptedRecipients(t *testing.T) {
+	for _, ext := range [][]string{nil, {"PIPELINING"}} {
+		s := newFakeServer(t, ext...)
+		p, err := NewPool(s.addr(), 1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.SetMaxRecipientsPerMessage(2)
+		e := NewEmail()
+		e.From = "sender@example.org"
+		e.To = []string{"a@example.com", "b@example.com", "c@example.com", "drop@example.com", "e@example.com", "f@example.com"}
+		e.Text = []byte("Hello")
+		err = p.Send(e, 5*time.Second)
+		pe, ok := err.(*PartialSendError)
+		if !ok {
+			t.Fatalf("%v: expected a *PartialSendError, got %#v", ext, err)
+		}
+		if want := []string{"a@example.com", "b@example.com"}; !reflect.DeepEqual(pe.Delivered, want) {
+			t.Errorf("%v: Delivered = %q, want %q", ext, pe.Delivered, want)
+		}
+		if want := []string{"c@example.com", "drop@example.com"}; !reflect.DeepEqual(pe.Failed, want) {
+			t.Errorf("%v: Failed = %q, want %q", ext, pe.Failed, want)
+		}
+		if want := []string{"e@example.com", "f@example.com"}; !reflect.DeepEqual(pe.NotAttempted, want) {
+			t.Errorf("%v: NotAttempted = %q, want %q", ext, pe.NotAttempted, want)
+		}
+		if txs := s.transactions(); len(txs) != 1 {
+			t.Errorf("%v: got %d transactions, want 1", ext, len(txs))
+		}
+		p.Close()
+		s.Close()
+	}
+}
+
+func TestPoolBinaryAttachments(t *testing.T) {
+	s := newFakeServer(t, "CHUNKING", "BINARYMIME")
+	defer s.Close()
+	p, err := NewPool(s.addr(), 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	content := []byte("\x00\x01\x02\xff\r\n.\r\nbinary")
+	e := NewEmail()
+	e.From = "sender@example.org"
+	e.To = []string{"rcpt@example.com"}
+	e.Text = []byte("Hello")
+	e.Attach(bytes.NewReader(content), "f.bin", "application/octet-stream")
+	qp, _ := e.Attach(bytes.NewReader([]byte("text")), "f.txt", "text/plain")
+	qp.Header.Set("Content-Transfer-Encoding", "quoted-printable")
+	// Rendering the message fills in the default encoding of the attachment,
+	// which mustn't stop it being sent unencoded.
+	if _, err := e.Bytes(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := p.Send(e, 5*time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	txs := s.transactions()
+	if len(txs) != 2 {
+		t.Fatalf("Got %d transactions, want 2", len(txs))
+	}
+	for _, tx := range txs {
+		if !strings.Contains(tx.from, "BODY=BINARYMIME") {
+			t.Errorf("MAIL FROM:%s doesn't declare BODY=BINARYMIME", tx.from)
+		}
+		if !strings.Contains(tx.data, "Content-Transfer-Encoding: binary\r\n") || !strings.Contains(tx.data, string(content)) {
+			t.Errorf("Attachment not sent unencoded:\n%s", tx.data)
+		}
+		if !strings.Contains(tx.data, "Content-Transfer-Encoding: quoted-printable\r\n") {
+			t.Errorf("Explicit encoding of attachment was overridden:\n%s", tx.data)
+		}
+	}
+	if cte := e.Attachments[0].Header.Get("Content-Transfer-Encoding"); cte != "base64" {
+		t.Errorf("Sending changed the attachment's Content-Transfer-Encoding to %q", cte)
+	}
+}
+
+func TestPoolDialTimeout(t *testing.T) {
+	// A server which accepts connections but never greets them.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	p, err := NewPool(ln.Addr().String(), 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	p.SetDialTimeout(200 * time.Millisecond)
+	e := NewEmail()
+	e.From = "sender@example.org"
+	e.To = []string{"rcpt@example.com"}
+	e.Text = []byte("Hello")
+	start := time.Now()
+	err = p.Send(e, time.Second)
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() || err == ErrTimeout {
+		t.Errorf("Expected the connection to time out building, got %v", err)
+	}
+	if d := time.Since(start); d > 3*time.Second {
+		t.Errorf("Send took %v to fail with a timeout of 1s", d)
+	}
+}
+
+func TestPoolSendTimeout(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.Close()
+	p, err := NewPool(s.addr(), 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	e := NewEmail()
+	e.From = "sender@example.org"
+	e.To = []string{"stall@example.com"}
+	e.Text = []byte("Hello")
+	start := time.Now()
+	if err := p.Send(e, 300*time.Millisecond); err != ErrSendTimeout {
+		t.Errorf("Expected ErrSendTimeout, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Send took %v to time out after 300ms", d)
+	}
+	if txs := s.transactions(); len(txs) != 0 {
+		t.Errorf("Got %d transactions from a timed out send", len(txs))
+	}
+}
+
+func TestPoolAcquireFIFO(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.Close()
+	p, err := NewPool(s.addr(), 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	held, err := p.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Queue up waiters one at a time, so that their order is known.
+	const waiters = 20
+	var mu sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	for i := 0; i < waiters; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c, err := p.Acquire(ctx)
+			if err != nil {
+				t.Errorf("Waiter %d: %v", i, err)
+				return
+			}
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+			c.Release()
+		}(i)
+		for p.Waiting() < i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	held.Release()
+	wg.Wait()
+	for i, w := range order {
+		if w != i {
+			t.Fatalf("Waiters served in order %v", order)
+		}
+	}
+}
+
+func TestPoolAcquireStress(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.Close()
+	p, err := NewPool(s.addr(), 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	const workers, sends = 50, 10
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < sends; j++ {
+				c, err := p.Acquire(ctx)
+				if err != nil {
+					t.Errorf("Worker %d starved after %d sends: %v", i, j, err)
+					return
+				}
+				e := NewEmail()
+				e.From = "sender@example.org"
+				e.To = []string{fmt.Sprintf("rcpt%d@example.com", i)}
+				e.Text = []byte("Hello")
+				err = c.Send(e, 5*time.Second)
+				c.Release()
+				if err != nil {
+					t.Errorf("Worker %d: %v", i, err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if txs := s.transactions(); len(txs) != workers*sends {
+		t.Errorf("Got %d transactions, want %d", len(txs), workers*sends)
+	}
+}
+
+func TestPoolParallelBuilds(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// The server is slow to greet, like one which is far away, or does a
+	// DNS lookup on each client.
+	const delay = 300 * time.Millisecond
+	var mu sync.Mutex
+	greeting, maxGreeting := 0, 0
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				mu.Lock()
+				if greeting++; greeting > maxGreeting {
+					maxGreeting = greeting
+				}
+				mu.Unlock()
+				time.Sleep(delay)
+				mu.Lock()
+				greeting--
+				mu.Unlock()
+				serveSMTP(conn, nil)
+			}()
+		}
+	}()
+
+	const senders = 4
+	p, err := NewPool(ln.Addr().String(), senders, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// Each sender holds on to its connection, so none can be reused.
+	start := time.Now()
+	clients := make(chan *Conn, senders)
+	for i := 0; i < senders; i++ {
+		go func() {
+			c, err := p.Acquire(ctx)
+			if err != nil {
+				t.Error(err)
+			}
+			clients <- c
+		}()
+	}
+	for i := 0; i < senders; i++ {
+		if c := <-clients; c != nil {
+			defer c.Release()
+		}
+	}
+	if d := time.Since(start); d >= 2*delay {
+		t.Errorf("Acquiring %d connections took %v, as if they were built one at a time", senders, d)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if maxGreeting != senders {
+		t.Errorf("Only %d of %d connections were built at once", maxGreeting, senders)
+	}
+}
+
+func TestPoolWarm(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.Close()
+	p, err := NewPool(s.addr(), 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// Concurrent calls mustn't build more connections than asked for.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := p.Warm(2); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := len(p.clients); n != 2 {
+		t.Errorf("Got %d ready connections after Warm(2), want 2", n)
+	}
+	// Nor more than the maximum.
+	if err := p.Warm(5); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(p.clients); n != 3 {
+		t.Errorf("Got %d ready connections after Warm(5), want the maximum of 3", n)
+	}
+	s.mu.Lock()
+	conns := s.conns
+	s.mu.Unlock()
+	if conns != 3 {
+		t.Errorf("Server got %d connections, want 3", conns)
+	}
+}
+
+func TestPoolSendBatch(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.Close()
+	p, err := NewPool(s.addr(), 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	e := NewEmail()
+	e.From = "sender@example.org"
+	e.To = []string{"list@example.org"}
+	e.Text = []byte("Hello")
+	e.Headers.Set("X-Campaign", "spring")
+	unsubscribe := func(id string) string {
+		token := strings.Repeat(id, 64)
+		return "<mailto:unsubscribe@example.org?subject=" + token + ">, <https://example.org/unsubscribe?token=" + token + ">"
+	}
+	recipients := []Recipient{
+		{Address: "one@example.com", Headers: textproto.MIMEHeader{"X-Recipient-Id": {"1"}, "List-Unsubscribe": {unsubscribe("a")}}},
+		{Address: "two@example.com", Headers: textproto.MIMEHeader{"x-recipient-id": {"2"}, "list-unsubscribe": {unsubscribe("b")}}},
+		{Address: "bad@example.com", Headers: textproto.MIMEHeader{"X-Recipient-Id": {"3"}}},
+	}
+	errs := p.SendBatch(e, recipients, 5*time.Second)
+	if len(errs) != 3 || errs[0] != nil || errs[1] != nil || errs[2] == nil {
+		t.Fatalf("Incorrect errors: %v", errs)
+	}
+	txs := s.transactions()
+	if len(txs) != 2 {
+		t.Fatalf("Got %d transactions, want 2", len(txs))
+	}
+	for i, tx := range txs {
+		r := recipients[i]
+		if len(tx.rcpt) != 1 || tx.rcpt[0] != "<"+r.Address+">" {
+			t.Errorf("Transaction %d has recipients %q, want only %s", i, tx.rcpt, r.Address)
+		}
+		for _, line := range strings.Split(tx.data, "\r\n") {
+			if len(line) > 998 {
+				t.Errorf("Transaction %d has a line of %d characters", i, len(line))
+			}
+		}
+		msg, err := mail.ReadMessage(strings.NewReader(tx.data))
+		if err != nil {
+			t.Fatal("Could not parse sent message: ", err)
+		}
+		if got, want := msg.Header.Get("X-Recipient-Id"), fmt.Sprint(i+1); got != want {
+			t.Errorf("Incorrect X-Recipient-Id: %#q != %#q", got, want)
+		}
+		if got := msg.Header.Get("X-Campaign"); got != "spring" {
+			t.Errorf("Incorrect X-Campaign: %#q", got)
+		}
+		if got, want := msg.Header.Get("List-Unsubscribe"), unsubscribe([]string{"a", "b"}[i]); got != want {
+			t.Errorf("Incorrect List-Unsubscribe:\n%s\nwant:\n%s", got, want)
+		}
+		if !strings.Contains(tx.data, ",\r\n <https://example.org/unsubscribe") {
+			t.Errorf("List-Unsubscribe was not folded between its URIs:\n%s", tx.data)
+		}
+	}
+	if _, ok := e.Headers["X-Recipient-Id"]; ok || len(e.To) != 1 {
+		t.Errorf("SendBatch modified the original: %v, %v", e.Headers, e.To)
+	}
+}
+
+func TestPoolSendIndividually(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.Close()
+	p, err := NewPool(s.addr(), 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	e := NewEmail()
+	e.From = "sender@example.org"
+	e.To = []string{"a@example.com", "B <b@example.com>"}
+	e.Cc = []string{"c@example.com"}
+	e.Bcc = []string{"d@example.com", "a@example.com"}
+	e.Text = []byte("Hello")
+	if err := p.SendIndividually(e, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	txs := s.transactions()
+	if len(txs) != 4 {
+		t.Fatalf("Got %d transactions, want 4", len(txs))
+	}
+	for i, want := range []struct{ rcpt, header string }{
+		{"a@example.com", "To: <a@example.com>\r\n"},
+		{"b@example.com", "To: \"B\" <b@example.com>\r\n"},
+		{"c@example.com", "Cc: <c@example.com>\r\n"},
+		{"d@example.com", ""},
+	} {
+		tx := txs[i]
+		if len(tx.rcpt) != 1 || tx.rcpt[0] != "<"+want.rcpt+">" {
+			t.Errorf("Transaction %d has recipients %q, want only %s", i, tx.rcpt, want.rcpt)
+		}
+		headers := tx.data[:strings.Index(tx.data, "\r\n\r\n")+2]
+		if want.header != "" && !strings.Contains(headers, want.header) {
+			t.Errorf("Copy for %s lacks %q:\n%s", want.rcpt, want.header, headers)
+		}
+		if strings.Count(headers, "@example.com") != strings.Count(want.header, "@example.com") {
+			t.Errorf("Copy for %s names other recipients:\n%s", want.rcpt, headers)
+		}
+	}
+}
+
+func TestPoolVerifyRecipient(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.Close()
+	p, err := NewPool(s.addr(), 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	for _, tt := range []struct {
+		to   string
+		code int
+	}{
+		{"good@example.com", 0},
+		{"bad@example.com", 550},
+		{"grey@example.com", 450},
+		{"Good <good@example.com>", 0},
+	} {
+		err := p.VerifyRecipient("sender@example.org", tt.to, 5*time.Second)
+		if tt.code == 0 {
+			if err != nil {
+				t.Errorf("VerifyRecipient(%q) = %v, want nil", tt.to, err)
+			}
+			continue
+		}
+		if te, ok := err.(*textproto.Error); !ok || te.Code != tt.code {
+			t.Errorf("VerifyRecipient(%q) = %#v, want a %d *textproto.Error", tt.to, err, tt.code)
+		}
+	}
+	s.mu.Lock()
+	conns := s.conns
+	s.mu.Unlock()
+	if conns != 1 {
+		t.Errorf("Rejections replaced the connection: %d connections", conns)
+	}
+	if txs := s.transactions(); len(txs) != 0 {
+		t.Errorf("VerifyRecipient sent %d messages", len(txs))
+	}
+}
+
+func TestPoolWithClient(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.Close()
+	p, err := NewPool(s.addr(), 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	if err := p.WithClient(func(c *smtp.Client) error { return c.Noop() }); err != nil {
+		t.Fatal("NOOP failed: ", err)
+	}
+	// A transaction left open by fn mustn't break the next send.
+	if err := p.WithClient(func(c *smtp.Client) error { return c.Mail("sender@example.org") }); err != nil {
+		t.Fatal("MAIL failed: ", err)
+	}
+	e := NewEmail()
+	e.From = "sender@example.org"
+	e.To = []string{"rcpt@example.com"}
+	e.Text = []byte("Hello")
+	if err := p.Send(e, 5*time.Second); err != nil {
+		t.Fatal("Send after WithClient failed: ", err)
+	}
+	cmds := strings.Join(s.commands(), "\n")
+	for _, want := range []string{"NOOP\nRSET\n", "MAIL FROM:<sender@example.org>\nRSET\n"} {
+		if !strings.Contains(cmds, want) {
+			t.Errorf("Commands lack %q:\n%s", want, cmds)
+		}
+	}
+}
+
+func TestPartialSendErrorOrigin(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.Close()
+	p, err := NewPool(s.addr(), 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	e := NewEmail()
+	e.From = "sender@example.org"
+	e.To = []string{"Customer <customer@example.com>"}
+	e.Bcc = []string{"bad-archive@example.com"}
+	e.Text = []byte("Hello")
+	err = p.Send(e, 5*time.Second)
+	pe, ok := err.(*PartialSendError)
+	if !ok {
+		t.Fatalf("Expected a *PartialSendError, got %#v", err)
+	}
+	if len(pe.Failed) != 1 || pe.Origin(pe.Failed[0]) != "Bcc" {
+		t.Errorf("Failed = %q, want the Bcc recipient", pe.Failed)
+	}
+	if len(pe.Delivered) != 1 || pe.Origin(pe.Delivered[0]) != "To" {
+		t.Errorf("Delivered = %q, want the To recipient", pe.Delivered)
+	}
+	if o := pe.Origin("nobody@example.com"); o != "" {
+		t.Errorf("Origin of an unknown recipient = %q, want \"\"", o)
+	}
+}
+
+func TestPoolSetDefaultFrom(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.Close()
+	p, err := NewPool(s.addr(), 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	p.SetDefaultFrom("Service <service@example.org>")
+
+	e := NewEmail()
+	e.To = []string{"rcpt@example.com"}
+	e.Text = []byte("Hello")
+	if err := p.Send(e, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if e.From != "" {
+		t.Errorf("Send modified the From of the message to %q", e.From)
+	}
+	e.From = "other@example.org"
+	if err := p.Send(e, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	txs := s.transactions()
+	if len(txs) != 2 {
+		t.Fatalf("Got %d transactions, want 2", len(txs))
+	}
+	for i, want := range []struct{ from, header string }{
+		{"<service@example.org>", "From: \"Service\" <service@example.org>\r\n"},
+		{"<other@example.org>", "From: <other@example.org>\r\n"},
+	} {
+		if txs[i].from != want.from {
+			t.Errorf("MAIL FROM:%s, want %s", txs[i].from, want.from)
+		}
+		if !strings.Contains(txs[i].data, want.header) {
+			t.Errorf("Message lacks %q:\n%s", want.header, txs[i].data)
+		}
+	}
+}
+
+func TestPoolSendWithInfo(t *testing.T) {
+	ca := testCertificate(t, "Test CA", nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{testCertificate(t, "localhost", &ca)}}
+
+	for _, useTLS := range []bool{false, true} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func(useTLS bool) {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				if useTLS {
+					go serveSMTP(conn, serverConfig)
+				} else {
+					go serveSMTP(conn, nil)
+				}
+			}
+		}(useTLS)
+		p, err := NewPool(ln.Addr().String(), 1, nil, &tls.Config{RootCAs: roots, ServerName: "localhost"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		e := prepareEmail()
+		e.Text = []byte("Hello!\n")
+		info, err := p.SendWithInfo(e, 5*time.Second)
+		if err != nil {
+			t.Fatalf("TLS %v: %v", useTLS, err)
+		}
+		if info.TLS != useTLS {
+			t.Errorf("SendInfo.TLS = %v, want %v", info.TLS, useTLS)
+		}
+		if useTLS && (info.TLSVersion < tls.VersionTLS12 || info.Cipher == 0) {
+			t.Errorf("SendInfo lacks the negotiated version or cipher: %+v", info)
+		}
+		if !useTLS && (info.TLSVersion != 0 || info.Cipher != 0) {
+			t.Errorf("SendInfo has a version or cipher without TLS: %+v", info)
+		}
+		p.Close()
+		ln.Close()
+	}
+}
+
+func TestPoolSetFooter(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.Close()
+	p, err := NewPool(s.addr(), 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	p.SetFooter([]byte("-- \nDisclaimer\n"), []byte("<p>Disclaimer</p>"))
+
+	e := NewEmail()
+	e.From = "sender@example.org"
+	e.To = []string{"rcpt@example.com"}
+	e.Text = []byte("Hello\n")
+	e.HTML = []byte("<html><body><p>Hello</p></body></html>")
+	// Sending the same message twice mustn't add the footer twice.
+	for i := 0; i < 2; i++ {
+		if err := p.Send(e, 5*time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if string(e.Text) != "Hello\n" {
+		t.Errorf("Send modified the message's text to %q", e.Text)
+	}
+	txs := s.transactions()
+	if len(txs) != 2 {
+		t.Fatalf("Got %d transactions, want 2", len(txs))
+	}
+	for _, tx := range txs {
+		if !strings.Contains(tx.data, "Hello\r\n--=20\r\nDisclaimer\r\n") {
+			t.Errorf("Text body lacks the footer:\n%s", tx.data)
+		}
+		if !strings.Contains(tx.data, "<p>Hello</p><p>Disclaimer</p></body>") {
+			t.Errorf("HTML body lacks the footer:\n%s", tx.data)
+		}
+		if n := strings.Count(tx.data, "Disclaimer"); n != 2 {
+			t.Errorf("Footer appears %d times, want once in each body", n)
+		}
+	}
+}
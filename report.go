@@ -0,0 +1,391 @@
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// report holds the machine readable parts of a multipart/report message (RFC 6522).
+// The human readable part of the report is taken from the Email's Text.
+//
+// A parsed message may have an HTML body or attachments besides, so it is
+// rendered like any other message, but in a multipart/report rather than a
+// multipart/mixed, with the parts of the report which aren't attachments
+// following the body.
+type report struct {
+	reportType string
+	parts      []*part
+	parsed     bool
+}
+
+// ErrNoDispositionNotificationTo is returned by NewMDN when the original message
+// didn't request a disposition notification.
+var ErrNoDispositionNotificationTo = errors.New("No Disposition-Notification-To found in the original message")
+
+// ErrMissingMessageID is returned when a report must reference the original
+// message, but it has no Message-Id header.
+var ErrMissingMessageID = errors.New("No Message-Id found in the original message")
+
+// NewReport creates a multipart/report message (RFC 6522) of the given
+// report-type, such as "delivery-status", from its three parts: the human
+// readable text, which becomes the Email's Text, the machine readable part,
+// which must have a Content-Type, and the original message, which is attached
+// as message/rfc822 unless it is nil. The sender, recipients and subject are
+// left to the caller.
+func NewReport(reportType string, humanReadable []byte, machineReadable *Part, original []byte) (*Email, error) {
+	if !isToken(reportType) {
+		return nil, fmt.Errorf("Invalid report-type %q", reportType)
+	}
+	if machineReadable == nil || machineReadable.Header.Get("Content-Type") == "" {
+		return nil, errors.New("The machine readable part of a report must have a Content-Type")
+	}
+	e := NewEmail()
+	e.Text = humanReadable
+	e.report = &report{
+		reportType: reportType,
+		parts: []*part{{
+			header: cloneHeader(machineReadable.Header),
+			body:   machineReadable.Body,
+		}},
+	}
+	if original != nil {
+		e.report.parts = append(e.report.parts, &part{
+			header: textproto.MIMEHeader{"Content-Type": {"message/rfc822"}},
+			body:   original,
+		})
+	}
+	return e, nil
+}
+
+// isToken reports whether s is a non-empty MIME token (RFC 2045), which can
+// be used as a parameter value without quoting.
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c <= ' ' || c >= 0x7f || strings.ContainsRune(`()<>@,;:\"/[]?=`, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// emitReport emits the multipart/report structure of e, using headers as the
+// message headers.
+func (e *Email) emitReport(em partEmitter, headers textproto.MIMEHeader) error {
+	if err := em.openMultipart("report; report-type="+e.report.reportType, headers); err != nil {
+		return err
+	}
+	if err := writeMessage(em, nil, e.Text, "text/plain", "", false); err != nil {
+		return err
+	}
+	if err := e.emitReportParts(em); err != nil {
+		return err
+	}
+	return em.closeMultipart()
+}
+
+// emitReportParts emits the parts of e's report, other than those which were
+// parsed into attachments.
+func (e *Email) emitReportParts(em partEmitter) error {
+	for _, p := range e.report.parts {
+		if p.attached {
+			continue
+		}
+		pw, err := em.leaf(p.header)
+		if err != nil {
+			return err
+		}
+		body := p.body
+		if !strings.EqualFold(p.header.Get("Content-Transfer-Encoding"), "binary") {
+			body = toCRLF(body)
+		}
+		if _, err := pw.Write(body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewMDN creates a Message Disposition Notification (RFC 8098) in response to
+// the original Email, which must have requested one with ReadReceipt or a
+// Disposition-Notification-To header.
+//
+// disposition is the disposition-type, such as "displayed" or "deleted", which
+// is reported with the "manual-action/MDN-sent-manually" action mode. A full
+// disposition field (e.g. "automatic-action/MDN-sent-automatically; processed")
+// may also be given, in which case it is used verbatim.
+//
+// The MDN is sent from the first of the original's To addresses.
+func NewMDN(original *Email, disposition string) (*Email, error) {
+	notifyTo := original.ReadReceipt
+	if len(notifyTo) == 0 && original.Headers != nil {
+		notifyTo = original.Headers["Disposition-Notification-To"]
+	}
+	if len(notifyTo) == 0 {
+		return nil, ErrNoDispositionNotificationTo
+	}
+	var msgID string
+	if original.Headers != nil {
+		msgID = original.Headers.Get("Message-Id")
+	}
+	if msgID == "" {
+		return nil, ErrMissingMessageID
+	}
+	if len(original.To) == 0 {
+		return nil, errors.New("Must specify at least one To address in the original message")
+	}
+	finalRecipient, err := emailOnly(original.To[0])
+	if err != nil {
+		return nil, err
+	}
+	if !strings.Contains(disposition, ";") {
+		disposition = "manual-action/MDN-sent-manually; " + disposition
+	}
+
+	var text bytes.Buffer
+	fmt.Fprintf(&text, "This is a disposition notification for the message sent to %s", finalRecipient)
+	if date := original.Headers.Get("Date"); date != "" {
+		fmt.Fprintf(&text, " on %s", date)
+	}
+	fmt.Fprintf(&text, " with the subject %q.\r\n\r\nDisposition: %s\r\n", original.Subject, disposition)
+
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "Final-Recipient: rfc822; %s\r\n", finalRecipient)
+	fmt.Fprintf(&body, "Original-Message-ID: %s\r\n", msgID)
+	fmt.Fprintf(&body, "Disposition: %s\r\n", disposition)
+	e, err := NewReport("disposition-notification", text.Bytes(), &Part{
+		Header: textproto.MIMEHeader{"Content-Type": {"message/disposition-notification"}},
+		Body:   body.Bytes(),
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	e.From = original.To[0]
+	e.To = append([]string(nil), notifyTo...)
+	e.Subject = "Disposition notification: " + original.Subject
+	e.Headers.Set("In-Reply-To", msgID)
+	e.Headers.Set("References", msgID)
+	return e, nil
+}
+
+// DSNRecipient is the delivery status of a single recipient in a Delivery
+// Status Notification (RFC 3464).
+type DSNRecipient struct {
+	FinalRecipient string // The recipient address, e.g. "user@example.com"
+	Action         string // One of "failed", "delayed", "delivered", "relayed" or "expanded"
+	Status         string // The RFC 3463 status code, e.g. "5.1.1"
+	DiagnosticCode string // The diagnostic, e.g. "smtp; 550 5.1.1 User unknown" (optional)
+	RemoteMTA      string // The remote MTA, e.g. "dns; mx.example.com" (optional)
+}
+
+// dsnStatusClass returns the expected class of a status code for a DSN action.
+func dsnStatusClass(action string) (byte, bool) {
+	switch action {
+	case "failed":
+		return '5', true
+	case "delayed":
+		return '4', true
+	case "delivered", "relayed", "expanded":
+		return '2', true
+	}
+	return 0, false
+}
+
+// validDSNStatus reports whether status is a well-formed RFC 3463 status code.
+func validDSNStatus(status string) bool {
+	fields := strings.Split(status, ".")
+	if len(fields) != 3 {
+		return false
+	}
+	for i, f := range fields {
+		if len(f) == 0 || len(f) > 3 || (i == 0 && len(f) != 1) {
+			return false
+		}
+		for _, c := range f {
+			if c < '0' || c > '9' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ErrNullReturnPath is returned by NewDSN when the original message has a null
+// Return-Path, which means that it must not be bounced (RFC 5321, section 4.5.5)
+var ErrNullReturnPath = errors.New("Original message has a null Return-Path")
+
+// NewDSN creates a Delivery Status Notification (RFC 3464) for the original
+// message, which is returned in its entirety as a message/rfc822 part. The DSN
+// is addressed to the original's Return-Path, or its From address if there is
+// no Return-Path, and is sent from the MAILER-DAEMON at reportingMTA with a
+// null envelope sender, so that it can't in turn generate further bounces.
+// An original with a null Return-Path, such as another DSN, is never reported
+// on, and ErrNullReturnPath is returned.
+func NewDSN(original []byte, recipients []DSNRecipient, reportingMTA string) (*Email, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("Must specify at least one recipient to report on")
+	}
+	msg, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(original))).ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	rp := strings.TrimSpace(msg.Get("Return-Path"))
+	if rp == "<>" {
+		return nil, ErrNullReturnPath
+	}
+	to := strings.Trim(rp, "<> ")
+	if to == "" {
+		to = msg.Get("From")
+	}
+	if to == "" {
+		return nil, errors.New("No Return-Path or From found in the original message")
+	}
+
+	var (
+		status bytes.Buffer
+		text   bytes.Buffer
+		worst  string
+	)
+	fmt.Fprintf(&status, "Reporting-MTA: dns; %s\r\n", reportingMTA)
+	fmt.Fprintf(&text, "This is the mail system at host %s.\r\n\r\n", reportingMTA)
+	fmt.Fprintf(&text, "The delivery status of your message to the following recipients is reported below.\r\n\r\n")
+	for _, r := range recipients {
+		class, ok := dsnStatusClass(r.Action)
+		if !ok {
+			return nil, fmt.Errorf("Invalid DSN action %q for %s", r.Action, r.FinalRecipient)
+		}
+		if !validDSNStatus(r.Status) || r.Status[0] != class {
+			return nil, fmt.Errorf("Invalid DSN status %q for action %q", r.Status, r.Action)
+		}
+		switch {
+		case r.Action == "failed":
+			worst = "Failure"
+		case r.Action == "delayed" && worst != "Failure":
+			worst = "Delay"
+		case worst == "":
+			worst = "Success"
+		}
+		fmt.Fprintf(&status, "\r\nFinal-Recipient: rfc822; %s\r\n", r.FinalRecipient)
+		fmt.Fprintf(&status, "Action: %s\r\n", r.Action)
+		fmt.Fprintf(&status, "Status: %s\r\n", r.Status)
+		if r.RemoteMTA != "" {
+			fmt.Fprintf(&status, "Remote-MTA: %s\r\n", r.RemoteMTA)
+		}
+		if r.DiagnosticCode != "" {
+			fmt.Fprintf(&status, "Diagnostic-Code: %s\r\n", r.DiagnosticCode)
+		}
+		fmt.Fprintf(&text, "<%s>: %s (%s)", r.FinalRecipient, r.Action, r.Status)
+		if r.DiagnosticCode != "" {
+			fmt.Fprintf(&text, ": %s", r.DiagnosticCode)
+		}
+		text.WriteString("\r\n")
+	}
+
+	e, err := NewReport("delivery-status", text.Bytes(), &Part{
+		Header: textproto.MIMEHeader{"Content-Type": {"message/delivery-status"}},
+		Body:   status.Bytes(),
+	}, original)
+	if err != nil {
+		return nil, err
+	}
+	e.From = fmt.Sprintf("Mail Delivery System <MAILER-DAEMON@%s>", reportingMTA)
+	e.ReturnPath = "<>"
+	e.To = []string{to}
+	e.Subject = "Delivery Status Notification (" + worst + ")"
+	e.Headers.Set("Auto-Submitted", "auto-replied")
+	if msgID := msg.Get("Message-Id"); msgID != "" {
+		e.Headers.Set("In-Reply-To", msgID)
+		e.Headers.Set("References", msgID)
+	}
+	return e, nil
+}
+
+// ErrNoFeedbackReport is returned by Email.FeedbackReport when the message
+// doesn't contain a feedback report.
+var ErrNoFeedbackReport = errors.New("No feedback report found in the message")
+
+// FeedbackReport is an abuse or feedback loop report in the Abuse Reporting
+// Format (RFC 5965).
+type FeedbackReport struct {
+	FeedbackType     string               // e.g. "abuse", "fraud" or "not-spam"
+	UserAgent        string               // The software which generated the report
+	Version          string               // The version of the format, "1"
+	OriginalMailFrom string               // The envelope sender of the original message (optional)
+	OriginalRcptTo   []string             // The envelope recipients of the original message (optional)
+	ArrivalDate      time.Time            // When the original message was received (optional)
+	ReportingMTA     string               // The MTA which generated the report (optional)
+	SourceIP         string               // The IP address the original message came from (optional)
+	ReportedDomain   []string             // Domains the report is about (optional)
+	ReportedURI      []string             // URIs the report is about (optional)
+	Fields           textproto.MIMEHeader // All of the fields of the report
+	Original         *Email               // The original message, or just its headers (optional)
+}
+
+// FeedbackReport parses the message/feedback-report part of a message parsed
+// with NewEmailFromReader, along with the original message it refers to. If
+// the message is not a feedback report, ErrNoFeedbackReport is returned.
+func (e *Email) FeedbackReport() (*FeedbackReport, error) {
+	if e.report == nil {
+		return nil, ErrNoFeedbackReport
+	}
+	var fr *FeedbackReport
+	var headers []byte
+	for _, p := range e.report.parts {
+		ct, _, err := mime.ParseMediaType(p.header.Get("Content-Type"))
+		if err != nil {
+			return nil, err
+		}
+		switch ct {
+		case "message/feedback-report":
+			if fr != nil {
+				continue
+			}
+			// The fields aren't required to be followed by a blank line.
+			body := append(append([]byte(nil), p.body...), "\r\n\r\n"...)
+			fields, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(body))).ReadMIMEHeader()
+			if err != nil {
+				return nil, err
+			}
+			fr = &FeedbackReport{
+				FeedbackType:     fields.Get("Feedback-Type"),
+				UserAgent:        fields.Get("User-Agent"),
+				Version:          fields.Get("Version"),
+				OriginalMailFrom: fields.Get("Original-Mail-From"),
+				OriginalRcptTo:   fields["Original-Rcpt-To"],
+				ReportingMTA:     fields.Get("Reporting-MTA"),
+				SourceIP:         fields.Get("Source-IP"),
+				ReportedDomain:   fields["Reported-Domain"],
+				ReportedURI:      fields["Reported-Uri"],
+				Fields:           fields,
+			}
+			if t, err := mail.ParseDate(fields.Get("Arrival-Date")); err == nil {
+				fr.ArrivalDate = t
+			}
+		case "text/rfc822-headers":
+			headers = append(append([]byte(nil), p.body...), "\r\n"...)
+		}
+	}
+	if fr == nil {
+		return nil, ErrNoFeedbackReport
+	}
+	switch {
+	case len(e.Embedded) > 0:
+		fr.Original = e.Embedded[0]
+	case headers != nil:
+		original, err := NewEmailFromReader(bytes.NewReader(headers))
+		if err != nil {
+			return nil, err
+		}
+		fr.Original = original
+	}
+	return fr, nil
+}
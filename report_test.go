@@ -0,0 +1,395 @@
+package email
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestNewReport(t *testing.T) {
+	original := []byte("From: sender@example.com\r\nSubject: Hi\r\n\r\nHello!\r\n")
+	e, err := NewReport("x-custom-report", []byte("Something happened.\r\n"), &Part{
+		Header: map[string][]string{"Content-Type": {"message/x-custom-report"}},
+		Body:   []byte("Event: something\r\n"),
+	}, original)
+	if err != nil {
+		t.Fatal("Could not create report: ", err)
+	}
+	e.From = "reporter@example.com"
+	e.To = []string{"sender@example.com"}
+	raw, err := e.Bytes()
+	if err != nil {
+		t.Fatal("Failed to render message: ", err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal("Could not parse rendered message: ", err)
+	}
+	mt, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal("Content-type header is invalid: ", err)
+	}
+	if mt != "multipart/report" || params["report-type"] != "x-custom-report" {
+		t.Fatalf("Incorrect Content-Type: %#q", msg.Header.Get("Content-Type"))
+	}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for _, want := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", "Something happened.\r\n"},
+		{"message/x-custom-report", "Event: something\r\n"},
+		{"message/rfc822", string(original)},
+	} {
+		p, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("Could not find the %s part: %s", want.contentType, err)
+		}
+		if ct := p.Header.Get("Content-Type"); ct != want.contentType {
+			t.Errorf("Incorrect Content-Type: %#q != %#q", ct, want.contentType)
+		}
+		body, err := ioutil.ReadAll(p)
+		if err != nil {
+			t.Fatal("Could not read part: ", err)
+		}
+		if want.contentType != "text/plain; charset=utf-8" && string(body) != want.body {
+			t.Errorf("Incorrect %s part: %#q != %#q", want.contentType, body, want.body)
+		}
+	}
+	if _, err := mr.NextPart(); err == nil {
+		t.Error("Expected exactly three parts")
+	}
+
+	if _, err := NewReport("bad type", nil, &Part{Header: map[string][]string{"Content-Type": {"text/plain"}}}, nil); err == nil {
+		t.Error("Expected an error for an invalid report-type")
+	}
+	if _, err := NewReport("x-custom-report", nil, &Part{}, nil); err == nil {
+		t.Error("Expected an error for a machine readable part without a Content-Type")
+	}
+}
+
+func TestNewMDN(t *testing.T) {
+	original := prepareEmail()
+	original.ReadReceipt = []string{"Jordan Wright <test@example.com>"}
+	original.Headers.Set("Message-Id", "<original@example.com>")
+
+	e, err := NewMDN(original, "displayed")
+	if err != nil {
+		t.Fatal("Could not create MDN: ", err)
+	}
+	raw, err := e.Bytes()
+	if err != nil {
+		t.Fatal("Failed to render message: ", err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal("Could not parse rendered message: ", err)
+	}
+	if got, want := msg.Header.Get("To"), "\"Jordan Wright\" <test@example.com>"; got != want {
+		t.Errorf("Incorrect To: %#q != %#q", got, want)
+	}
+	mt, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal("Content-type header is invalid: ", err)
+	}
+	if mt != "multipart/report" || params["report-type"] != "disposition-notification" {
+		t.Fatalf("Incorrect Content-Type: %#q", msg.Header.Get("Content-Type"))
+	}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	text, err := mr.NextPart()
+	if err != nil {
+		t.Fatal("Could not find human readable part: ", err)
+	}
+	if ct := text.Header.Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+		t.Errorf("Incorrect human readable Content-Type: %#q", ct)
+	}
+	notification, err := mr.NextPart()
+	if err != nil {
+		t.Fatal("Could not find disposition notification part: ", err)
+	}
+	if ct := notification.Header.Get("Content-Type"); ct != "message/disposition-notification" {
+		t.Errorf("Incorrect notification Content-Type: %#q", ct)
+	}
+	body, err := ioutil.ReadAll(notification)
+	if err != nil {
+		t.Fatal("Could not read notification: ", err)
+	}
+	want := "Final-Recipient: rfc822; test@example.com\r\n" +
+		"Original-Message-ID: <original@example.com>\r\n" +
+		"Disposition: manual-action/MDN-sent-manually; displayed\r\n"
+	if string(body) != want {
+		t.Errorf("Incorrect notification: %#q != %#q", body, want)
+	}
+}
+
+func TestNewMDNNotRequested(t *testing.T) {
+	original := prepareEmail()
+	original.Headers.Set("Message-Id", "<original@example.com>")
+	if _, err := NewMDN(original, "displayed"); err != ErrNoDispositionNotificationTo {
+		t.Fatalf("Expected ErrNoDispositionNotificationTo, got %v", err)
+	}
+}
+
+func TestNewDSN(t *testing.T) {
+	original := []byte("Return-Path: <sender@example.com>\r\n" +
+		"From: Sender <sender@example.com>\r\n" +
+		"To: missing@example.org, slow@example.org\r\n" +
+		"Subject: Hello\r\n" +
+		"Message-Id: <original@example.com>\r\n" +
+		"\r\n" +
+		"Hello!\r\n")
+	recipients := []DSNRecipient{
+		{FinalRecipient: "missing@example.org", Action: "failed", Status: "5.1.1", DiagnosticCode: "smtp; 550 5.1.1 User unknown"},
+		{FinalRecipient: "slow@example.org", Action: "delayed", Status: "4.4.1"},
+	}
+	e, err := NewDSN(original, recipients, "mx.example.org")
+	if err != nil {
+		t.Fatal("Could not create DSN: ", err)
+	}
+	raw, err := e.Bytes()
+	if err != nil {
+		t.Fatal("Failed to render message: ", err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal("Could not parse rendered message: ", err)
+	}
+	if got, want := msg.Header.Get("To"), "<sender@example.com>"; got != want {
+		t.Errorf("Incorrect To: %#q != %#q", got, want)
+	}
+	if sender, err := e.parseSender(); err != nil || sender != "" {
+		t.Errorf("DSN has envelope sender %q (%v), want a null one", sender, err)
+	}
+	if got, want := msg.Header.Get("Subject"), "Delivery Status Notification (Failure)"; got != want {
+		t.Errorf("Incorrect Subject: %#q != %#q", got, want)
+	}
+	mt, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal("Content-type header is invalid: ", err)
+	}
+	if mt != "multipart/report" || params["report-type"] != "delivery-status" {
+		t.Fatalf("Incorrect Content-Type: %#q", msg.Header.Get("Content-Type"))
+	}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	if _, err := mr.NextPart(); err != nil {
+		t.Fatal("Could not find human readable part: ", err)
+	}
+	ds, err := mr.NextPart()
+	if err != nil {
+		t.Fatal("Could not find delivery status part: ", err)
+	}
+	body, err := ioutil.ReadAll(ds)
+	if err != nil {
+		t.Fatal("Could not read delivery status: ", err)
+	}
+	want := "Reporting-MTA: dns; mx.example.org\r\n" +
+		"\r\n" +
+		"Final-Recipient: rfc822; missing@example.org\r\n" +
+		"Action: failed\r\n" +
+		"Status: 5.1.1\r\n" +
+		"Diagnostic-Code: smtp; 550 5.1.1 User unknown\r\n" +
+		"\r\n" +
+		"Final-Recipient: rfc822; slow@example.org\r\n" +
+		"Action: delayed\r\n" +
+		"Status: 4.4.1\r\n"
+	if string(body) != want {
+		t.Errorf("Incorrect delivery status: %#q != %#q", body, want)
+	}
+	returned, err := mr.NextPart()
+	if err != nil {
+		t.Fatal("Could not find returned message part: ", err)
+	}
+	if ct := returned.Header.Get("Content-Type"); ct != "message/rfc822" {
+		t.Errorf("Incorrect returned message Content-Type: %#q", ct)
+	}
+}
+
+func TestNewDSNNullReturnPath(t *testing.T) {
+	original := []byte("Return-Path: <>\r\n" +
+		"From: Mail Delivery System <MAILER-DAEMON@example.com>\r\n" +
+		"\r\n" +
+		"Hello!\r\n")
+	recipients := []DSNRecipient{{FinalRecipient: "missing@example.org", Action: "failed", Status: "5.1.1"}}
+	if _, err := NewDSN(original, recipients, "mx.example.org"); err != ErrNullReturnPath {
+		t.Fatalf("Expected ErrNullReturnPath, got %v", err)
+	}
+}
+
+func TestNewDSNInvalidStatus(t *testing.T) {
+	original := []byte("From: sender@example.com\r\n\r\nHello!\r\n")
+	recipients := []DSNRecipient{{FinalRecipient: "missing@example.org", Action: "failed", Status: "2.0.0"}}
+	if _, err := NewDSN(original, recipients, "mx.example.org"); err == nil {
+		t.Fatal("Expected an error for a failed action with a success status")
+	}
+}
+
+func TestFeedbackReport(t *testing.T) {
+	raw := []byte("From: <abusedesk@example.com>\r\n" +
+		"Date: Thu, 8 Mar 2005 17:40:36 EDT\r\n" +
+		"Subject: FW: Earn money\r\n" +
+		"To: <abuse@example.net>\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/report; report-type=feedback-report;\r\n" +
+		"     boundary=\"part1_13d.2e68ed54_boundary\"\r\n" +
+		"\r\n" +
+		"--part1_13d.2e68ed54_boundary\r\n" +
+		"Content-Type: text/plain; charset=\"US-ASCII\"\r\n" +
+		"Content-Transfer-Encoding: 7bit\r\n" +
+		"\r\n" +
+		"This is an email abuse report for an email message received from IP\r\n" +
+		"192.0.2.1 on Thu, 8 Mar 2005 14:00:00 EDT.\r\n" +
+		"--part1_13d.2e68ed54_boundary\r\n" +
+		"Content-Type: message/feedback-report\r\n" +
+		"\r\n" +
+		"Feedback-Type: abuse\r\n" +
+		"User-Agent: SomeGenerator/1.0\r\n" +
+		"Version: 1\r\n" +
+		"Original-Mail-From: <somespammer@example.net>\r\n" +
+		"Original-Rcpt-To: <user@example.com>\r\n" +
+		"Arrival-Date: Thu, 8 Mar 2005 14:00:00 EDT\r\n" +
+		"Reporting-MTA: dns; mail.example.com\r\n" +
+		"Source-IP: 192.0.2.1\r\n" +
+		"Reported-Domain: example.net\r\n" +
+		"\r\n" +
+		"--part1_13d.2e68ed54_boundary\r\n" +
+		"Content-Type: message/rfc822\r\n" +
+		"Content-Disposition: inline\r\n" +
+		"\r\n" +
+		"From: <somespammer@example.net>\r\n" +
+		"Received: from mailserver.example.net (mailserver.example.net\r\n" +
+		"        [192.0.2.1]) by example.com with ESMTP id M63d4137594e46;\r\n" +
+		"        Thu, 08 Mar 2005 14:00:00 -0400\r\n" +
+		"To: <Undisclosed Recipients>\r\n" +
+		"Subject: Earn money\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-type: text/plain\r\n" +
+		"Message-ID: 8787KJKJ3K4J3K4J3K4J3.mail@example.net\r\n" +
+		"Date: Thu, 02 Sep 2004 12:31:03 -0500\r\n" +
+		"\r\n" +
+		"Spam Spam Spam\r\n" +
+		"--part1_13d.2e68ed54_boundary--\r\n")
+	e, err := NewEmailFromReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Error parsing email %s", err.Error())
+	}
+	fr, err := e.FeedbackReport()
+	if err != nil {
+		t.Fatal("Failed to parse feedback report: ", err)
+	}
+	for _, c := range []struct{ got, want string }{
+		{fr.FeedbackType, "abuse"},
+		{fr.UserAgent, "SomeGenerator/1.0"},
+		{fr.Version, "1"},
+		{fr.OriginalMailFrom, "<somespammer@example.net>"},
+		{fr.ReportingMTA, "dns; mail.example.com"},
+		{fr.SourceIP, "192.0.2.1"},
+	} {
+		if c.got != c.want {
+			t.Errorf("Incorrect feedback report field: %#q != %#q", c.got, c.want)
+		}
+	}
+	if len(fr.OriginalRcptTo) != 1 || fr.OriginalRcptTo[0] != "<user@example.com>" {
+		t.Errorf("Incorrect Original-Rcpt-To: %#q", fr.OriginalRcptTo)
+	}
+	if len(fr.ReportedDomain) != 1 || fr.ReportedDomain[0] != "example.net" {
+		t.Errorf("Incorrect Reported-Domain: %#q", fr.ReportedDomain)
+	}
+	if fr.ArrivalDate.IsZero() {
+		t.Error("Arrival-Date was not parsed")
+	}
+	if fr.Original == nil {
+		t.Fatal("Original message was not parsed")
+	}
+	if got, want := fr.Original.Subject, "Earn money"; got != want {
+		t.Errorf("Incorrect original subject: %#q != %#q", got, want)
+	}
+
+	// The report survives being rendered and parsed again.
+	b, err := e.Bytes()
+	if err != nil {
+		t.Fatal("Error rendering email: ", err)
+	}
+	if e, err = NewEmailFromReader(bytes.NewReader(b)); err != nil {
+		t.Fatal("Error parsing rendered email: ", err)
+	}
+	if fr, err = e.FeedbackReport(); err != nil {
+		t.Fatalf("Rendering the parsed report lost it: %v\n%s", err, b)
+	}
+	if fr.FeedbackType != "abuse" || fr.Original == nil || fr.Original.Subject != "Earn money" {
+		t.Errorf("Incorrect feedback report after rendering: %+v", fr)
+	}
+
+	e, err = NewEmailFromReader(bytes.NewReader([]byte("From: <a@example.com>\r\nSubject: Hi\r\n\r\nHello\r\n")))
+	if err != nil {
+		t.Fatalf("Error parsing email %s", err.Error())
+	}
+	if _, err := e.FeedbackReport(); err != ErrNoFeedbackReport {
+		t.Errorf("Expected ErrNoFeedbackReport, got %v", err)
+	}
+}
+
+func TestParsedReportBytes(t *testing.T) {
+	raw := []byte("From: <mailer-daemon@example.com>\r\n" +
+		"To: <sender@example.net>\r\n" +
+		"Subject: Delivery failure\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/report; report-type=delivery-status; boundary=\"b1\"\r\n" +
+		"\r\n" +
+		"--b1\r\n" +
+		"Content-Type: multipart/alternative; boundary=\"b2\"\r\n" +
+		"\r\n" +
+		"--b2\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Your message could not be delivered.\r\n" +
+		"--b2\r\n" +
+		"Content-Type: text/html\r\n" +
+		"\r\n" +
+		"<p>Your message could not be delivered.</p>\r\n" +
+		"--b2--\r\n" +
+		"--b1\r\n" +
+		"Content-Type: message/delivery-status\r\n" +
+		"\r\n" +
+		"Reporting-MTA: dns; mail.example.com\r\n" +
+		"\r\n" +
+		"Final-Recipient: rfc822; user@example.com\r\n" +
+		"Action: failed\r\n" +
+		"Status: 5.1.1\r\n" +
+		"\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"Content-Disposition: attachment; filename=\"transcript.txt\"\r\n" +
+		"\r\n" +
+		"550 5.1.1 No such user\r\n" +
+		"--b1--\r\n")
+	for _, modify := range []bool{false, true} {
+		e, err := NewEmailFromReader(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal("Error parsing email: ", err)
+		}
+		if modify {
+			e.Text = append(e.Text, "Sorry!\r\n"...)
+		}
+		b, err := e.Bytes()
+		if err != nil {
+			t.Fatal("Error rendering email: ", err)
+		}
+		e, err = NewEmailFromReader(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal("Error parsing rendered email: ", err)
+		}
+		if !bytes.Contains(e.HTML, []byte("<p>Your message could not be delivered.</p>")) {
+			t.Errorf("Rendering the parsed report lost its HTML body:\n%s", b)
+		}
+		if len(e.Attachments) != 1 || e.Attachments[0].Filename != "transcript.txt" {
+			t.Errorf("Rendering the parsed report lost its attachment:\n%s", b)
+		}
+		if !strings.HasPrefix(e.Headers.Get("Content-Type"), "multipart/report; report-type=delivery-status;") {
+			t.Errorf("Parsed report was not rendered as a report:\n%s", b)
+		}
+		if !bytes.Contains(b, []byte("Content-Type: message/delivery-status\r\n")) || !bytes.Contains(b, []byte("Status: 5.1.1\r\n")) {
+			t.Errorf("Rendering the parsed report lost its delivery status:\n%s", b)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package email
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/smtp"
+)
+
+// Option configures SendMail.
+type Option func(*sendOptions)
+
+type sendOptions struct {
+	ctx         context.Context
+	tlsConfig   *tls.Config
+	localName   string
+	tlsRequired bool
+	implicitTLS bool
+	trace       func(event string)
+}
+
+// WithContext sets a context which bounds the whole of SendMail, from dialing
+// the server to the end of the SMTP conversation.
+func WithContext(ctx context.Context) Option {
+	return func(o *sendOptions) {
+		o.ctx = ctx
+	}
+}
+
+// WithTLSConfig sets the TLS configuration used for STARTTLS or implicit TLS.
+// If its ServerName is empty, the host of the server address is used.
+func WithTLSConfig(c *tls.Config) Option {
+	return func(o *sendOptions) {
+		o.tlsConfig = c
+	}
+}
+
+// WithLocalName sets the hostname sent in the EHLO or HELO command, instead of
+// "localhost".
+func WithLocalName(name string) Option {
+	return func(o *sendOptions) {
+		o.localName = name
+	}
+}
+
+// WithTLSRequired makes SendMail fail, rather than send the message in the
+// clear, if the server doesn't support STARTTLS.
+func WithTLSRequired() Option {
+	return func(o *sendOptions) {
+		o.tlsRequired = true
+	}
+}
+
+// WithImplicitTLS connects to the server over TLS from the start (RFC 8314),
+// as on port 465, instead of using STARTTLS.
+func WithImplicitTLS() Option {
+	return func(o *sendOptions) {
+		o.implicitTLS = true
+	}
+}
+
+// WithTrace sets a function which is called with each SMTP command sent and
+// each response line received, as described for Pool.SetTrace.
+func WithTrace(f func(event string)) Option {
+	return func(o *sendOptions) {
+		o.trace = f
+	}
+}
+
+// SendMail sends e through the SMTP server at addr, like smtp.SendMail. The
+// connection is upgraded with STARTTLS if the server supports it, and if a is
+// not nil, the client authenticates with a. The recipients are taken from the
+// To, Cc and Bcc fields, and the envelope sender is chosen as described for
+// Email.ReturnPath.
+func SendMail(addr string, a smtp.Auth, e *Email, opts ...Option) error {
+	o := sendOptions{ctx: context.Background(), localName: "localhost"}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	to, err := addressLists(e.To, e.Cc, e.Bcc)
+	if err != nil {
+		return err
+	}
+	// Check to make sure there is at least one recipient and one "From" address
+	if e.From == "" || len(to) == 0 {
+		return errors.New("Must specify at least one From address and one To address")
+	}
+	sender, err := e.parseSender()
+	if err != nil {
+		return err
+	}
+	raw, err := e.Bytes()
+	if err != nil {
+		return err
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	tlsConfig := &tls.Config{ServerName: host}
+	if o.tlsConfig != nil {
+		tlsConfig = o.tlsConfig.Clone()
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = host
+		}
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(o.ctx, "tcp", addr)
+	if err != nil {
+		return contextErr(o.ctx, err)
+	}
+	if deadline, ok := o.ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// Abort the conversation if the context is cancelled.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-o.ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	if err := sendMail(conn, host, a, tlsConfig, &o, e, sender, to, raw); err != nil {
+		return contextErr(o.ctx, err)
+	}
+	return nil
+}
+
+func sendMail(conn net.Conn, host string, a smtp.Auth, tlsConfig *tls.Config, o *sendOptions, e *Email, sender string, to []string, raw []byte) error {
+	if o.implicitTLS {
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return err
+		}
+		conn = tlsConn
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if o.trace != nil {
+		traceClient(c, o.trace)
+	}
+	if err = c.Hello(o.localName); err != nil {
+		return err
+	}
+	if !o.implicitTLS {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err = c.StartTLS(tlsConfig); err != nil {
+				return err
+			}
+			if o.trace != nil {
+				traceClient(c, o.trace)
+			}
+		} else if o.tlsRequired {
+			return errors.New("Server does not support the STARTTLS extension")
+		}
+	}
+	if a != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("Server does not support the AUTH extension")
+		}
+		if err = c.Auth(a); err != nil {
+			return err
+		}
+	}
+	if err = e.mail(c, sender); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err = c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+	if err = textCmd(c.Text, 354, "DATA"); err != nil {
+		return err
+	}
+	if err = writeData(c.Text, raw); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,367 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSendMailContext(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// Accept connections, but never send a greeting.
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	e := prepareEmail()
+	e.Text = []byte("Hello!\n")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := SendMail(ln.Addr().String(), nil, e, WithContext(ctx), WithLocalName("client.example.com")); err != context.DeadlineExceeded {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("SendMail took %v to time out", d)
+	}
+}
+
+func TestSendMailValidation(t *testing.T) {
+	e := NewEmail()
+	e.To = []string{"recipient@example.com"}
+	if err := SendMail("localhost:25", nil, e); err == nil {
+		t.Error("Expected an error sending without a From address")
+	}
+}
+
+// testCertificate returns a certificate for name signed by ca, or a
+// self-signed CA certificate if ca is nil.
+func testCertificate(t *testing.T, name string, ca *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	parent, signer := tmpl, interface{}(key)
+	if ca == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+	} else {
+		parent, signer = ca.Leaf, ca.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestSendMailRecipientOrder(t *testing.T) {
+	client, server := net.Pipe()
+	go serveSMTP(server, nil)
+
+	e := prepareEmail()
+	e.To = []string{"to2@example.com", "To One <to1@example.com>"}
+	e.Cc = []string{"cc2@example.com", "cc1@example.com"}
+	e.Bcc = []string{"bcc2@example.com", "bcc1@example.com"}
+	e.Text = []byte("Hello!\n")
+	raw, err := e.Bytes()
+	if err != nil {
+		t.Fatal("Could not serialize e-mail:", err)
+	}
+	to, err := addressLists(e.To, e.Cc, e.Bcc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rcpts []string
+	o := &sendOptions{localName: "localhost", trace: func(event string) {
+		if strings.HasPrefix(event, "C: RCPT TO:") {
+			rcpts = append(rcpts, strings.TrimPrefix(event, "C: RCPT TO:"))
+		}
+	}}
+	if err := sendMail(client, "localhost", nil, nil, o, e, "test@example.com", to, raw); err != nil {
+		t.Fatal("Could not send message: ", err)
+	}
+	want := []string{
+		"<to2@example.com>", "<to1@example.com>",
+		"<cc2@example.com>", "<cc1@example.com>",
+		"<bcc2@example.com>", "<bcc1@example.com>",
+	}
+	if strings.Join(rcpts, " ") != strings.Join(want, " ") {
+		t.Errorf("Incorrect RCPT order: %v != %v", rcpts, want)
+	}
+}
+
+func TestSendMailEnvelopeID(t *testing.T) {
+	client, server := net.Pipe()
+	go serveSMTP(server, nil)
+
+	e := prepareEmail()
+	e.Text = []byte("Hello!\n")
+	e.EnvelopeID = "campaign-7+user=42"
+	raw, err := e.Bytes()
+	if err != nil {
+		t.Fatal("Could not serialize e-mail:", err)
+	}
+	if !bytes.Contains(raw, []byte("X-Envelope-Id: campaign-7+user=42\r\n")) {
+		t.Errorf("Rendered message has no X-Envelope-Id header:\n%s", raw)
+	}
+	var mailCmd string
+	o := &sendOptions{localName: "localhost", trace: func(event string) {
+		if strings.HasPrefix(event, "C: MAIL FROM:") {
+			mailCmd = event
+		}
+	}}
+	if err := sendMail(client, "localhost", nil, nil, o, e, "test@example.com", []string{"test@example.com"}, raw); err != nil {
+		t.Fatal("Could not send message: ", err)
+	}
+	if want := " ENVID=campaign-7+2Buser+3D42"; !strings.HasSuffix(mailCmd, want) {
+		t.Errorf("MAIL command %q does not end with %q", mailCmd, want)
+	}
+}
+
+// failingConn reads canned server responses, and fails writes after limit
+// bytes have been written.
+type failingConn struct {
+	io.Reader
+	written, limit int
+}
+
+func (c *failingConn) Write(b []byte) (int, error) {
+	if c.written+len(b) > c.limit {
+		n := c.limit - c.written
+		c.written = c.limit
+		return n, errors.New("connection reset by peer")
+	}
+	c.written += len(b)
+	return len(b), nil
+}
+
+func (c *failingConn) Close() error {
+	return nil
+}
+
+func TestWriteDataClassification(t *testing.T) {
+	msg := bytes.Repeat([]byte("Hello, world!\r\n"), 1000)
+	for _, test := range []struct {
+		name                string
+		responses           string
+		limit               int
+		complete            bool
+		rejected, retryable bool
+	}{
+		{"interrupted", "", 5000, false, false, true},
+		{"rejected", "554 5.7.1 Message rejected\r\n", len(msg) * 2, true, true, false},
+		{"no response", "", len(msg) * 2, true, false, false},
+	} {
+		text := textproto.NewConn(&failingConn{Reader: strings.NewReader(test.responses), limit: test.limit})
+		err := writeData(text, msg)
+		se, ok := err.(*SendError)
+		if !ok {
+			t.Errorf("%s: expected a *SendError, got %#v", test.name, err)
+			continue
+		}
+		if se.Size != len(msg) || se.Complete != test.complete {
+			t.Errorf("%s: incorrect progress: %d of %d bytes, complete %v", test.name, se.Written, se.Size, se.Complete)
+		}
+		if !se.Complete && se.Written >= se.Size {
+			t.Errorf("%s: the whole message was reported as written", test.name)
+		}
+		if se.Rejected() != test.rejected || se.Retryable() != test.retryable {
+			t.Errorf("%s: incorrect classification: rejected %v, retryable %v", test.name, se.Rejected(), se.Retryable())
+		}
+	}
+
+	text := textproto.NewConn(&failingConn{Reader: strings.NewReader("250 2.0.0 Queued\r\n"), limit: len(msg) * 2})
+	if err := writeData(text, msg); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
+
+func TestSendMailClientCertificate(t *testing.T) {
+	ca := testCertificate(t, "Test CA", nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	serverConfig := &tls.Config{
+		Certificates: []tls.Certificate{testCertificate(t, "localhost", &ca)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+	clientCert := testCertificate(t, "client", &ca)
+
+	e := prepareEmail()
+	e.Text = []byte("Hello!\n")
+	raw, err := e.Bytes()
+	if err != nil {
+		t.Fatal("Could not serialize e-mail:", err)
+	}
+	for _, implicit := range []bool{false, true} {
+		for _, withCert := range []bool{false, true} {
+			clientConfig := &tls.Config{RootCAs: pool}
+			if withCert {
+				clientConfig.Certificates = []tls.Certificate{clientCert}
+			}
+			// net.Pipe is unbuffered, so a failed TLS 1.3 handshake would
+			// deadlock the alert against the client's next command.
+			client, server := loopbackPair(t)
+			if implicit {
+				go serveSMTP(tls.Server(server, serverConfig), nil)
+			} else {
+				go serveSMTP(server, serverConfig)
+			}
+			o := &sendOptions{localName: "localhost", implicitTLS: implicit, tlsRequired: true}
+			tlsConfig := clientConfig.Clone()
+			tlsConfig.ServerName = "localhost"
+			err := sendMail(client, "localhost", nil, tlsConfig, o, e, "test@example.com", []string{"test@example.com"}, raw)
+			if withCert && err != nil {
+				t.Errorf("Implicit TLS %v: could not send with a client certificate: %s", implicit, err)
+			}
+			if !withCert && err == nil {
+				t.Errorf("Implicit TLS %v: expected an error without a client certificate", implicit)
+			}
+		}
+	}
+}
+
+// loopbackPair returns both ends of a buffered TCP connection on the
+// loopback interface.
+func loopbackPair(t *testing.T) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := l.Accept()
+	if err != nil {
+		client.Close()
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+// listenSMTP starts serveSMTP on a loopback listener for each connection,
+// offering STARTTLS if tlsConfig is not nil.
+func listenSMTP(t *testing.T, tlsConfig *tls.Config) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSMTP(conn, tlsConfig)
+		}
+	}()
+	return ln
+}
+
+func TestSendMailLocalName(t *testing.T) {
+	ln := listenSMTP(t, nil)
+	defer ln.Close()
+
+	e := prepareEmail()
+	e.Text = []byte("Hello!\n")
+	for _, test := range []struct {
+		opts []Option
+		ehlo string
+	}{
+		{nil, "C: EHLO localhost"},
+		{[]Option{WithLocalName("client.example.com")}, "C: EHLO client.example.com"},
+	} {
+		var events []string
+		opts := append(test.opts, WithTrace(func(event string) {
+			events = append(events, event)
+		}))
+		if err := SendMail(ln.Addr().String(), nil, e, opts...); err != nil {
+			t.Fatal("Could not send message: ", err)
+		}
+		if len(events) == 0 || events[0] != test.ehlo {
+			t.Errorf("Expected %q as the first command, got %q", test.ehlo, events)
+		}
+	}
+}
+
+func TestSendMailTLSRequired(t *testing.T) {
+	ca := testCertificate(t, "Test CA", nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	clientConfig := &tls.Config{RootCAs: roots}
+
+	e := prepareEmail()
+	e.Text = []byte("Hello!\n")
+
+	plain := listenSMTP(t, nil)
+	defer plain.Close()
+	// Without WithTLSRequired, the message is sent in the clear.
+	if err := SendMail(plain.Addr().String(), nil, e, WithTLSConfig(clientConfig)); err != nil {
+		t.Fatal("Could not send message: ", err)
+	}
+	var events []string
+	trace := WithTrace(func(event string) {
+		events = append(events, event)
+	})
+	err := SendMail(plain.Addr().String(), nil, e, WithTLSConfig(clientConfig), WithTLSRequired(), trace)
+	if err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Errorf("Expected WithTLSRequired to refuse a server without STARTTLS, got %v", err)
+	}
+	for _, event := range events {
+		if strings.HasPrefix(event, "C: MAIL FROM:") {
+			t.Errorf("Mail transaction started without TLS: %q", events)
+		}
+	}
+
+	secure := listenSMTP(t, &tls.Config{Certificates: []tls.Certificate{testCertificate(t, "localhost", &ca)}})
+	defer secure.Close()
+	_, port, err := net.SplitHostPort(secure.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	events = nil
+	if err := SendMail(net.JoinHostPort("localhost", port), nil, e, WithTLSConfig(clientConfig), WithTLSRequired(), trace); err != nil {
+		t.Fatal("Could not send message: ", err)
+	}
+	if log := strings.Join(events, "\n"); !strings.Contains(log, "C: STARTTLS") {
+		t.Errorf("Message was not sent over STARTTLS:\n%s", log)
+	}
+}
@@ -0,0 +1,165 @@
+package email
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"sort"
+	"strings"
+)
+
+// MessageSummary describes the structure of a message, as returned by
+// Email.Summary.
+type MessageSummary struct {
+	Attachments    int      // The number of attachments
+	AttachmentSize int      // The combined decoded size of the attachments in bytes
+	Size           int      // The size of the undecoded message body in bytes
+	HasText        bool     // Whether there is a plain text body
+	HasHTML        bool     // Whether there is an HTML body
+	ContentTypes   []string // The media types of the non-multipart entities, in order
+	Signed         bool     // Whether the message is signed with S/MIME or OpenPGP
+	Encrypted      bool     // Whether the message is encrypted with S/MIME or OpenPGP
+}
+
+// Summary summarizes the structure of the message, such as for an inspection
+// tool. Signatures and encryption are detected from the MIME structure
+// (multipart/signed, multipart/encrypted and application/pkcs7-mime, RFC 1847,
+// 3156 and 8551) and from inline OpenPGP armor in the text body; they are not
+// verified. Encapsulated message/rfc822 entities are listed, but not looked
+// into.
+//
+// Messages parsed with NewEmailFromReader are summarized as they were read;
+// otherwise the message is rendered with Bytes first. If that fails, or the
+// MIME structure is malformed, the summary only has what could be found
+// before the error.
+func (e *Email) Summary() MessageSummary {
+	s := MessageSummary{
+		Attachments: len(e.Attachments),
+		HasText:     len(e.Text) > 0,
+		HasHTML:     len(e.HTML) > 0,
+	}
+	for _, a := range e.Attachments {
+		s.AttachmentSize += len(a.Content)
+	}
+	if root, err := e.rootEntity(); err == nil {
+		s.Size = len(root.Body)
+		s.inspect(root.Header, bytes.NewReader(root.Body))
+	}
+	if bytes.Contains(e.Text, []byte("-----BEGIN PGP SIGNED MESSAGE-----")) {
+		s.Signed = true
+	}
+	if bytes.Contains(e.Text, []byte("-----BEGIN PGP MESSAGE-----")) {
+		s.Encrypted = true
+	}
+	return s
+}
+
+// inspect adds the entity with the header h and body to the summary,
+// recursing into multipart entities.
+func (s *MessageSummary) inspect(h textproto.MIMEHeader, body io.Reader) error {
+	ct, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		ct = "text/plain"
+	}
+	switch ct {
+	case "multipart/signed":
+		s.Signed = true
+	case "multipart/encrypted":
+		s.Encrypted = true
+	case "application/pkcs7-mime", "application/x-pkcs7-mime":
+		// Without an smime-type, as with S/MIME version 2, the content is
+		// most likely enveloped.
+		switch strings.ToLower(params["smime-type"]) {
+		case "signed-data", "certs-only":
+			s.Signed = true
+		default:
+			s.Encrypted = true
+		}
+	}
+	if !strings.HasPrefix(ct, "multipart/") {
+		s.ContentTypes = append(s.ContentTypes, ct)
+		return nil
+	}
+	boundary, err := boundaryParam(params)
+	if err != nil {
+		return err
+	}
+	mr := multipart.NewReader(body, boundary)
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, ok := p.Header["Content-Type"]; !ok {
+			p.Header.Set("Content-Type", defaultContentType)
+		}
+		if err := s.inspect(p.Header, p); err != nil {
+			return err
+		}
+	}
+}
+
+// DecodedSize returns the size in bytes of the content of the message as its
+// recipient sees it: the plain text, HTML and alternative bodies and the
+// decoded attachments. Together with WireSize, it tells the overhead of
+// encoding the message for transport.
+func (e *Email) DecodedSize() int64 {
+	n := int64(len(e.Text) + len(e.HTML))
+	for _, alt := range e.alternatives {
+		n += int64(len(alt.body))
+	}
+	for _, a := range e.Attachments {
+		n += int64(len(a.Content))
+	}
+	return n
+}
+
+// WireSize returns the size in bytes of the message as it is transferred,
+// with its header and encoded bodies. Messages parsed with NewEmailFromReader
+// are measured as they were read, as long as their headers, bodies and
+// attachments are unchanged; otherwise the message is rendered to measure
+// it, which is what sending it would transfer apart from the SMTP
+// dot-stuffing.
+func (e *Email) WireSize() (int64, error) {
+	if e.wireSize > 0 && e.contentSum() == e.rawSum && e.headerSum() == e.rawHeaderSum {
+		return e.wireSize, nil
+	}
+	return e.WriteTo(ioutil.Discard)
+}
+
+// headerSum returns a hash of the fields of e which are rendered into the
+// message header, so that changes to them can be detected.
+func (e *Email) headerSum() uint64 {
+	h := fnv.New64a()
+	field := func(s string) {
+		var n [8]byte
+		binary.LittleEndian.PutUint64(n[:], uint64(len(s)))
+		h.Write(n[:])
+		io.WriteString(h, s)
+	}
+	field(e.From)
+	field(e.Sender)
+	field(e.Subject)
+	field(e.RawSubject)
+	for _, list := range [][]string{e.To, e.Cc, e.Bcc, e.ReplyTo, e.ReadReceipt} {
+		field(strings.Join(list, "\x00"))
+	}
+	keys := make([]string, 0, len(e.Headers))
+	for k := range e.Headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		field(k)
+		field(strings.Join(e.Headers[k], "\x00"))
+	}
+	return h.Sum64()
+}
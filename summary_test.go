@@ -0,0 +1,181 @@
+package email
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestSummary(t *testing.T) {
+	e := prepareEmail()
+	e.Text = []byte("Text Body is, of course, supported!\n")
+	e.HTML = []byte("<h1>Fancy Html is supported, too!</h1>\n")
+	if _, err := e.Attach(bytes.NewBufferString("Rad attachment"), "rad.txt", "text/plain; charset=utf-8"); err != nil {
+		t.Fatal("Could not add an attachment to the message: ", err)
+	}
+	raw, err := e.Bytes()
+	if err != nil {
+		t.Fatal("Failed to render message: ", err)
+	}
+	parsed, err := NewEmailFromReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal("Could not parse rendered message: ", err)
+	}
+	for _, m := range []*Email{e, parsed} {
+		s := m.Summary()
+		if s.Attachments != 1 || s.AttachmentSize != len("Rad attachment") {
+			t.Errorf("Incorrect attachments: %d, %d bytes", s.Attachments, s.AttachmentSize)
+		}
+		if !s.HasText || !s.HasHTML || s.Signed || s.Encrypted {
+			t.Errorf("Incorrect summary: %+v", s)
+		}
+		if s.Size == 0 {
+			t.Error("Expected a non-zero size")
+		}
+		if got, want := strings.Join(s.ContentTypes, " "), "text/plain text/html text/plain"; got != want {
+			t.Errorf("Incorrect content types: %#q != %#q", got, want)
+		}
+	}
+}
+
+func TestSummarySignedEncrypted(t *testing.T) {
+	var cases = []struct {
+		name              string
+		raw               string
+		signed, encrypted bool
+		contentTypes      string
+	}{
+		{
+			"PGP/MIME signed",
+			"From: test@example.com\r\n" +
+				"Content-Type: multipart/signed; micalg=pgp-sha256;\r\n" +
+				" protocol=\"application/pgp-signature\"; boundary=\"sig\"\r\n" +
+				"\r\n" +
+				"--sig\r\n" +
+				"Content-Type: text/plain\r\n" +
+				"\r\n" +
+				"Signed text\r\n" +
+				"--sig\r\n" +
+				"Content-Type: application/pgp-signature\r\n" +
+				"\r\n" +
+				"-----BEGIN PGP SIGNATURE-----\r\n" +
+				"--sig--\r\n",
+			true, false, "text/plain application/pgp-signature",
+		},
+		{
+			"S/MIME encrypted",
+			"From: test@example.com\r\n" +
+				"Content-Type: application/pkcs7-mime; smime-type=enveloped-data; name=smime.p7m\r\n" +
+				"Content-Transfer-Encoding: base64\r\n" +
+				"\r\n" +
+				"AAAA\r\n",
+			false, true, "application/pkcs7-mime",
+		},
+		{
+			"S/MIME opaque signed",
+			"From: test@example.com\r\n" +
+				"Content-Type: application/pkcs7-mime; smime-type=signed-data; name=smime.p7m\r\n" +
+				"Content-Transfer-Encoding: base64\r\n" +
+				"\r\n" +
+				"AAAA\r\n",
+			true, false, "application/pkcs7-mime",
+		},
+		{
+			"Inline PGP encrypted",
+			"From: test@example.com\r\n" +
+				"Content-Type: text/plain\r\n" +
+				"\r\n" +
+				"-----BEGIN PGP MESSAGE-----\r\n" +
+				"-----END PGP MESSAGE-----\r\n",
+			false, true, "text/plain",
+		},
+	}
+	for _, c := range cases {
+		e, err := NewEmailFromReader(strings.NewReader(c.raw))
+		if err != nil {
+			t.Errorf("%s: could not parse message: %s", c.name, err)
+			continue
+		}
+		s := e.Summary()
+		if s.Signed != c.signed || s.Encrypted != c.encrypted {
+			t.Errorf("%s: incorrect signed %v, encrypted %v", c.name, s.Signed, s.Encrypted)
+		}
+		if got := strings.Join(s.ContentTypes, " "); got != c.contentTypes {
+			t.Errorf("%s: incorrect content types: %#q != %#q", c.name, got, c.contentTypes)
+		}
+	}
+}
+
+func TestDecodedAndWireSize(t *testing.T) {
+	raw := "From: Jordan Wright <jmwright798@gmail.com>\r\n" +
+		"To: Jordan Wright <jmwright798@gmail.com>\r\n" +
+		"Subject: Test Subject\r\n" +
+		"Message-Id: <size@example.com>\r\n" +
+		"Mime-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=abc123\r\n" +
+		"\r\n" +
+		"--abc123\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"Content-Type: text/html; charset=UTF-8\r\n" +
+		"\r\n" +
+		"<div dir=3D\"ltr\">Simple HTML body</div>\r\n" +
+		"--abc123\r\n" +
+		"Content-Disposition: attachment; filename=\"cat.jpeg\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"Content-Type: image/jpeg\r\n" +
+		"\r\n" +
+		"TGV0J3MganVzdCBwcmV0ZW5kIHRoaXMgaXMgcmF3IEpQRUcgZGF0YS4=\r\n" +
+		"--abc123\r\n" +
+		"Content-Disposition: attachment; filename=\"cat2.jpeg\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"Content-Type: image/jpeg\r\n" +
+		"\r\n" +
+		"TGV0J3MganVzdCBwcmV0ZW5kIHRoaXMgaXMgcmF3IEpQRUcgZGF0YS4=\r\n" +
+		"--abc123--\r\n"
+	e, err := NewEmailFromReader(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal("Could not parse message: ", err)
+	}
+	want := len(`<div dir="ltr">Simple HTML body</div>`) + 2*len("Let's just pretend this is raw JPEG data.")
+	if got := e.DecodedSize(); got != int64(want) {
+		t.Errorf("Incorrect decoded size: %d != %d", got, want)
+	}
+	if got, err := e.WireSize(); err != nil || got != int64(len(raw)) {
+		t.Errorf("Incorrect wire size: %d != %d, %v", got, len(raw), err)
+	}
+	// Once the message is changed, it is measured as it would be sent.
+	for _, change := range []func(e *Email){
+		func(e *Email) { e.HTML = append(e.HTML, "<p>More</p>"...) },
+		func(e *Email) { e.Attachments = e.Attachments[:1] },
+		func(e *Email) { e.Subject = "Changed" },
+		func(e *Email) { e.Headers.Set("X-Changed", "yes") },
+	} {
+		e, err := NewEmailFromReader(strings.NewReader(raw))
+		if err != nil {
+			t.Fatal("Could not parse message: ", err)
+		}
+		change(e)
+		rendered, err := e.Bytes()
+		if err != nil {
+			t.Fatal("Failed to render message: ", err)
+		}
+		if got, err := e.WireSize(); err != nil || got != int64(len(rendered)) {
+			t.Errorf("Incorrect wire size of a changed message: %d, rendered %d, read %d, %v", got, len(rendered), len(raw), err)
+		}
+	}
+
+	e = prepareEmail()
+	e.Text = []byte("Text Body is, of course, supported!\n")
+	e.Headers.Set("Date", "Thu, 17 Oct 2019 08:55:37 +0100")
+	e.Headers.Set("Message-Id", "<size@example.com>")
+	rendered, err := e.Bytes()
+	if err != nil {
+		t.Fatal("Failed to render message: ", err)
+	}
+	if got := e.DecodedSize(); got != int64(len(e.Text)) {
+		t.Errorf("Incorrect decoded size: %d != %d", got, len(e.Text))
+	}
+	if got, err := e.WireSize(); err != nil || got != int64(len(rendered)) {
+		t.Errorf("Incorrect wire size: %d != %d, %v", got, len(rendered), err)
+	}
+}
@@ -0,0 +1,145 @@
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// traceClient makes c report each command it sends and each response line it
+// receives to trace, as "C: <command>" and "S: <response>". Credentials sent
+// during AUTH are redacted, and message content is summarized by its length.
+//
+// It must be called again after StartTLS, which replaces c.Text. The greeting
+// and the EHLO that StartTLS sends itself are not reported.
+func traceClient(c *smtp.Client, trace func(event string)) {
+	old := c.Text
+	c.Text = textproto.NewConn(&traceConn{r: old.R, w: old.W, c: old, trace: trace})
+}
+
+// traceConn sits between a textproto.Conn and the buffers of the one it
+// replaces, splitting the traffic into lines to be traced.
+type traceConn struct {
+	r     *bufio.Reader
+	w     *bufio.Writer
+	c     io.Closer
+	trace func(string)
+
+	rline, wline []byte
+	pending      []string // verbs of the commands awaiting a response, which may be pipelined
+	auth         bool     // the client is in an AUTH exchange
+	data         bool     // the client is sending message content
+	dataLen      int
+	skip         int // bytes of BDAT content still to be sent
+}
+
+func (t *traceConn) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	t.rline = append(t.rline, p[:n]...)
+	for {
+		i := bytes.IndexByte(t.rline, '\n')
+		if i < 0 {
+			break
+		}
+		t.response(strings.TrimRight(string(t.rline[:i]), "\r"))
+		t.rline = t.rline[i+1:]
+	}
+	return n, err
+}
+
+func (t *traceConn) Write(p []byte) (int, error) {
+	n, err := t.w.Write(p)
+	if err == nil {
+		err = t.w.Flush()
+	}
+	b := p[:n]
+	for len(b) > 0 {
+		if t.skip > 0 {
+			k := t.skip
+			if k > len(b) {
+				k = len(b)
+			}
+			t.skip -= k
+			b = b[k:]
+			continue
+		}
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			t.wline = append(t.wline, b...)
+			break
+		}
+		t.wline = append(t.wline, b[:i+1]...)
+		b = b[i+1:]
+		t.command(strings.TrimRight(string(t.wline), "\r\n"))
+		t.wline = t.wline[:0]
+	}
+	return n, err
+}
+
+func (t *traceConn) Close() error {
+	return t.c.Close()
+}
+
+func (t *traceConn) command(line string) {
+	if t.data {
+		if line != "." {
+			t.dataLen += len(line) + 2
+			return
+		}
+		t.trace(fmt.Sprintf("C: <%d bytes of message content>", t.dataLen))
+		t.data, t.dataLen = false, 0
+		t.trace("C: .")
+		return
+	}
+	if t.auth {
+		t.pending = append(t.pending, "AUTH")
+		t.trace("C: <redacted>")
+		return
+	}
+	fields := strings.Fields(line)
+	verb := ""
+	if len(fields) > 0 {
+		verb = strings.ToUpper(fields[0])
+	}
+	switch verb {
+	case "AUTH":
+		t.auth = true
+		if len(fields) > 2 {
+			line = fields[0] + " " + fields[1] + " <redacted>"
+		}
+	case "BDAT":
+		if len(fields) > 1 {
+			t.skip, _ = strconv.Atoi(fields[1])
+		}
+	}
+	t.pending = append(t.pending, verb)
+	t.trace("C: " + line)
+}
+
+func (t *traceConn) response(line string) {
+	t.trace("S: " + line)
+	// Only the last line of a multiline response ends the exchange.
+	if len(line) >= 4 && line[3] == '-' {
+		return
+	}
+	if len(t.pending) == 0 {
+		return
+	}
+	verb := t.pending[0]
+	t.pending = t.pending[1:]
+	code := line
+	if len(code) > 3 {
+		code = code[:3]
+	}
+	switch verb {
+	case "AUTH":
+		t.auth = code == "334"
+	case "DATA":
+		t.data = code == "354"
+	}
+}
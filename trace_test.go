@@ -0,0 +1,186 @@
+package email
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveSMTP answers a single SMTP session on conn with canned responses. If
+// tlsConfig is not nil, STARTTLS is offered, and the session fails if the
+// handshake does. REQUIRETLS is offered once the session is secure.
+func serveSMTP(conn net.Conn, tlsConfig *tls.Config) {
+	// conn is replaced by the TLS connection after STARTTLS.
+	defer func() {
+		conn.Close()
+	}()
+	r := bufio.NewReader(conn)
+	conn.Write([]byte("220 localhost ESMTP\r\n"))
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch verb := strings.ToUpper(strings.Fields(line + " x")[0]); verb {
+		case "EHLO":
+			conn.Write([]byte("250-localhost\r\n"))
+			if _, ok := conn.(*tls.Conn); ok {
+				conn.Write([]byte("250-REQUIRETLS\r\n"))
+			} else if tlsConfig != nil {
+				conn.Write([]byte("250-STARTTLS\r\n"))
+			}
+			conn.Write([]byte("250-AUTH PLAIN\r\n250-DSN\r\n250-SIZE 1000000\r\n250-SMTPUTF8\r\n250 8BITMIME\r\n"))
+		case "STARTTLS":
+			conn.Write([]byte("220 2.0.0 Ready to start TLS\r\n"))
+			tlsConn := tls.Server(conn, tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn = tlsConn
+			r = bufio.NewReader(conn)
+		case "AUTH":
+			conn.Write([]byte("235 2.7.0 Authentication successful\r\n"))
+		case "DATA":
+			conn.Write([]byte("354 Go ahead\r\n"))
+			for {
+				if line, err = r.ReadString('\n'); err != nil || line == ".\r\n" {
+					break
+				}
+			}
+			conn.Write([]byte("250 2.0.0 Queued\r\n"))
+		case "QUIT":
+			conn.Write([]byte("221 2.0.0 Bye\r\n"))
+			return
+		default:
+			conn.Write([]byte("250 2.0.0 OK\r\n"))
+		}
+	}
+}
+
+func TestSendMailTrace(t *testing.T) {
+	client, server := net.Pipe()
+	go serveSMTP(server, nil)
+
+	e := prepareEmail()
+	e.Text = []byte("Hello!\n")
+	var events []string
+	o := &sendOptions{localName: "client.example.com", trace: func(event string) {
+		events = append(events, event)
+	}}
+	auth := smtp.PlainAuth("", "user", "secret", "localhost")
+	raw, err := e.Bytes()
+	if err != nil {
+		t.Fatal("Could not serialize e-mail:", err)
+	}
+	if err := sendMail(client, "localhost", auth, nil, o, e, "test@example.com", []string{"test@example.com"}, raw); err != nil {
+		t.Fatal("Could not send message: ", err)
+	}
+
+	log := strings.Join(events, "\n")
+	for _, want := range []string{
+		"C: EHLO client.example.com",
+		"S: 250-AUTH PLAIN",
+		"C: AUTH PLAIN <redacted>",
+		"S: 235 2.7.0 Authentication successful",
+		"C: MAIL FROM:<test@example.com>",
+		"C: RCPT TO:<test@example.com>",
+		"C: DATA",
+		"S: 354 Go ahead",
+		"bytes of message content>",
+		"S: 250 2.0.0 Queued",
+		"C: QUIT",
+	} {
+		if !strings.Contains(log, want) {
+			t.Errorf("Trace is missing %q:\n%s", want, log)
+		}
+	}
+	if strings.Contains(log, "c2VjcmV0") || strings.Contains(log, "AHVzZXIAc2VjcmV0") || strings.Contains(log, "Hello!") {
+		t.Errorf("Trace leaked credentials or message content:\n%s", log)
+	}
+}
+
+func TestPoolMailOptions(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSMTP(conn, nil)
+		}
+	}()
+
+	p, err := NewPool(ln.Addr().String(), 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	mailCmds := make(chan string, 1)
+	p.SetTrace(func(event string) {
+		if strings.HasPrefix(event, "C: MAIL FROM:") {
+			mailCmds <- event
+		}
+	})
+	e := prepareEmail()
+	e.Text = []byte("Hello!\n")
+	if err := p.SendWithOptions(e, 5*time.Second, &MailOptions{Size: 1234, UTF8: true, Auth: "user+1@example.com"}); err != nil {
+		t.Fatal("Could not send message: ", err)
+	}
+	mailCmd := <-mailCmds
+	for _, want := range []string{" SIZE=1234", " SMTPUTF8", " AUTH=user+2B1@example.com"} {
+		if !strings.Contains(mailCmd, want) {
+			t.Errorf("MAIL command %q is missing %q", mailCmd, want)
+		}
+	}
+
+	// Options the server doesn't support, or allow, fail the send.
+	if err := p.SendWithOptions(e, 5*time.Second, &MailOptions{Size: 2000000}); err == nil {
+		t.Error("Expected an error declaring a size over the server limit")
+	}
+}
+
+func TestRequireTLSTrace(t *testing.T) {
+	ca := testCertificate(t, "Test CA", nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	clientConfig := &tls.Config{RootCAs: roots, ServerName: "localhost"}
+	ln := listenSMTP(t, &tls.Config{Certificates: []tls.Certificate{testCertificate(t, "localhost", &ca)}})
+	defer ln.Close()
+
+	e := prepareEmail()
+	e.Text = []byte("Hello!\n")
+	e.RequireTLS = true
+	mailCmds := make(chan string, 2)
+	trace := func(event string) {
+		if strings.HasPrefix(event, "C: MAIL FROM:") {
+			mailCmds <- event
+		}
+	}
+	if err := SendMail(ln.Addr().String(), nil, e, WithTLSConfig(clientConfig), WithTrace(trace)); err != nil {
+		t.Fatal("Could not send message: ", err)
+	}
+	p, err := NewPool(ln.Addr().String(), 1, nil, clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	p.SetTrace(trace)
+	if err := p.Send(e, 5*time.Second); err != nil {
+		t.Fatal("Could not send message: ", err)
+	}
+	for _, via := range []string{"SendMail", "Pool"} {
+		if mailCmd := <-mailCmds; !strings.HasSuffix(mailCmd, " REQUIRETLS") {
+			t.Errorf("%s: MAIL command %q is missing REQUIRETLS", via, mailCmd)
+		}
+	}
+}